@@ -0,0 +1,45 @@
+// Command ugo-dap is a Debug Adapter Protocol server for uGO scripts. It serves
+// a single session over standard input and output by default, or serves the
+// sessions one at a time over TCP if -listen flag is given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+var listen = flag.String("listen", "", "serve over TCP at given address:port instead of stdio")
+
+func main() {
+	flag.Parse()
+	log.SetOutput(os.Stderr)
+
+	if *listen == "" {
+		if err := newSession(os.Stdin, os.Stdout).serve(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to listen", err)
+		os.Exit(1)
+	}
+	log.Printf("listening at %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// builtin print functions write to a global writer, so sessions cannot
+		// run concurrently
+		if err := newSession(conn, conn).serve(); err != nil {
+			log.Print(err)
+		}
+		_ = conn.Close()
+	}
+}
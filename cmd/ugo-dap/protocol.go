@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Debug Adapter Protocol messages, only the fields used by the adapter are
+// declared. See https://microsoft.github.io/debug-adapter-protocol/specification
+
+type message struct {
+	Seq  int    `json:"seq"`
+	Type string `json:"type"`
+}
+
+type request struct {
+	message
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type response struct {
+	message
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type event struct {
+	message
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+type launchArguments struct {
+	Program     string   `json:"program"`
+	Args        []string `json:"args"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+	NoDebug     bool     `json:"noDebug"`
+}
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type sourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+type setBreakpointsArguments struct {
+	Source      source             `json:"source"`
+	Breakpoints []sourceBreakpoint `json:"breakpoints"`
+}
+
+type breakpoint struct {
+	Verified bool    `json:"verified"`
+	Line     int     `json:"line,omitempty"`
+	Source   *source `json:"source,omitempty"`
+	Message  string  `json:"message,omitempty"`
+}
+
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type stackTraceArguments struct {
+	ThreadID   int `json:"threadId"`
+	StartFrame int `json:"startFrame"`
+	Levels     int `json:"levels"`
+}
+
+type stackFrame struct {
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Source *source `json:"source,omitempty"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+}
+
+type scopesArguments struct {
+	FrameID int `json:"frameId"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// readMessage reads a message with its base protocol header and decodes it
+// into v.
+func readMessage(r *bufio.Reader, v any) error {
+	tr := textproto.NewReader(r)
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(header) == 0 {
+			return io.EOF
+		}
+		return err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(header.Get("Content-Length")))
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid Content-Length header: %q",
+			header.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// writeMessage writes v as JSON with the base protocol header.
+func writeMessage(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
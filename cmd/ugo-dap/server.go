@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/importers"
+	ugofmt "github.com/ozanh/ugo/stdlib/fmt"
+	ugojson "github.com/ozanh/ugo/stdlib/json"
+	ugostrings "github.com/ozanh/ugo/stdlib/strings"
+	ugotime "github.com/ozanh/ugo/stdlib/time"
+
+	"github.com/ozanh/ugodev/debugger"
+)
+
+// threadID is the id of the only thread running the script.
+const threadID = 1
+
+var errNotLaunched = errors.New("program is not launched")
+
+// session serves a debug session for a single client.
+type session struct {
+	r   *bufio.Reader
+	wmu sync.Mutex
+	w   io.Writer
+	seq int
+
+	mu         sync.Mutex
+	bc         *ugo.Bytecode
+	dbg        *debugger.Debugger
+	vm         *ugo.VM
+	args       []ugo.Object
+	configured bool
+	state      *debugger.State
+	refs       []varRef
+	done       chan struct{}
+	out        *outputWriter
+}
+
+// varRef is the target of a variables reference, either a list of variables
+// or an object to expand.
+type varRef struct {
+	vars []debugger.Variable
+	obj  ugo.Object
+}
+
+func newSession(r io.Reader, w io.Writer) *session {
+	return &session{r: bufio.NewReader(r), w: w}
+}
+
+// serve handles the requests until the client disconnects.
+func (s *session) serve() error {
+	defer s.stop()
+
+	for {
+		var req request
+		if err := readMessage(s.r, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		body, err := s.handle(&req)
+		resp := response{
+			message:    message{Type: "response"},
+			RequestSeq: req.Seq,
+			Success:    err == nil,
+			Command:    req.Command,
+			Body:       body,
+		}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		if err := s.send(&resp, &resp.message); err != nil {
+			return err
+		}
+		if !resp.Success {
+			continue
+		}
+
+		switch req.Command {
+		case "launch":
+			s.sendEvent("initialized", nil)
+		case "configurationDone":
+			s.start()
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+func (s *session) handle(req *request) (any, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		var args launchArguments
+		if err := unmarshalArgs(req, &args); err != nil {
+			return nil, err
+		}
+		return nil, s.launch(&args)
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if err := unmarshalArgs(req, &args); err != nil {
+			return nil, err
+		}
+		return s.setBreakpoints(&args), nil
+	case "configurationDone":
+		return nil, nil
+	case "threads":
+		return map[string]any{
+			"threads": []thread{{ID: threadID, Name: "main"}},
+		}, nil
+	case "stackTrace":
+		var args stackTraceArguments
+		if err := unmarshalArgs(req, &args); err != nil {
+			return nil, err
+		}
+		return s.stackTrace(&args)
+	case "scopes":
+		var args scopesArguments
+		if err := unmarshalArgs(req, &args); err != nil {
+			return nil, err
+		}
+		return s.scopes(&args)
+	case "variables":
+		var args variablesArguments
+		if err := unmarshalArgs(req, &args); err != nil {
+			return nil, err
+		}
+		return s.variables(&args)
+	case "continue":
+		return map[string]any{"allThreadsContinued": true},
+			s.resume((*debugger.Debugger).Continue)
+	case "next":
+		return nil, s.resume((*debugger.Debugger).StepOver)
+	case "stepIn":
+		return nil, s.resume((*debugger.Debugger).StepIn)
+	case "stepOut":
+		return nil, s.resume((*debugger.Debugger).StepOut)
+	case "pause":
+		dbg := s.debugger()
+		if dbg == nil {
+			return nil, errNotLaunched
+		}
+		dbg.Pause()
+		return nil, nil
+	case "terminate", "disconnect":
+		s.stop()
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported command: %s", req.Command)
+	}
+}
+
+func unmarshalArgs(req *request, v any) error {
+	if len(req.Arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(req.Arguments, v); err != nil {
+		return fmt.Errorf("invalid arguments of %s: %w", req.Command, err)
+	}
+	return nil
+}
+
+func (s *session) launch(args *launchArguments) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bc != nil {
+		return errors.New("program is already launched")
+	}
+	if args.Program == "" {
+		return errors.New("program is required")
+	}
+	path, err := filepath.Abs(args.Program)
+	if err != nil {
+		return err
+	}
+	script, err := importers.ShebangReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	s.out = &outputWriter{s: s, category: "stdout"}
+	opts := ugo.CompilerOptions{
+		SymbolTable: ugo.NewSymbolTable(),
+		ModuleMap:   defaultModuleMap(filepath.Dir(path), s.out),
+		ModulePath:  path,
+	}
+	bc, err := ugo.Compile(script, opts)
+	if err != nil {
+		return err
+	}
+	if !args.NoDebug {
+		s.dbg, err = debugger.New(bc, debugger.Options{
+			SymbolTable: opts.SymbolTable,
+			StopOnEntry: args.StopOnEntry,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	s.bc = bc
+	for _, arg := range args.Args {
+		s.args = append(s.args, ugo.String(arg))
+	}
+	return nil
+}
+
+func defaultModuleMap(workdir string, out io.Writer) *ugo.ModuleMap {
+	return ugo.NewModuleMap().
+		AddBuiltinModule("time", ugotime.Module).
+		AddBuiltinModule("strings", ugostrings.Module).
+		AddBuiltinModule("fmt", fmtModule(out)).
+		AddBuiltinModule("json", ugojson.Module).
+		SetExtImporter(
+			&importers.FileImporter{
+				WorkDir:    workdir,
+				FileReader: importers.ShebangReadFile,
+			},
+		)
+}
+
+// fmtModule returns a copy of the fmt module whose print functions write to w
+// instead of os.Stdout, which is the protocol stream in stdio mode.
+func fmtModule(w io.Writer) ugo.Map {
+	m := make(ugo.Map, len(ugofmt.Module))
+	for k, v := range ugofmt.Module {
+		m[k] = v
+	}
+	for name, sprint := range map[string]string{
+		"Print":   "Sprint",
+		"Printf":  "Sprintf",
+		"Println": "Sprintln",
+	} {
+		m[name] = printFunc(w, name, m[sprint].(*ugo.Function))
+	}
+	return m
+}
+
+// printFunc returns a function writing the result of given sprint function to
+// w.
+func printFunc(w io.Writer, name string, sprint *ugo.Function) *ugo.Function {
+	fn := func(c ugo.Call) (ugo.Object, error) {
+		ret, err := sprint.ValueEx(c)
+		if err != nil {
+			return ugo.Undefined, err
+		}
+		n, err := io.WriteString(w, ret.String())
+		return ugo.Int(n), err
+	}
+	return &ugo.Function{
+		Name: name,
+		Value: func(args ...ugo.Object) (ugo.Object, error) {
+			return fn(ugo.NewCall(nil, args))
+		},
+		ValueEx: fn,
+	}
+}
+
+func (s *session) debugger() *debugger.Debugger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dbg
+}
+
+func (s *session) setBreakpoints(args *setBreakpointsArguments) any {
+	path := args.Source.Path
+	if p, err := filepath.Abs(path); err == nil {
+		path = p
+	}
+
+	dbg := s.debugger()
+	if dbg != nil {
+		for _, loc := range dbg.Breakpoints() {
+			if loc.File == path {
+				dbg.ClearBreakpoint(loc.File, loc.Line)
+			}
+		}
+	}
+	bps := make([]breakpoint, 0, len(args.Breakpoints))
+	for _, sbp := range args.Breakpoints {
+		bp := breakpoint{Line: sbp.Line, Source: &args.Source}
+		switch {
+		case dbg == nil:
+			bp.Message = errNotLaunched.Error()
+		case dbg.SetBreakpoint(path, sbp.Line):
+			bp.Verified = true
+		default:
+			bp.Message = "no code at line"
+		}
+		bps = append(bps, bp)
+	}
+	return map[string]any{"breakpoints": bps}
+}
+
+// start runs the launched program in a new goroutine once configuration is
+// done.
+func (s *session) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bc == nil || s.configured {
+		return
+	}
+	s.configured = true
+	s.vm = ugo.NewVM(s.bc).SetRecover(true)
+	s.done = make(chan struct{})
+
+	// builtin print functions write to the global writer, redirect it to the
+	// client to keep the protocol stream intact in stdio mode until the
+	// program exits
+	printWriter := ugo.PrintWriter
+	ugo.PrintWriter = s.out
+
+	vm, args, done := s.vm, s.args, s.done
+	if s.dbg != nil {
+		go s.watchStops(s.dbg, done)
+	}
+	go func() {
+		defer close(done)
+		_, err := vm.Run(ugo.Map{}, args...)
+		ugo.PrintWriter = printWriter
+		exitCode := 0
+		if err != nil {
+			exitCode = 1
+			s.sendEvent("output", map[string]any{
+				"category": "stderr",
+				"output":   err.Error() + "\n",
+			})
+		}
+		s.sendEvent("exited", map[string]any{"exitCode": exitCode})
+		s.sendEvent("terminated", nil)
+	}()
+}
+
+func (s *session) watchStops(dbg *debugger.Debugger, done <-chan struct{}) {
+	for {
+		select {
+		case st := <-dbg.Stops():
+			s.mu.Lock()
+			s.state = st
+			s.refs = s.refs[:0]
+			s.mu.Unlock()
+			s.sendEvent("stopped", map[string]any{
+				"reason":            st.Reason.String(),
+				"threadId":          threadID,
+				"allThreadsStopped": true,
+			})
+		case <-done:
+			return
+		}
+	}
+}
+
+// stop aborts the running program.
+func (s *session) stop() {
+	s.mu.Lock()
+	dbg, vm, done := s.dbg, s.vm, s.done
+	s.mu.Unlock()
+
+	if vm == nil {
+		return
+	}
+	vm.Abort()
+	if dbg != nil {
+		dbg.Detach()
+	}
+	<-done
+}
+
+func (s *session) resume(cmd func(*debugger.Debugger) error) error {
+	s.mu.Lock()
+	dbg := s.dbg
+	s.state = nil
+	s.refs = s.refs[:0]
+	s.mu.Unlock()
+
+	if dbg == nil {
+		return errNotLaunched
+	}
+	return cmd(dbg)
+}
+
+func (s *session) pausedState() (*debugger.State, error) {
+	if s.state == nil {
+		return nil, debugger.ErrNotPaused
+	}
+	return s.state, nil
+}
+
+func (s *session) stackTrace(args *stackTraceArguments) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.pausedState()
+	if err != nil {
+		return nil, err
+	}
+	start := args.StartFrame
+	if start < 0 || start > len(st.Frames) {
+		start = len(st.Frames)
+	}
+	end := len(st.Frames)
+	if args.Levels > 0 && start+args.Levels < end {
+		end = start + args.Levels
+	}
+	frames := make([]stackFrame, 0, end-start)
+	for i := start; i < end; i++ {
+		fr := st.Frames[i]
+		sf := stackFrame{
+			ID:     i + 1,
+			Name:   fr.Func,
+			Line:   fr.Line,
+			Column: fr.Column,
+		}
+		if filepath.IsAbs(fr.File) {
+			sf.Source = &source{Name: filepath.Base(fr.File), Path: fr.File}
+		} else if fr.File != "" {
+			sf.Source = &source{Name: fr.File}
+		}
+		frames = append(frames, sf)
+	}
+	return map[string]any{
+		"stackFrames": frames,
+		"totalFrames": len(st.Frames),
+	}, nil
+}
+
+func (s *session) scopes(args *scopesArguments) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.pausedState()
+	if err != nil {
+		return nil, err
+	}
+	i := args.FrameID - 1
+	if i < 0 || i >= len(st.Frames) {
+		return nil, fmt.Errorf("invalid frame id: %d", args.FrameID)
+	}
+	scopes := []scope{{
+		Name:               "Locals",
+		VariablesReference: s.addRef(varRef{vars: st.Frames[i].Locals}),
+	}}
+	if st.Globals != nil {
+		scopes = append(scopes, scope{
+			Name:               "Globals",
+			VariablesReference: s.addRef(varRef{obj: st.Globals}),
+		})
+	}
+	return map[string]any{"scopes": scopes}, nil
+}
+
+func (s *session) variables(args *variablesArguments) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.pausedState(); err != nil {
+		return nil, err
+	}
+	i := args.VariablesReference - 1
+	if i < 0 || i >= len(s.refs) {
+		return nil, fmt.Errorf("invalid variables reference: %d",
+			args.VariablesReference)
+	}
+	vars := s.refs[i].vars
+	if vars == nil {
+		vars = children(s.refs[i].obj)
+	}
+	out := make([]variable, 0, len(vars))
+	for _, v := range vars {
+		out = append(out, s.variable(v))
+	}
+	return map[string]any{"variables": out}, nil
+}
+
+func (s *session) addRef(ref varRef) int {
+	s.refs = append(s.refs, ref)
+	return len(s.refs)
+}
+
+func (s *session) variable(v debugger.Variable) variable {
+	out := variable{Name: v.Name, Value: "undefined", Type: "undefined"}
+	if v.Value == nil {
+		return out
+	}
+	out.Type = v.Value.TypeName()
+	if str, ok := v.Value.(ugo.String); ok {
+		out.Value = strconv.Quote(string(str))
+	} else {
+		out.Value = v.Value.String()
+	}
+	if hasChildren(v.Value) {
+		out.VariablesReference = s.addRef(varRef{obj: v.Value})
+	}
+	return out
+}
+
+func hasChildren(obj ugo.Object) bool {
+	switch v := obj.(type) {
+	case ugo.Array:
+		return len(v) > 0
+	case ugo.Map:
+		return len(v) > 0
+	case *ugo.SyncMap:
+		return len(v.Value) > 0
+	default:
+		return false
+	}
+}
+
+// children returns the elements of the container objects.
+func children(obj ugo.Object) []debugger.Variable {
+	var m ugo.Map
+	switch v := obj.(type) {
+	case ugo.Array:
+		vars := make([]debugger.Variable, 0, len(v))
+		for i, elem := range v {
+			vars = append(vars, debugger.Variable{
+				Name:  fmt.Sprintf("[%d]", i),
+				Value: elem,
+			})
+		}
+		return vars
+	case ugo.Map:
+		m = v
+	case *ugo.SyncMap:
+		// the program is paused, it is safe to read the map
+		m = v.Value
+	default:
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	vars := make([]debugger.Variable, 0, len(keys))
+	for _, k := range keys {
+		vars = append(vars, debugger.Variable{Name: k, Value: m[k]})
+	}
+	return vars
+}
+
+// send writes the message after setting its sequence number.
+func (s *session) send(v any, msg *message) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.seq++
+	msg.Seq = s.seq
+	return writeMessage(s.w, v)
+}
+
+func (s *session) sendEvent(name string, body any) {
+	ev := event{message: message{Type: "event"}, Event: name, Body: body}
+	_ = s.send(&ev, &ev.message)
+}
+
+// outputWriter sends the written data to the client as output events.
+type outputWriter struct {
+	s        *session
+	category string
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.s.sendEvent("output", map[string]any{
+		"category": w.category,
+		"output":   string(p),
+	})
+	return len(p), nil
+}
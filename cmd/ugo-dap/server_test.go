@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugo"
+)
+
+const testScript = `param arg
+add := func(a, b) {
+	c := a + b
+	return c
+}
+x := add(1, 2)
+println(arg, x)
+m := {a: [1, 2]}
+return m
+`
+
+type testMessage struct {
+	Type       string          `json:"type"`
+	Seq        int             `json:"seq"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Command    string          `json:"command"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// testClient is a minimal Debug Adapter Protocol client.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	seq    int
+	msgs   chan *testMessage
+	events []*testMessage
+}
+
+func newTestClient(t *testing.T) *testClient {
+	server, conn := net.Pipe()
+	go func() {
+		defer server.Close()
+		_ = newSession(server, server).serve()
+	}()
+
+	c := &testClient{t: t, conn: conn, msgs: make(chan *testMessage, 100)}
+	go func() {
+		defer close(c.msgs)
+		r := bufio.NewReader(conn)
+		for {
+			var msg testMessage
+			if err := readMessage(r, &msg); err != nil {
+				return
+			}
+			c.msgs <- &msg
+		}
+	}()
+	t.Cleanup(func() { _ = conn.Close() })
+	return c
+}
+
+func (c *testClient) next() *testMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		require.True(c.t, ok, "connection closed")
+		require.Greater(c.t, msg.Seq, 0)
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timeout")
+	}
+	return nil
+}
+
+// request sends a request and decodes the body of its successful response into
+// body if it is not nil. Events received meanwhile are queued.
+func (c *testClient) request(command string, args any, body any) *testMessage {
+	c.t.Helper()
+	resp := c.tryRequest(command, args)
+	require.True(c.t, resp.Success, "%s failed: %s", command, resp.Message)
+	if body != nil {
+		require.NoError(c.t, json.Unmarshal(resp.Body, body))
+	}
+	return resp
+}
+
+func (c *testClient) tryRequest(command string, args any) *testMessage {
+	c.t.Helper()
+	c.seq++
+	req := map[string]any{"seq": c.seq, "type": "request", "command": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	require.NoError(c.t, writeMessage(c.conn, req))
+	for {
+		msg := c.next()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		require.Equal(c.t, "response", msg.Type)
+		require.Equal(c.t, c.seq, msg.RequestSeq)
+		require.Equal(c.t, command, msg.Command)
+		return msg
+	}
+}
+
+// event waits for the next event with given name skipping the other events and
+// decodes its body into body if it is not nil.
+func (c *testClient) event(name string, body any) {
+	c.t.Helper()
+	for {
+		var msg *testMessage
+		if len(c.events) > 0 {
+			msg, c.events = c.events[0], c.events[1:]
+		} else {
+			msg = c.next()
+		}
+		require.Equal(c.t, "event", msg.Type)
+		if msg.Event != name {
+			continue
+		}
+		if body != nil {
+			require.NoError(c.t, json.Unmarshal(msg.Body, body))
+		}
+		return
+	}
+}
+
+type testStopped struct {
+	Reason   string `json:"reason"`
+	ThreadID int    `json:"threadId"`
+}
+
+func (c *testClient) stopped(reason string) {
+	c.t.Helper()
+	var ev testStopped
+	c.event("stopped", &ev)
+	require.Equal(c.t, reason, ev.Reason)
+	require.Equal(c.t, threadID, ev.ThreadID)
+}
+
+func (c *testClient) stackTrace() []stackFrame {
+	c.t.Helper()
+	var body struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+		TotalFrames int          `json:"totalFrames"`
+	}
+	c.request("stackTrace", map[string]any{"threadId": threadID}, &body)
+	require.Equal(c.t, len(body.StackFrames), body.TotalFrames)
+	return body.StackFrames
+}
+
+func (c *testClient) scopes(frameID int) []scope {
+	c.t.Helper()
+	var body struct {
+		Scopes []scope `json:"scopes"`
+	}
+	c.request("scopes", map[string]any{"frameId": frameID}, &body)
+	return body.Scopes
+}
+
+func (c *testClient) variables(ref int) map[string]variable {
+	c.t.Helper()
+	var body struct {
+		Variables []variable `json:"variables"`
+	}
+	c.request("variables", map[string]any{"variablesReference": ref}, &body)
+	vars := make(map[string]variable, len(body.Variables))
+	for _, v := range body.Variables {
+		vars[v.Name] = v
+	}
+	return vars
+}
+
+func writeTestScript(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.ugo")
+	require.NoError(t, os.WriteFile(path, []byte(testScript), 0o600))
+	return path
+}
+
+func TestSession(t *testing.T) {
+	path := writeTestScript(t)
+	c := newTestClient(t)
+
+	var caps map[string]bool
+	c.request("initialize", map[string]any{"adapterID": "ugo"}, &caps)
+	require.True(t, caps["supportsConfigurationDoneRequest"])
+
+	c.request("launch", map[string]any{
+		"program": path,
+		"args":    []string{"hello"},
+	}, nil)
+	c.event("initialized", nil)
+
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": path},
+		"breakpoints": []map[string]any{{"line": 3}, {"line": 5}},
+	}, &bps)
+	require.Len(t, bps.Breakpoints, 2)
+	require.True(t, bps.Breakpoints[0].Verified)
+	require.Equal(t, 3, bps.Breakpoints[0].Line)
+	require.False(t, bps.Breakpoints[1].Verified)
+
+	c.request("configurationDone", nil, nil)
+	c.stopped("breakpoint")
+
+	var threads struct {
+		Threads []thread `json:"threads"`
+	}
+	c.request("threads", nil, &threads)
+	require.Equal(t, []thread{{ID: threadID, Name: "main"}}, threads.Threads)
+
+	frames := c.stackTrace()
+	require.Len(t, frames, 2)
+	require.Equal(t, 3, frames[0].Line)
+	require.Equal(t, path, frames[0].Source.Path)
+	require.Equal(t, "test.ugo", frames[0].Source.Name)
+	require.Equal(t, "main", frames[1].Name)
+	require.Equal(t, 6, frames[1].Line)
+
+	scopes := c.scopes(frames[0].ID)
+	require.Equal(t, "Locals", scopes[0].Name)
+	vars := c.variables(scopes[0].VariablesReference)
+	require.Equal(t, "1", vars["local#0"].Value)
+	require.Equal(t, "int", vars["local#0"].Type)
+	require.Equal(t, "2", vars["local#1"].Value)
+	require.Equal(t, "undefined", vars["local#2"].Value)
+
+	scopes = c.scopes(frames[1].ID)
+	vars = c.variables(scopes[0].VariablesReference)
+	require.Equal(t, `"hello"`, vars["arg"].Value)
+	require.Equal(t, "string", vars["arg"].Type)
+
+	c.request("stepOut", nil, nil)
+	c.stopped("step")
+	frames = c.stackTrace()
+	require.Len(t, frames, 1)
+	require.Equal(t, 7, frames[0].Line)
+
+	c.request("next", nil, nil)
+	var output struct {
+		Category string `json:"category"`
+		Output   string `json:"output"`
+	}
+	c.event("output", &output)
+	require.Equal(t, "stdout", output.Category)
+	require.Equal(t, "hello 3\n", output.Output)
+	c.stopped("step")
+
+	c.request("next", nil, nil)
+	c.stopped("step")
+	frames = c.stackTrace()
+	require.Equal(t, 9, frames[0].Line)
+	scopes = c.scopes(frames[0].ID)
+	require.Len(t, scopes, 2)
+	require.Equal(t, "Globals", scopes[1].Name)
+	vars = c.variables(scopes[0].VariablesReference)
+	require.Equal(t, "map", vars["m"].Type)
+	require.Greater(t, vars["m"].VariablesReference, 0)
+	vars = c.variables(vars["m"].VariablesReference)
+	require.Equal(t, "array", vars["a"].Type)
+	vars = c.variables(vars["a"].VariablesReference)
+	require.Equal(t, "1", vars["[0]"].Value)
+	require.Equal(t, "2", vars["[1]"].Value)
+
+	c.request("continue", nil, nil)
+	var exited struct {
+		ExitCode int `json:"exitCode"`
+	}
+	c.event("exited", &exited)
+	require.Equal(t, 0, exited.ExitCode)
+	c.event("terminated", nil)
+
+	resp := c.tryRequest("stackTrace", map[string]any{"threadId": threadID})
+	require.False(t, resp.Success)
+	c.request("disconnect", nil, nil)
+}
+
+func TestSessionStopOnEntryAndDisconnect(t *testing.T) {
+	path := writeTestScript(t)
+	c := newTestClient(t)
+
+	c.request("initialize", nil, nil)
+	resp := c.tryRequest("launch", map[string]any{})
+	require.False(t, resp.Success)
+	require.Equal(t, "program is required", resp.Message)
+
+	c.request("launch", map[string]any{
+		"program":     path,
+		"stopOnEntry": true,
+	}, nil)
+	c.event("initialized", nil)
+	c.request("configurationDone", nil, nil)
+	c.stopped("entry")
+	frames := c.stackTrace()
+	require.Equal(t, 2, frames[0].Line)
+
+	c.request("stepIn", nil, nil)
+	c.stopped("step")
+	require.Equal(t, 6, c.stackTrace()[0].Line)
+	c.request("stepIn", nil, nil)
+	c.stopped("step")
+	require.Equal(t, 3, c.stackTrace()[0].Line)
+
+	resp = c.tryRequest("evaluate", map[string]any{"expression": "a"})
+	require.False(t, resp.Success)
+
+	// disconnect terminates the paused program
+	c.request("disconnect", nil, nil)
+	c.event("terminated", nil)
+}
+
+func TestSessionFmtOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fmt.ugo")
+	script := `fmt := import("fmt")
+fmt.Println("a", 1)
+fmt.Printf("%s-%d\n", "b", 2)
+return fmt.Print("c")`
+	require.NoError(t, os.WriteFile(path, []byte(script), 0o600))
+	c := newTestClient(t)
+
+	c.request("initialize", nil, nil)
+	c.request("launch", map[string]any{"program": path, "noDebug": true}, nil)
+	c.event("initialized", nil)
+	c.request("configurationDone", nil, nil)
+
+	// fmt module writes to the client instead of os.Stdout
+	var outputs []string
+	for i := 0; i < 3; i++ {
+		var output struct {
+			Category string `json:"category"`
+			Output   string `json:"output"`
+		}
+		c.event("output", &output)
+		require.Equal(t, "stdout", output.Category)
+		outputs = append(outputs, output.Output)
+	}
+	require.Equal(t, []string{"a 1\n", "b-2\n", "c"}, outputs)
+	c.event("exited", nil)
+	c.event("terminated", nil)
+	require.Equal(t, os.Stdout, ugo.PrintWriter)
+	c.request("disconnect", nil, nil)
+}
@@ -0,0 +1,153 @@
+// Command ugo-patchdiff compiles a uGO script, applies the patches of the
+// patcher package and prints the differences between the original and the
+// patched bytecode.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/importers"
+	ugofmt "github.com/ozanh/ugo/stdlib/fmt"
+	ugojson "github.com/ozanh/ugo/stdlib/json"
+	ugostrings "github.com/ozanh/ugo/stdlib/strings"
+	ugotime "github.com/ozanh/ugo/stdlib/time"
+
+	"github.com/ozanh/ugodev/patcher"
+)
+
+const usage = `Usage: ugo-patchdiff [flags] <script>
+
+Patches are applied in the given order with a patcher.Pipeline, available
+patches are:
+  gosched   PatchForGosched with -threshold
+  limit     PatchForInstructionLimit with -limit
+  memory    PatchForMemoryLimit with -memory
+  coverage  PatchForCoverage
+  profile   PatchForProfile
+  trace     PatchForTrace
+  optimize  Optimize
+
+Flags:
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("ugo-patchdiff", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	patches := fs.String("patch", "gosched", "comma separated list of patches")
+	threshold := fs.Uint("threshold", 1000, "call threshold of gosched patch")
+	limit := fs.Uint64("limit", 1000000, "instruction limit of limit patch")
+	memory := fs.Uint64("memory", 64<<20, "byte limit of memory patch")
+	all := fs.Bool("all", false, "print unchanged instructions and functions")
+	disasm := fs.Bool("disasm", false, "print disassembly of the patched bytecode instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	path := fs.Arg(0)
+	script, err := importers.ShebangReadFile(path)
+	if err != nil {
+		return err
+	}
+	compile := func() (*ugo.Bytecode, error) {
+		return ugo.Compile(script, ugo.CompilerOptions{
+			ModuleMap:  defaultModuleMap(filepath.Dir(path)),
+			ModulePath: path,
+		})
+	}
+	before, err := compile()
+	if err != nil {
+		return err
+	}
+	after, err := compile()
+	if err != nil {
+		return err
+	}
+
+	pl := patcher.NewPipeline()
+	for _, name := range strings.Split(*patches, ",") {
+		var pass patcher.Pass
+		switch name = strings.TrimSpace(name); name {
+		case "":
+			continue
+		case "gosched":
+			pass, _ = patcher.GoschedPass(patcher.GoschedOptions{
+				CallThreshold: uint32(*threshold),
+			})
+		case "limit":
+			pass, _ = patcher.InstructionLimitPass(*limit)
+		case "memory":
+			pass, _ = patcher.MemoryLimitPass(*memory)
+		case "coverage":
+			pass, _ = patcher.CoveragePass()
+		case "profile":
+			pass = patcher.ApplyPass(name, func(bc *ugo.Bytecode) error {
+				_, err := patcher.PatchForProfile(bc)
+				return err
+			})
+		case "trace":
+			pass = patcher.ApplyPass(name, func(bc *ugo.Bytecode) error {
+				return patcher.PatchForTrace(bc, func(patcher.TraceEvent) error {
+					return nil
+				})
+			})
+		case "optimize":
+			pass, _ = patcher.OptimizePass()
+		default:
+			return fmt.Errorf("unknown patch: %s", name)
+		}
+		pl.Add(pass)
+	}
+	if _, err := pl.Run(after); err != nil {
+		return err
+	}
+
+	if *disasm {
+		return patcher.Disassemble(stdout, after, patcher.DisasmOptions{
+			Sources:  map[string][]byte{path: script},
+			Original: before,
+		})
+	}
+	d, err := patcher.Diff(before, after)
+	if err != nil {
+		return err
+	}
+	return d.WriteText(stdout, !*all)
+}
+
+func defaultModuleMap(workdir string) *ugo.ModuleMap {
+	return ugo.NewModuleMap().
+		AddBuiltinModule("time", ugotime.Module).
+		AddBuiltinModule("strings", ugostrings.Module).
+		AddBuiltinModule("fmt", ugofmt.Module).
+		AddBuiltinModule("json", ugojson.Module).
+		SetExtImporter(
+			&importers.FileImporter{
+				WorkDir:    workdir,
+				FileReader: importers.ShebangReadFile,
+			},
+		)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.ugo")
+	err := os.WriteFile(path, []byte("x := 0\nfor i := 0; i < 3; i++ {\n\tx += i\n}\nreturn x\n"), 0o644)
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, run([]string{"-patch", "gosched,limit", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(),
+		"main: 26 inserted, 0 removed, 20 relocated, 2 jumps changed, 5 source positions changed\n")
+	require.Contains(t, stdout.String(), "> 0039 0083  JUMP         27             ; jump changed from 10\n")
+
+	stdout.Reset()
+	require.NoError(t, run([]string{"-patch", "coverage", "-disasm", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), "  0000 + CONSTANT     3                  ; <coverCounter>\n")
+
+	stdout.Reset()
+	require.NoError(t, run([]string{"-patch", "optimize", path}, &stdout, &stderr))
+	require.Equal(t,
+		"main: 0 inserted, 1 removed, 0 relocated, 0 jumps changed, 0 source positions changed\n"+
+			"- 0048 ----  RETURN       0\n\n", stdout.String())
+
+	require.EqualError(t, run([]string{"-patch", "unknown", path}, &stdout, &stderr),
+		"unknown patch: unknown")
+	require.Error(t, run(nil, &stdout, &stderr))
+}
@@ -0,0 +1,461 @@
+// Package debugger provides a breakpoint and step debugger for uGO scripts.
+// Bytecode is patched to call hooks at the first instruction of each source
+// line, function entries and returns. The VM goroutine is blocked in the hooks
+// while the program is paused.
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+
+	"github.com/ozanh/ugodev/patcher"
+)
+
+// ErrNotPaused is returned by the commands requiring a paused program.
+var ErrNotPaused = errors.New("program is not paused")
+
+// StopReason is the reason of the pause.
+type StopReason int
+
+// List of stop reasons.
+const (
+	StopBreakpoint StopReason = iota + 1
+	StopStep
+	StopPause
+	StopEntry
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopStep:
+		return "step"
+	case StopPause:
+		return "pause"
+	case StopEntry:
+		return "entry"
+	default:
+		return fmt.Sprintf("StopReason(%d)", int(r))
+	}
+}
+
+// Location is a source line.
+type Location struct {
+	File string
+	Line int
+}
+
+// Variable is a named value inspected at a pause.
+type Variable struct {
+	Name  string
+	Value ugo.Object
+}
+
+// Frame is a call frame of the paused program.
+type Frame struct {
+	// Func is the name of the function, main function is named as "main".
+	Func   string
+	File   string
+	Line   int
+	Column int
+	// Locals are the local variables of the function at the last executed line
+	// of the frame. Locals are named by the symbol table given in Options, or
+	// as "local#<index>" if not found.
+	Locals []Variable
+}
+
+// State is the state of the paused program.
+type State struct {
+	Reason StopReason
+	// Frames is the call stack, the innermost frame is the first.
+	Frames []Frame
+	// Globals is the globals object given to the VM.
+	Globals ugo.Object
+}
+
+// Options are the options of the Debugger.
+type Options struct {
+	// SymbolTable is the symbol table given to the compiler with
+	// ugo.CompilerOptions. If set, local variables of the main function are
+	// named after the symbols of the top level scope.
+	SymbolTable *ugo.SymbolTable
+	// StopOnEntry pauses the program at the first line of the main function.
+	StopOnEntry bool
+}
+
+type stepMode int
+
+const (
+	modeRun stepMode = iota
+	modeStepIn
+	modeStepOver
+	modeStepOut
+)
+
+// Debugger controls the execution of a ugo.Bytecode patched by New. Commands
+// are safe to call concurrently with the VM goroutine. Call stack is tracked
+// for a single VM at a time, running the same patched ugo.Bytecode
+// concurrently is not supported.
+type Debugger struct {
+	mu          sync.Mutex
+	fileSet     *parser.SourceFileSet
+	lines       map[Location]struct{}
+	breakpoints map[Location]struct{}
+	stopOnEntry bool
+	entry       bool
+	pause       bool
+	paused      bool
+	mode        stepMode
+	stepDepth   int
+	stack       patcher.CallStack[*frame]
+	stops       chan *State
+	resume      chan struct{}
+}
+
+type funcInfo struct {
+	name   string
+	main   bool
+	locals []string
+}
+
+type frame struct {
+	fn     *funcInfo
+	pos    parser.Pos
+	locals []ugo.Object
+}
+
+// New modifies given ugo.Bytecode to insert debugger hooks and returns a
+// Debugger controlling it. Note that tail call optimization of the VM is
+// disabled by the patch. If error is returned, given ugo.Bytecode must be
+// discarded due to invalid patching.
+func New(bc *ugo.Bytecode, opts Options) (*Debugger, error) {
+	d := &Debugger{
+		fileSet:     bc.FileSet,
+		lines:       make(map[Location]struct{}),
+		breakpoints: make(map[Location]struct{}),
+		stopOnEntry: opts.StopOnEntry,
+		stops:       make(chan *State, 1),
+		resume:      make(chan struct{}, 1),
+	}
+
+	var fi *funcInfo
+	hooks := patcher.Hooks{
+		Enter: func(fn *ugo.CompiledFunction, index int) ugo.Object {
+			fi = &funcInfo{main: index < 0}
+			fi.name, _ = patcher.FuncName(bc.FileSet, fn, index)
+			fi.locals = localNames(fn, index < 0, opts.SymbolTable)
+			return &site{d: d, fn: fi, kind: siteEnter}
+		},
+		Line: func(pos parser.Pos, _ ugo.Opcode) ugo.Object {
+			d.lines[d.location(pos)] = struct{}{}
+			return &site{d: d, fn: fi, kind: siteLine, pos: pos}
+		},
+		Exit: func() ugo.Object {
+			return &site{d: d, fn: fi, kind: siteExit}
+		},
+		LineLocals: true,
+	}
+	d.stack.SetUnwindHooks(&hooks, &d.mu, nil)
+	if err := patcher.PatchForHooks(bc, hooks); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func localNames(fn *ugo.CompiledFunction, main bool, st *ugo.SymbolTable) []string {
+	n := fn.NumLocals
+	if n > patcher.MaxHookLocals {
+		n = patcher.MaxHookLocals
+	}
+	names := make([]string, n)
+	if main && st != nil {
+		st.Range(false, func(sym *ugo.Symbol) bool {
+			if sym.Scope == ugo.ScopeLocal && sym.Index < n {
+				names[sym.Index] = sym.Name
+			}
+			return true
+		})
+	}
+	for i := range names {
+		if names[i] == "" {
+			names[i] = fmt.Sprintf("local#%d", i)
+		}
+	}
+	return names
+}
+
+func (d *Debugger) location(pos parser.Pos) Location {
+	if d.fileSet == nil {
+		return Location{Line: int(pos)}
+	}
+	p := d.fileSet.Position(pos)
+	return Location{File: p.Filename, Line: p.Line}
+}
+
+// Stops returns the channel receiving the state of the program at each pause.
+// The channel must be drained to run the program. It is never closed, callers
+// must watch the VM to detect the end of the program.
+func (d *Debugger) Stops() <-chan *State {
+	return d.stops
+}
+
+// SetBreakpoint sets a breakpoint at given file and line, and reports whether
+// the line has executable code. Breakpoints are not set for the lines without
+// code. Main script is named as "(main)" unless ugo.CompilerOptions.ModulePath
+// is set.
+func (d *Debugger) SetBreakpoint(file string, line int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	loc := Location{File: file, Line: line}
+	if _, ok := d.lines[loc]; !ok {
+		return false
+	}
+	d.breakpoints[loc] = struct{}{}
+	return true
+}
+
+// ClearBreakpoint removes the breakpoint at given file and line.
+func (d *Debugger) ClearBreakpoint(file string, line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.breakpoints, Location{File: file, Line: line})
+}
+
+// ClearBreakpoints removes all breakpoints.
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for loc := range d.breakpoints {
+		delete(d.breakpoints, loc)
+	}
+}
+
+// Breakpoints returns the breakpoints sorted by file name and line number.
+func (d *Debugger) Breakpoints() []Location {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	locs := make([]Location, 0, len(d.breakpoints))
+	for loc := range d.breakpoints {
+		locs = append(locs, loc)
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		if locs[i].File != locs[j].File {
+			return locs[i].File < locs[j].File
+		}
+		return locs[i].Line < locs[j].Line
+	})
+	return locs
+}
+
+// Pause requests to pause the program at the next source line.
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pause = true
+}
+
+// Continue resumes the paused program until a breakpoint is hit.
+func (d *Debugger) Continue() error {
+	return d.resumeWith(modeRun)
+}
+
+// StepIn resumes the paused program until the next source line, including the
+// lines of the called functions.
+func (d *Debugger) StepIn() error {
+	return d.resumeWith(modeStepIn)
+}
+
+// StepOver resumes the paused program until the next source line of the
+// current function or its callers.
+func (d *Debugger) StepOver() error {
+	return d.resumeWith(modeStepOver)
+}
+
+// StepOut resumes the paused program until the current function returns to its
+// caller.
+func (d *Debugger) StepOut() error {
+	return d.resumeWith(modeStepOut)
+}
+
+// Detach clears breakpoints, cancels stepping and resumes the program if it is
+// paused, so that the program runs to completion.
+func (d *Debugger) Detach() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for loc := range d.breakpoints {
+		delete(d.breakpoints, loc)
+	}
+	d.stopOnEntry = false
+	d.pause = false
+	d.mode = modeRun
+	if d.paused {
+		d.paused = false
+		d.resume <- struct{}{}
+	}
+}
+
+func (d *Debugger) resumeWith(mode stepMode) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.paused {
+		return ErrNotPaused
+	}
+	d.paused = false
+	d.mode = mode
+	d.stepDepth = d.stack.Len()
+	d.resume <- struct{}{}
+	return nil
+}
+
+// enter pushes a new frame, a call to main function starts a new run.
+func (d *Debugger) enter(fn *funcInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if fn.main {
+		// new run, drop the frames left by the previous run if it failed
+		d.stack.Cut(0, nil)
+		d.entry = d.stopOnEntry
+		d.mode = modeRun
+	}
+	d.stack.Push(&frame{fn: fn})
+}
+
+func (d *Debugger) exit() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stack.Pop()
+}
+
+// line updates the current frame and blocks the caller if the program must be
+// paused at given position.
+func (d *Debugger) line(fn *funcInfo, pos parser.Pos, c *ugo.Call) {
+	d.mu.Lock()
+	top, ok := d.stack.Top()
+	if !ok {
+		top = &frame{fn: fn}
+		d.stack.Push(top)
+	}
+	top.pos = pos
+	top.locals = top.locals[:0]
+	for i := 0; i < c.Len(); i++ {
+		top.locals = append(top.locals, c.Get(i))
+	}
+
+	reason := d.stopReason(pos)
+	if reason == 0 {
+		d.mu.Unlock()
+		return
+	}
+	st := d.state(reason, c.VM())
+	d.entry = false
+	d.pause = false
+	d.mode = modeRun
+	d.paused = true
+	d.mu.Unlock()
+
+	d.stops <- st
+	<-d.resume
+}
+
+func (d *Debugger) stopReason(pos parser.Pos) StopReason {
+	if d.entry {
+		return StopEntry
+	}
+	if d.pause {
+		return StopPause
+	}
+	depth := d.stack.Len()
+	switch {
+	case d.mode == modeStepIn,
+		d.mode == modeStepOver && depth <= d.stepDepth,
+		d.mode == modeStepOut && depth < d.stepDepth:
+		return StopStep
+	}
+	if _, ok := d.breakpoints[d.location(pos)]; ok {
+		return StopBreakpoint
+	}
+	return 0
+}
+
+func (d *Debugger) state(reason StopReason, vm *ugo.VM) *State {
+	st := &State{
+		Reason: reason,
+		Frames: make([]Frame, 0, d.stack.Len()),
+	}
+	if vm != nil {
+		st.Globals = vm.GetGlobals()
+	}
+	frames := d.stack.Frames()
+	for i := len(frames) - 1; i >= 0; i-- {
+		f := frames[i]
+		fr := Frame{
+			Func:   f.fn.name,
+			Locals: make([]Variable, 0, len(f.locals)),
+		}
+		if d.fileSet != nil && f.pos.IsValid() {
+			p := d.fileSet.Position(f.pos)
+			fr.File, fr.Line, fr.Column = p.Filename, p.Line, p.Column
+		}
+		for j, v := range f.locals {
+			if j < len(f.fn.locals) {
+				fr.Locals = append(fr.Locals, Variable{Name: f.fn.locals[j], Value: v})
+			}
+		}
+		st.Frames = append(st.Frames, fr)
+	}
+	return st
+}
+
+type siteKind int
+
+const (
+	siteEnter siteKind = iota
+	siteLine
+	siteExit
+)
+
+// site is the callable added to ugo.Bytecode by New to notify the Debugger.
+type site struct {
+	ugo.ObjectImpl
+	d    *Debugger
+	fn   *funcInfo
+	kind siteKind
+	pos  parser.Pos
+}
+
+var _ ugo.ExCallerObject = (*site)(nil)
+
+func (s *site) String() string   { return "<debuggerSite>" }
+func (s *site) TypeName() string { return s.String() }
+func (s *site) CanCall() bool    { return true }
+
+func (s *site) Call(args ...ugo.Object) (ugo.Object, error) {
+	return s.CallEx(ugo.NewCall(nil, args))
+}
+
+func (s *site) CallEx(c ugo.Call) (ugo.Object, error) {
+	switch s.kind {
+	case siteEnter:
+		s.d.enter(s.fn)
+	case siteLine:
+		s.d.line(s.fn, s.pos, &c)
+	default:
+		s.d.exit()
+	}
+	return ugo.Undefined, nil
+}
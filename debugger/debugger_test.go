@@ -0,0 +1,207 @@
+package debugger_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/debugger"
+
+	. "github.com/ozanh/ugo"
+)
+
+const testScript = `add := func(a, b) {
+	c := a + b
+	return c
+}
+x := 1
+y := add(x, 2)
+z := add(y, 3)
+return z`
+
+type session struct {
+	t    *testing.T
+	d    *debugger.Debugger
+	done chan struct{}
+	ret  Object
+	err  error
+}
+
+func startSession(t *testing.T, script string, opts debugger.Options,
+	setup func(d *debugger.Debugger)) *session {
+	t.Helper()
+	st := NewSymbolTable()
+	bc, err := Compile([]byte(script), CompilerOptions{SymbolTable: st})
+	require.NoError(t, err)
+	opts.SymbolTable = st
+	d, err := debugger.New(bc, opts)
+	require.NoError(t, err)
+	if setup != nil {
+		setup(d)
+	}
+
+	s := &session{t: t, d: d, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		s.ret, s.err = NewVM(bc).Run(Map{"g": Int(10)})
+	}()
+	return s
+}
+
+func (s *session) expectStop(reason debugger.StopReason, fn string, line int) *debugger.State {
+	s.t.Helper()
+	select {
+	case st := <-s.d.Stops():
+		require.Equal(s.t, reason, st.Reason)
+		require.Equal(s.t, fn, st.Frames[0].Func)
+		require.Equal(s.t, line, st.Frames[0].Line)
+		return st
+	case <-s.done:
+		s.t.Fatalf("program exited, want stop at line %d: %v", line, s.err)
+	case <-time.After(5 * time.Second):
+		s.t.Fatalf("timeout, want stop at line %d", line)
+	}
+	return nil
+}
+
+func (s *session) expectExit(ret Object) {
+	s.t.Helper()
+	select {
+	case st := <-s.d.Stops():
+		s.t.Fatalf("unexpected stop at line %d", st.Frames[0].Line)
+	case <-s.done:
+		require.NoError(s.t, s.err)
+		require.Equal(s.t, ret, s.ret)
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("timeout, want exit")
+	}
+}
+
+func locals(fr debugger.Frame) map[string]Object {
+	m := make(map[string]Object, len(fr.Locals))
+	for _, v := range fr.Locals {
+		m[v.Name] = v.Value
+	}
+	return m
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	add := "func@(main):2:2"
+	s := startSession(t, testScript, debugger.Options{},
+		func(d *debugger.Debugger) {
+			require.True(t, d.SetBreakpoint("(main)", 2))
+			require.True(t, d.SetBreakpoint("(main)", 8))
+			require.False(t, d.SetBreakpoint("(main)", 4))
+			require.False(t, d.SetBreakpoint("other", 2))
+			require.Equal(t, []debugger.Location{
+				{File: "(main)", Line: 2},
+				{File: "(main)", Line: 8},
+			}, d.Breakpoints())
+		})
+
+	st := s.expectStop(debugger.StopBreakpoint, add, 2)
+	require.Len(t, st.Frames, 2)
+	require.Equal(t, "main", st.Frames[1].Func)
+	require.Equal(t, 6, st.Frames[1].Line)
+	require.Equal(t, Int(1), locals(st.Frames[0])["local#0"])
+	require.Equal(t, Int(2), locals(st.Frames[0])["local#1"])
+	require.Equal(t, Undefined, locals(st.Frames[0])["local#2"])
+	require.Equal(t, Int(1), locals(st.Frames[1])["x"])
+	require.Equal(t, Map{"g": Int(10)}, st.Globals)
+	require.NoError(t, s.d.Continue())
+
+	st = s.expectStop(debugger.StopBreakpoint, add, 2)
+	require.Equal(t, 7, st.Frames[1].Line)
+	require.Equal(t, Int(3), locals(st.Frames[0])["local#0"])
+	require.Equal(t, Int(3), locals(st.Frames[1])["y"])
+	s.d.ClearBreakpoint("(main)", 2)
+	require.NoError(t, s.d.Continue())
+
+	st = s.expectStop(debugger.StopBreakpoint, "main", 8)
+	require.Len(t, st.Frames, 1)
+	require.Equal(t, Int(6), locals(st.Frames[0])["z"])
+	require.NoError(t, s.d.Continue())
+	s.expectExit(Int(6))
+
+	require.ErrorIs(t, s.d.Continue(), debugger.ErrNotPaused)
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	add := "func@(main):2:2"
+	s := startSession(t, testScript, debugger.Options{StopOnEntry: true}, nil)
+
+	s.expectStop(debugger.StopEntry, "main", 1)
+	require.NoError(t, s.d.StepOver())
+	s.expectStop(debugger.StopStep, "main", 5)
+	require.NoError(t, s.d.StepOver())
+	s.expectStop(debugger.StopStep, "main", 6)
+	require.NoError(t, s.d.StepIn())
+	s.expectStop(debugger.StopStep, add, 2)
+	require.NoError(t, s.d.StepIn())
+	st := s.expectStop(debugger.StopStep, add, 3)
+	require.Equal(t, Int(3), locals(st.Frames[0])["local#2"])
+	require.NoError(t, s.d.StepOut())
+	s.expectStop(debugger.StopStep, "main", 7)
+	require.NoError(t, s.d.StepOver())
+	st = s.expectStop(debugger.StopStep, "main", 8)
+	require.Equal(t, Int(6), locals(st.Frames[0])["z"])
+	require.NoError(t, s.d.StepOver())
+	s.expectExit(Int(6))
+}
+
+func TestDebuggerPauseAndDetach(t *testing.T) {
+	script := `
+i := 0
+for i < 1000 {
+	i++
+}
+return i`
+	s := startSession(t, script, debugger.Options{},
+		func(d *debugger.Debugger) {
+			d.Pause()
+		})
+	s.expectStop(debugger.StopPause, "main", 2)
+	require.True(t, s.d.SetBreakpoint("(main)", 4))
+	require.NoError(t, s.d.Continue())
+	st := s.expectStop(debugger.StopBreakpoint, "main", 4)
+	require.Equal(t, Int(0), locals(st.Frames[0])["i"])
+	require.NoError(t, s.d.Continue())
+	st = s.expectStop(debugger.StopBreakpoint, "main", 4)
+	require.Equal(t, Int(1), locals(st.Frames[0])["i"])
+
+	s.d.Detach()
+	require.Empty(t, s.d.Breakpoints())
+	s.expectExit(Int(1000))
+}
+
+func TestDebuggerRecursiveThrow(t *testing.T) {
+	script := `var g
+g = func(n) {
+	if n == 1 {
+		throw "x"
+	}
+	if n > 0 {
+		return g(n-1)
+	}
+	try {
+		g(3)
+	} catch e {
+	}
+	return n
+}
+return g(0)`
+	s := startSession(t, script, debugger.Options{},
+		func(d *debugger.Debugger) {
+			require.True(t, d.SetBreakpoint("(main)", 13))
+		})
+
+	// frames left by the error are popped in the outer frame of g
+	st := s.expectStop(debugger.StopBreakpoint, "func@(main):3:2", 13)
+	require.Len(t, st.Frames, 2)
+	// local variable of the patch is not listed
+	require.Len(t, st.Frames[0].Locals, 2)
+	require.Equal(t, Int(0), locals(st.Frames[0])["local#0"])
+	require.NoError(t, s.d.Continue())
+	s.expectExit(Int(0))
+}
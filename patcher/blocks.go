@@ -0,0 +1,68 @@
+package patcher
+
+import (
+	"github.com/ozanh/ugo"
+)
+
+// basicBlock represents a sequence of instructions in [start, end) range which
+// can only be entered from the first instruction.
+type basicBlock struct {
+	start    int
+	end      int
+	numInsts int
+}
+
+// basicBlocks returns the basic blocks of given instructions in order.
+func basicBlocks(insts []byte) ([]basicBlock, error) {
+	leaders := map[int]struct{}{0: {}}
+	it := NewIterator(insts)
+	for it.Next() {
+		switch op := it.Opcode(); op {
+		case ugo.OpJump,
+			ugo.OpJumpFalsy,
+			ugo.OpAndJump,
+			ugo.OpOrJump,
+			ugo.OpSetupTry:
+			for _, target := range it.Operands() {
+				if target > 0 || op != ugo.OpSetupTry {
+					leaders[target] = struct{}{}
+				}
+			}
+			leaders[it.Pos()+it.Offset()+1] = struct{}{}
+		case ugo.OpReturn, ugo.OpThrow:
+			leaders[it.Pos()+it.Offset()+1] = struct{}{}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	var blocks []basicBlock
+	it.Reset(insts)
+	for it.Next() {
+		pos := it.Pos()
+		if _, ok := leaders[pos]; ok {
+			if len(blocks) > 0 {
+				blocks[len(blocks)-1].end = pos
+			}
+			blocks = append(blocks, basicBlock{start: pos})
+		}
+		blocks[len(blocks)-1].numInsts++
+	}
+	if len(blocks) > 0 {
+		blocks[len(blocks)-1].end = len(insts)
+	}
+	return blocks, it.Error()
+}
+
+// blockStartOp returns the Op to insert instructions at the start of a basic
+// block starting with given opcode.
+func blockStartOp(opcode ugo.Opcode) Op {
+	switch opcode {
+	case ugo.OpSetupCatch, ugo.OpSetupFinally:
+		// Error handler must be consumed before inserted instructions,
+		// otherwise throwing an error jumps to the same handler again.
+		return InsertAfter
+	}
+	return Prepend
+}
@@ -0,0 +1,343 @@
+package patcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/encoder"
+)
+
+// cacheMagic is the first line of the cache files, it must be changed if the
+// format of the files change.
+const cacheMagic = "ugodev-patch-cache 1"
+
+// cacheBuild is the versions of the modules compiling and patching the
+// bytecode in the build, which is a part of the cache key since the patches
+// may change between the versions.
+var cacheBuild = buildVersions()
+
+// buildVersions returns the versions of uGO and this module in the build
+// info, including the VCS revision if this module is the main module.
+func buildVersions() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	var b strings.Builder
+	for _, m := range append([]*debug.Module{&info.Main}, info.Deps...) {
+		if m.Path != "github.com/ozanh/ugo" && m.Path != "github.com/ozanh/ugodev" {
+			continue
+		}
+		path := m.Path
+		if m.Replace != nil {
+			m = m.Replace
+		}
+		fmt.Fprintf(&b, "%s@%s %s\n", path, m.Version, m.Sum)
+	}
+	if info.Main.Path == "github.com/ozanh/ugodev" {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" || s.Key == "vcs.modified" {
+				fmt.Fprintf(&b, "%s=%s\n", s.Key, s.Value)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Cache stores compiled and patched ugo.Bytecode in a directory to skip
+// compiling and patching the same scripts again. Bytecode is stored with the
+// bytecode encoding of uGO, callables added by the passes cannot be encoded
+// so they are stored as ugo.Undefined and set by Pass.Attach after decoding.
+// As the callables of the given passes are attached, the objects returned by
+// the pass constructors like the Gosched and the InstructionMeter report the
+// runs of the bytecode loaded from the cache. It is safe for concurrent use.
+type Cache struct {
+	// StoreError is called with the errors of storing the bytecodes if it is
+	// set. Compile returns the bytecode even if it cannot be stored.
+	StoreError func(err error)
+
+	dir         string
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	storeErrors atomic.Uint64
+}
+
+// CacheStats holds the statistics of a Cache.
+type CacheStats struct {
+	// Hits is the number of bytecodes loaded from the cache.
+	Hits uint64
+	// Misses is the number of bytecodes compiled and patched.
+	Misses uint64
+	// StoreErrors is the number of bytecodes which cannot be stored, e.g. the
+	// callables of the passes without Attach cannot be encoded.
+	StoreErrors uint64
+}
+
+// NewCache returns a new Cache storing the files in given directory, which is
+// created if it does not exist.
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// Stats returns the statistics of the cache.
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		StoreErrors: c.storeErrors.Load(),
+	}
+}
+
+// Compile returns the ugo.Bytecode of given script compiled with given
+// options and patched with given pipeline. It is loaded from the cache if it
+// is found by CacheKey and the sources of the imported modules are not
+// changed, otherwise it is compiled, patched and stored in the cache. Scripts
+// importing modules which cannot be resolved with the ModuleMap of the
+// options by their file names are not stored, nor the ones which cannot be
+// encoded, see CacheStats.StoreErrors. A pipeline must be used once
+// like the passes. Options with Constants or SymbolTable are not supported.
+func (c *Cache) Compile(
+	script []byte,
+	opts ugo.CompilerOptions,
+	pl *Pipeline,
+) (*ugo.Bytecode, error) {
+	if opts.Constants != nil || opts.SymbolTable != nil {
+		return nil, errors.New(
+			"cache: compiler options with constants or symbol table are not supported")
+	}
+
+	path := filepath.Join(c.dir, CacheKey(script, opts, pl)+".bc")
+	if bc, err := loadCached(path, opts, pl); err == nil {
+		c.hits.Add(1)
+		return bc, nil
+	}
+	c.misses.Add(1)
+
+	bc, err := ugo.Compile(script, opts)
+	if err != nil {
+		return nil, err
+	}
+	report, err := pl.Run(bc)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.store(path, bc, opts, pl, report); err != nil {
+		c.storeErrors.Add(1)
+		if c.StoreError != nil {
+			c.StoreError(err)
+		}
+	}
+	return bc, nil
+}
+
+// CacheKey returns the key of Cache for given script, options and pipeline.
+// It is the hash of the script, the options changing the compiled bytecode,
+// the names and the keys of the passes, and the versions of uGO and this
+// module in the build.
+func CacheKey(script []byte, opts ugo.CompilerOptions, pl *Pipeline) string {
+	h := sha256.New()
+	writeHashField(h, []byte(cacheMagic))
+	writeHashField(h, []byte(cacheBuild))
+	writeHashField(h, script)
+	writeHashField(h, []byte(opts.ModulePath))
+	writeHashField(h, []byte(strconv.FormatBool(opts.NoOptimize)))
+	writeHashField(h, []byte(strconv.Itoa(opts.OptimizerLimit)))
+	for _, pass := range pl.passes {
+		writeHashField(h, []byte(pass.Name))
+		writeHashField(h, []byte(pass.Key))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeHashField writes given data prefixed with its length to h to separate
+// the fields.
+func writeHashField(h hash.Hash, data []byte) {
+	_, _ = h.Write([]byte(strconv.Itoa(len(data)) + ":"))
+	_, _ = h.Write(data)
+}
+
+// cacheEntry is the metadata stored before the encoded bytecode.
+type cacheEntry struct {
+	// Passes holds the indexes of the constants added by each pass.
+	Passes [][]int `json:"passes"`
+	// Modules holds the hashes of the imported module sources by file name.
+	Modules map[string]string `json:"modules"`
+}
+
+func loadCached(
+	path string,
+	opts ugo.CompilerOptions,
+	pl *Pipeline,
+) (*ugo.Bytecode, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	magic, data, _ := bytes.Cut(data, []byte{'\n'})
+	if string(magic) != cacheMagic {
+		return nil, errors.New("cache: invalid file")
+	}
+	meta, data, _ := bytes.Cut(data, []byte{'\n'})
+	var entry cacheEntry
+	if err := json.Unmarshal(meta, &entry); err != nil {
+		return nil, err
+	}
+	if len(entry.Passes) != len(pl.passes) {
+		return nil, fmt.Errorf("cache: number of passes %d is not %d",
+			len(entry.Passes), len(pl.passes))
+	}
+	for name, sum := range entry.Modules {
+		if s, ok := moduleSum(opts.ModuleMap, name); !ok || s != sum {
+			return nil, fmt.Errorf("cache: module %q is changed", name)
+		}
+	}
+
+	bc, err := encoder.DecodeBytecodeFrom(bytes.NewReader(data), opts.ModuleMap)
+	if err != nil {
+		return nil, err
+	}
+	for i, pass := range pl.passes {
+		indexes := entry.Passes[i]
+		if len(indexes) == 0 || pass.Attach == nil {
+			continue
+		}
+		consts := make([]ugo.Object, len(indexes))
+		for j, index := range indexes {
+			if index < 0 || index >= len(bc.Constants) {
+				return nil, fmt.Errorf("cache: constant %d is out of range", index)
+			}
+			consts[j] = bc.Constants[index]
+		}
+		if err := pass.Attach(bc, consts); err != nil {
+			return nil, fmt.Errorf("%s pass: %w", pass.Name, err)
+		}
+		for j, index := range indexes {
+			bc.Constants[index] = consts[j]
+		}
+	}
+	return bc, nil
+}
+
+func (c *Cache) store(
+	path string,
+	bc *ugo.Bytecode,
+	opts ugo.CompilerOptions,
+	pl *Pipeline,
+	report *PipelineReport,
+) error {
+	entry := cacheEntry{Modules: make(map[string]string)}
+	if bc.FileSet != nil && len(bc.FileSet.Files) > 1 {
+		for _, f := range bc.FileSet.Files[1:] {
+			sum, ok := moduleSum(opts.ModuleMap, f.Name)
+			if !ok {
+				return nil
+			}
+			entry.Modules[f.Name] = sum
+		}
+	}
+
+	attached := make(map[int]bool)
+	cached := make(map[int]ugo.Object)
+	for i, pr := range report.Passes {
+		entry.Passes = append(entry.Passes, pr.Constants)
+		if pl.passes[i].Attach != nil {
+			for _, index := range pr.Constants {
+				attached[index] = true
+			}
+			for index, obj := range pr.cached {
+				cached[index] = obj
+			}
+		}
+	}
+
+	encoded := *bc
+	encoded.Constants = make([]ugo.Object, len(bc.Constants))
+	for i, obj := range bc.Constants {
+		if c, ok := cached[i]; ok {
+			obj = c
+		} else if !encodable(obj) {
+			if !attached[i] {
+				return fmt.Errorf("cache: constant %d of type %s cannot be encoded",
+					i, obj.TypeName())
+			}
+			obj = ugo.Undefined
+		}
+		encoded.Constants[i] = obj
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(cacheMagic + "\n")
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	buf.Write(meta)
+	buf.WriteByte('\n')
+	if err := encoder.EncodeBytecodeTo(&encoded, &buf); err != nil {
+		return err
+	}
+
+	// write to a temporary file first not to load partially written files
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// encodable reports whether given constant can be encoded and decoded with
+// the bytecode encoding of uGO.
+func encodable(obj ugo.Object) bool {
+	switch obj.(type) {
+	case ugo.Bool, ugo.Int, ugo.Uint, ugo.Char, ugo.Float, ugo.String,
+		ugo.Bytes, ugo.Array, ugo.Map, *ugo.SyncMap, *ugo.CompiledFunction,
+		*ugo.BuiltinFunction, *ugo.UndefinedType:
+		return true
+	}
+	return false
+}
+
+// moduleSum returns the hash of the source of the module with given name
+// imported from modules, or false if it cannot be imported as source.
+func moduleSum(modules *ugo.ModuleMap, name string) (string, bool) {
+	imp := modules.Get(name)
+	if imp == nil {
+		return "", false
+	}
+	v, err := imp.Import(name)
+	if err != nil {
+		return "", false
+	}
+	src, ok := v.([]byte)
+	if !ok {
+		return "", false
+	}
+	sum := sha256.Sum256(src)
+	return hex.EncodeToString(sum[:]), true
+}
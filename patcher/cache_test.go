@@ -0,0 +1,290 @@
+package patcher_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestCache(t *testing.T) {
+	script := []byte(`
+	x := import("strings")
+	f := func(n) {
+		s := []
+		for i := 0; i < n; i++ {
+			s = append(s, x.ToUpper("a"))
+		}
+		return s
+	}
+	return len(f(10)) + import("mod")`)
+
+	modules := NewModuleMap()
+	modules.AddBuiltinModule("strings", Map{"ToUpper": &Function{
+		Name: "ToUpper",
+		Value: func(args ...Object) (Object, error) {
+			return String("A"), nil
+		},
+	}})
+	modules.AddSourceModule("mod", []byte(`return 1`))
+	opts := CompilerOptions{ModuleMap: modules}
+
+	c := patcher.NewCache(t.TempDir())
+	compile := func(t *testing.T) (Object, patcher.Gosched, *patcher.InstructionMeter,
+		*patcher.MemoryMeter) {
+		t.Helper()
+		gp, g := patcher.GoschedPass(patcher.GoschedOptions{CallThreshold: 1})
+		lp, lm := patcher.InstructionLimitPass(1000)
+		mp, mm := patcher.MemoryLimitPass(1 << 20)
+		bc, err := c.Compile(script, opts, patcher.NewPipeline(gp, lp, mp))
+		require.NoError(t, err)
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		return ret, g, lm, mm
+	}
+
+	ret, g, lm, mm := compile(t)
+	require.Equal(t, Int(11), ret)
+	require.Equal(t, patcher.CacheStats{Misses: 1}, c.Stats())
+
+	// callables of the new passes are attached to the loaded bytecode
+	ret2, g2, lm2, mm2 := compile(t)
+	require.Equal(t, ret, ret2)
+	require.Equal(t, patcher.CacheStats{Hits: 1, Misses: 1}, c.Stats())
+	require.Equal(t, g.Stats().Calls, g2.Stats().Calls)
+	require.Equal(t, lm.Used(), lm2.Used())
+	require.Equal(t, mm.Used(), mm2.Used())
+	require.NotZero(t, lm2.Used())
+	require.NotZero(t, mm2.Used())
+
+	// changing the source module compiles the script again
+	modules.AddSourceModule("mod", []byte(`return 2`))
+	ret, _, _, _ = compile(t)
+	require.Equal(t, Int(12), ret)
+	require.Equal(t, patcher.CacheStats{Hits: 1, Misses: 2}, c.Stats())
+
+	// a broken file is replaced
+	dir := t.TempDir()
+	c = patcher.NewCache(dir)
+	_, _, _, _ = compile(t)
+	files, err := filepath.Glob(filepath.Join(dir, "*.bc"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.NoError(t, os.WriteFile(files[0], []byte("broken"), 0o644))
+	ret, _, _, _ = compile(t)
+	require.Equal(t, Int(12), ret)
+	_, _, _, _ = compile(t)
+	require.Equal(t, patcher.CacheStats{Hits: 1, Misses: 2}, c.Stats())
+
+	// callables of passes without Attach cannot be stored, which does not
+	// fail compiling
+	var storeErr error
+	c.StoreError = func(err error) { storeErr = err }
+	var called bool
+	hook := patcher.ApplyPass("hook", func(bc *Bytecode) error {
+		return patcher.PatchForHooks(bc, patcher.Hooks{
+			Exit: func() Object {
+				return &hookFunc{fn: func(Call) { called = true }}
+			},
+		})
+	})
+	bc, err := c.Compile(script, opts, patcher.NewPipeline(hook))
+	require.NoError(t, err)
+	require.EqualError(t, storeErr,
+		"cache: constant 9 of type <hookFunc> cannot be encoded")
+	require.Equal(t, patcher.CacheStats{Hits: 1, Misses: 3, StoreErrors: 1}, c.Stats())
+	ret, err = NewVM(bc).Run(nil)
+	require.NoError(t, err)
+	require.Equal(t, Int(12), ret)
+	require.True(t, called)
+
+	_, err = c.Compile(script, CompilerOptions{Constants: []Object{Int(1)}},
+		patcher.NewPipeline())
+	require.Error(t, err)
+
+	// compile errors are returned
+	_, err = c.Compile([]byte(`return x`), opts, patcher.NewPipeline())
+	require.Error(t, err)
+}
+
+func TestCacheKey(t *testing.T) {
+	script := []byte(`return 1`)
+	key := func(opts CompilerOptions, passes ...patcher.Pass) string {
+		return patcher.CacheKey(script, opts, patcher.NewPipeline(passes...))
+	}
+	apply := func(bc *Bytecode) error { return nil }
+
+	base := key(CompilerOptions{})
+	require.Len(t, base, 64)
+	require.Equal(t, base, key(CompilerOptions{}))
+	require.NotEqual(t, base, key(CompilerOptions{NoOptimize: true}))
+	require.NotEqual(t, base, key(CompilerOptions{ModulePath: "a"}))
+	require.NotEqual(t, base, patcher.CacheKey([]byte(`return 2`),
+		CompilerOptions{}, patcher.NewPipeline()))
+
+	withPass := key(CompilerOptions{}, patcher.ApplyPass("a", apply))
+	require.NotEqual(t, base, withPass)
+	require.NotEqual(t, withPass, key(CompilerOptions{}, patcher.ApplyPass("b", apply)))
+
+	pass := patcher.ApplyPass("a", apply)
+	pass.Key = "1"
+	require.NotEqual(t, withPass, key(CompilerOptions{}, pass))
+
+	// runtime configuration is not a part of the key
+	p1, _ := patcher.InstructionLimitPass(1)
+	p2, _ := patcher.InstructionLimitPass(2)
+	require.Equal(t, key(CompilerOptions{}, p1), key(CompilerOptions{}, p2))
+
+	// versions of the modules in the build are a part of the key
+	restore := patcher.SetCacheBuild("github.com/ozanh/ugo@v0.0.0 h1:x\n")
+	defer restore()
+	require.NotEqual(t, base, key(CompilerOptions{}))
+}
+
+func TestCachePasses(t *testing.T) {
+	script := []byte(`
+	x := import("strings")
+	m := {}
+	s := []
+	for i := 0; i < 5; i++ {
+		s = append(s, x.ToUpper("a"))
+		m[i] = i
+	}
+	try {
+		throw "error"
+	} catch err {
+		s = append(s, string(err))
+	}
+	return [len(s), len(m), s[0]]`)
+
+	modules := NewModuleMap()
+	modules.AddBuiltinModule("strings", Map{"ToUpper": &Function{
+		Name: "ToUpper",
+		Value: func(args ...Object) (Object, error) {
+			return String("A"), nil
+		},
+	}})
+	opts := CompilerOptions{ModuleMap: modules}
+	expected := Array{Int(6), Int(5), String("A")}
+
+	// test cases return a new pass and a function returning what the pass
+	// observed while running the bytecode
+	testCases := map[string]func() (patcher.Pass, func() interface{}){
+		"coverage": func() (patcher.Pass, func() interface{}) {
+			pass, cov := patcher.CoveragePass()
+			return pass, func() interface{} { return cov.Lines() }
+		},
+		"gosched": func() (patcher.Pass, func() interface{}) {
+			pass, g := patcher.GoschedPass(patcher.GoschedOptions{CallThreshold: 1})
+			return pass, func() interface{} { return g.Stats().Calls }
+		},
+		"gosched-perrun": func() (patcher.Pass, func() interface{}) {
+			pass, g := patcher.GoschedPass(patcher.GoschedOptions{
+				CallThreshold: 1,
+				PerRun:        true,
+			})
+			return pass, func() interface{} { return g.Stats().Calls }
+		},
+		"instruction-limit": func() (patcher.Pass, func() interface{}) {
+			pass, m := patcher.InstructionLimitPass(1000)
+			return pass, func() interface{} { return m.Used() }
+		},
+		"memory-limit": func() (patcher.Pass, func() interface{}) {
+			pass, m := patcher.MemoryLimitPass(1 << 20)
+			return pass, func() interface{} { return m.Used() }
+		},
+		"optimize": func() (patcher.Pass, func() interface{}) {
+			pass, _ := patcher.OptimizePass()
+			return pass, func() interface{} { return nil }
+		},
+		"replay": func() (patcher.Pass, func() interface{}) {
+			var log bytes.Buffer
+			rp := patcher.NewRecorder(&log)
+			pass := patcher.ReplayPass(rp, []string{"strings.ToUpper", "append"})
+			return pass, func() interface{} {
+				require.NoError(t, rp.Flush())
+				return log.String()
+			}
+		},
+		"watch": func() (patcher.Pass, func() interface{}) {
+			var events []string
+			pass := patcher.WatchPass(func(ev patcher.WatchEvent) error {
+				events = append(events, fmt.Sprintf("%s %s %s %s %s %s:%d:%d %d",
+					ev.Kind, ev.Name, ev.Func, ev.Old, ev.New, ev.File, ev.Line,
+					ev.Column, ev.Pos))
+				return nil
+			}, patcher.WatchOptions{})
+			return pass, func() interface{} { return events }
+		},
+	}
+	for name, newPass := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c := patcher.NewCache(t.TempDir())
+			c.StoreError = func(err error) { require.NoError(t, err) }
+			run := func() interface{} {
+				pass, observe := newPass()
+				bc, err := c.Compile(script, opts, patcher.NewPipeline(pass))
+				require.NoError(t, err)
+				ret, err := NewVM(bc).Run(nil)
+				require.NoError(t, err)
+				require.Equal(t, expected, ret)
+				return observe()
+			}
+			observed := run()
+			require.Equal(t, observed, run())
+			require.Equal(t, patcher.CacheStats{Hits: 1, Misses: 1}, c.Stats())
+		})
+	}
+}
+
+func BenchmarkCache(b *testing.B) {
+	script := []byte(`
+	var fib
+	fib = func(n) {
+		if n < 2 {
+			return n
+		}
+		return fib(n-1) + fib(n-2)
+	}
+	s := []
+	for i := 0; i < 10; i++ {
+		s = append(s, {a: fib(i), b: [i, i*2]})
+	}
+	return s`)
+	pipeline := func() *patcher.Pipeline {
+		gp, _ := patcher.GoschedPass(patcher.GoschedOptions{CallThreshold: 100})
+		lp, _ := patcher.InstructionLimitPass(1 << 20)
+		mp, _ := patcher.MemoryLimitPass(1 << 20)
+		return patcher.NewPipeline(gp, lp, mp)
+	}
+
+	b.Run("compile", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bc, err := Compile(script, CompilerOptions{})
+			if err == nil {
+				_, err = pipeline().Run(bc)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cache", func(b *testing.B) {
+		c := patcher.NewCache(b.TempDir())
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Compile(script, CompilerOptions{}, pipeline()); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if c.Stats().Misses != 1 {
+			b.Fatal("cache misses")
+		}
+	})
+}
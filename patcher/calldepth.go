@@ -0,0 +1,290 @@
+package patcher
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+)
+
+// ErrCallDepth is the error matched by CallDepthError with errors.Is.
+var ErrCallDepth = errors.New("call depth limit exceeded")
+
+// CallDepthError is the error thrown by the callables added by
+// PatchForCallDepth when a function is entered deeper than the limit. Errors
+// returned from ugo.VM wrap it, use errors.As to get it.
+type CallDepthError struct {
+	Limit int
+	// Func is the name of the entered function like the names returned by
+	// FuncName.
+	Func string
+	// File, Line and Column are the first source position of the function if
+	// it is known.
+	File   string
+	Line   int
+	Column int
+}
+
+func (e *CallDepthError) Error() string {
+	if e.File == "" && e.Line == 0 {
+		return fmt.Sprintf("%s: %d entering %s", ErrCallDepth, e.Limit, e.Func)
+	}
+	return fmt.Sprintf("%s: %d entering %s at %s:%d:%d",
+		ErrCallDepth, e.Limit, e.Func, e.File, e.Line, e.Column)
+}
+
+// Is reports whether target is ErrCallDepth.
+func (e *CallDepthError) Is(target error) bool {
+	return target == ErrCallDepth
+}
+
+// PatchForCallDepth modifies given ugo.Bytecode to add callables tracking the
+// call depth of compiled functions including the main function. Callables are
+// called at function entries, before returns, before try statements to get
+// the depth and at the start of catch and finally blocks to drop the frames
+// left by thrown errors. Entering a function deeper than the limit throws a
+// *CallDepthError before the VM runs out of stack. Call depth is tracked per
+// run of ugo.VM, so the patched ugo.Bytecode can be run concurrently, and
+// functions called by a VM which has not run the main function are not
+// tracked. Note that tail call optimization of the VM is disabled by this
+// patch. Functions having try statements and using all 256 local variables
+// cannot be patched since the depth is kept in a local variable. If error is
+// returned, given ugo.Bytecode must be discarded due to invalid patching.
+func PatchForCallDepth(bc *ugo.Bytecode, limit int) error {
+	// Generate following instructions to insert at function entry points and
+	// before returns, which pass the state of the run to the site.
+	/*
+		0000 CONSTANT <site index>
+		0000 LOADMODULE <starter index> <module index>
+		0000 POP
+		0000 CALL 1 0
+		0000 POP
+	*/
+	// Depth before try statements is stored with the following instructions,
+	// and passed to the unwind sites at the start of catch and finally blocks.
+	/*
+		0000 CONSTANT <site index>
+		0000 LOADMODULE <starter index> <module index>
+		0000 POP
+		0000 CALL 1 0
+		0000 DEFINELOCAL <try local>
+		....
+		0000 CONSTANT <site index>
+		0000 LOADMODULE <starter index> <module index>
+		0000 POP
+		0000 GETLOCAL <try local>
+		0000 CALL 2 0
+		0000 POP
+	*/
+
+	if limit <= 0 {
+		panic("limit must be greater than 0")
+	}
+
+	constIndex := len(bc.Constants)
+	sites := []ugo.Object{&depthStart{}}
+	rs, err := newRunState(bc, constIndex, -1)
+	if err != nil {
+		return err
+	}
+	start, err := rs.startInsts()
+	if err != nil {
+		return err
+	}
+	var curFn *depthFunc
+	var tryLocal int
+
+	addSite := func(kind depthSiteKind) int {
+		sites = append(sites, &depthSite{limit: limit, fn: curFn, kind: kind})
+		return constIndex + len(sites) - 1
+	}
+	siteInsts := func(kind depthSiteKind) []byte {
+		var insts []byte
+		insts, err = rs.callInsts(addSite(kind))
+		return insts
+	}
+
+	p := New(bc, func(it *Iterator) (Op, []byte) {
+		if err != nil {
+			return Next, nil
+		}
+		var insts []byte
+		if it.Pos() == 0 {
+			curFn = newDepthFunc(bc.FileSet, it.Func(), it.FuncIndex())
+			tryLocal = -1
+			if it.FuncIndex() < 0 {
+				insts = append(insts, start...)
+			}
+			insts = append(insts, siteInsts(depthEnter)...)
+		}
+		switch it.Opcode() {
+		case ugo.OpReturn:
+			insts = append(insts, siteInsts(depthExit)...)
+		case ugo.OpSetupTry:
+			fn := it.Func()
+			if tryLocal < 0 {
+				if fn.NumLocals > 255 {
+					err = fmt.Errorf("no local variable left for call depth: %d",
+						fn.NumLocals)
+					return Next, nil
+				}
+				tryLocal = fn.NumLocals
+				fn.NumLocals++
+			}
+			var try []byte
+			try, err = makeInsts(
+				[]int{int(ugo.OpConstant), addSite(depthTry)},
+				[]int{int(ugo.OpLoadModule), rs.starter, rs.module},
+				[]int{int(ugo.OpPop)},
+				[]int{int(ugo.OpCall), 1, 0},
+				[]int{int(ugo.OpDefineLocal), tryLocal},
+			)
+			insts = append(insts, try...)
+		case ugo.OpSetupCatch, ugo.OpSetupFinally:
+			var unwind []byte
+			unwind, err = makeInsts(
+				[]int{int(ugo.OpConstant), addSite(depthUnwind)},
+				[]int{int(ugo.OpLoadModule), rs.starter, rs.module},
+				[]int{int(ugo.OpPop)},
+				[]int{int(ugo.OpGetLocal), tryLocal},
+				[]int{int(ugo.OpCall), 2, 0},
+				[]int{int(ugo.OpPop)},
+			)
+			return blockStartOp(it.Opcode()), unwind
+		}
+		if len(insts) == 0 {
+			return Next, nil
+		}
+		if it.Pos() == 0 {
+			// jumps to the first instruction must not enter the function again
+			return InsertBefore, insts
+		}
+		return Prepend, insts
+	})
+	if err2 := p.Patch(); err2 != nil {
+		return err2
+	}
+	if err != nil {
+		return err
+	}
+
+	bc.Constants = append(bc.Constants, sites...)
+	return debugVerify(bc)
+}
+
+// depthFunc identifies a patched function in the call stack.
+type depthFunc struct {
+	err CallDepthError
+}
+
+func newDepthFunc(
+	fileSet *parser.SourceFileSet,
+	fn *ugo.CompiledFunction,
+	index int,
+) *depthFunc {
+	name, pos := FuncName(fileSet, fn, index)
+	f := &depthFunc{err: CallDepthError{Func: name}}
+	if fileSet != nil && pos.IsValid() {
+		p := fileSet.Position(pos)
+		f.err.File, f.err.Line, f.err.Column = p.Filename, p.Line, p.Column
+	}
+	return f
+}
+
+// depthStart is the starter of the run state of PatchForCallDepth, which
+// creates a new depthRun for each run.
+type depthStart struct {
+	ugo.ObjectImpl
+}
+
+var _ runStarter = (*depthStart)(nil)
+
+func (s *depthStart) String() string   { return "<callDepthStart>" }
+func (s *depthStart) TypeName() string { return s.String() }
+func (s *depthStart) CanCall() bool    { return true }
+func (s *depthStart) runStarter()      {}
+
+func (s *depthStart) Call(args ...ugo.Object) (ugo.Object, error) {
+	return s.CallEx(ugo.NewCall(nil, args))
+}
+
+func (s *depthStart) CallEx(_ ugo.Call) (ugo.Object, error) {
+	return &depthRun{}, nil
+}
+
+// depthRun is the state of a run tracking the call stack of the patched
+// functions. It is locked since the VMs created by the invokers of the VM
+// share it.
+type depthRun struct {
+	ugo.ObjectImpl
+	mu    sync.Mutex
+	stack CallStack[*depthFunc]
+}
+
+func (r *depthRun) String() string   { return "<callDepthRun>" }
+func (r *depthRun) TypeName() string { return r.String() }
+
+type depthSiteKind int
+
+const (
+	depthEnter depthSiteKind = iota
+	depthExit
+	depthTry
+	depthUnwind
+)
+
+// depthSite is the callable added to ugo.Bytecode to track the call depth,
+// which is called with the depthRun of the VM.
+type depthSite struct {
+	ugo.ObjectImpl
+	limit int
+	fn    *depthFunc
+	kind  depthSiteKind
+}
+
+var _ ugo.ExCallerObject = (*depthSite)(nil)
+
+func (s *depthSite) String() string   { return "<callDepth>" }
+func (s *depthSite) TypeName() string { return s.String() }
+func (s *depthSite) CanCall() bool    { return true }
+
+func (s *depthSite) Call(args ...ugo.Object) (ugo.Object, error) {
+	return s.CallEx(ugo.NewCall(nil, args))
+}
+
+func (s *depthSite) CallEx(c ugo.Call) (ugo.Object, error) {
+	var r *depthRun
+	if c.Len() > 0 {
+		r, _ = c.Get(0).(*depthRun)
+	}
+	if r == nil {
+		// the VM has not run the main function
+		return ugo.Int(0), nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch s.kind {
+	case depthEnter:
+		if r.stack.Len() >= s.limit {
+			err := s.fn.err
+			err.Limit = s.limit
+			return ugo.Undefined, &err
+		}
+		r.stack.Push(s.fn)
+	case depthExit:
+		r.stack.Pop()
+	case depthTry:
+		return ugo.Int(r.stack.Len()), nil
+	case depthUnwind:
+		if c.Len() < 2 {
+			break
+		}
+		if height, ok := c.Get(1).(ugo.Int); ok {
+			r.stack.Cut(int(height), nil)
+		}
+	}
+	return ugo.Undefined, nil
+}
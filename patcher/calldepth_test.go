@@ -0,0 +1,170 @@
+package patcher_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPatchForCallDepth(t *testing.T) {
+	script := `param n
+var fib
+fib = func(n) {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+deep := func(n) {
+	try {
+		return fib(n)
+	} catch err {
+		return -1
+	}
+}
+sum := 0
+for i := 0; i < 10; i++ {
+	sum += deep(n)
+}
+return [sum, fib(n)]`
+
+	expectCompile(t, script, CompilerOptions{ModulePath: "(main)"}, func(bc *Bytecode) {
+		err := patcher.PatchForCallDepth(bc, 8)
+		require.NoError(t, err)
+
+		vm := NewVM(bc)
+		// main, fib(6) to fib(0) through deep or not
+		ret, err := vm.Run(nil, Int(6))
+		require.NoError(t, err)
+		require.Equal(t, Array{Int(80), Int(8)}, ret)
+
+		// errors caught in deep do not leave frames behind
+		ret, err = vm.Run(nil, Int(7))
+		require.NoError(t, err)
+		require.Equal(t, Array{Int(-10), Int(13)}, ret)
+
+		ret, err = vm.Run(nil, Int(8))
+		require.Error(t, err)
+		var depthErr *patcher.CallDepthError
+		require.True(t, errors.As(err, &depthErr), "%v", err)
+		require.True(t, errors.Is(err, patcher.ErrCallDepth))
+		require.Equal(t, patcher.CallDepthError{
+			Limit:  8,
+			Func:   "func@(main):4:2",
+			File:   "(main)",
+			Line:   4,
+			Column: 2,
+		}, *depthErr)
+		require.Equal(t, "call depth limit exceeded: 8 entering "+
+			"func@(main):4:2 at (main):4:2", depthErr.Error())
+		require.Nil(t, ret)
+
+		// previous failed run does not affect the next one
+		ret, err = vm.Run(nil, Int(5))
+		require.NoError(t, err)
+		require.Equal(t, Array{Int(50), Int(5)}, ret)
+	})
+
+	// errors thrown through the frames of a recursive function are caught by
+	// an outer frame of the same function
+	script = `var g
+g = func(k, n) {
+	if n > 0 {
+		if n == 1 {
+			throw "x"
+		}
+		return g(k, n-1)
+	}
+	try {
+		g(k, 4)
+	} catch e {
+	}
+	if k == 0 {
+		return "ok"
+	}
+	return g(k-1, 0)
+}
+return g(10, 0)`
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		require.NoError(t, patcher.PatchForCallDepth(bc, 20))
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, String("ok"), ret)
+	})
+
+	// main function is counted
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		require.NoError(t, patcher.PatchForCallDepth(bc, 1))
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(1), ret)
+	})
+	expectCompile(t, `f := func() {}; return f()`, CompilerOptions{}, func(bc *Bytecode) {
+		require.NoError(t, patcher.PatchForCallDepth(bc, 1))
+		_, err := NewVM(bc).Run(nil)
+		var depthErr *patcher.CallDepthError
+		require.True(t, errors.As(err, &depthErr), "%v", err)
+		require.Equal(t, "call depth limit exceeded: 1 entering func#0",
+			depthErr.Error())
+	})
+}
+
+func TestPatchForCallDepthConcurrentVMs(t *testing.T) {
+	script := `param (n, other)
+var f
+f = func(n, other) {
+	if n > 0 {
+		return f(n-1, other) + 1
+	}
+	if other {
+		other()
+		return f(0, undefined)
+	}
+	return 0
+}
+return f(n, other)`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		require.NoError(t, patcher.PatchForCallDepth(bc, 10))
+
+		const numVMs = 8
+		var wg sync.WaitGroup
+		for i := 0; i < numVMs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				vm := NewVM(bc)
+				// other VM runs at the depth limit of this VM without
+				// changing its depth
+				other := &Function{
+					Name: "other",
+					Value: func(args ...Object) (Object, error) {
+						ret, err := NewVM(bc).Run(nil, Int(8))
+						require.NoError(t, err)
+						require.Equal(t, Int(8), ret)
+						return Undefined, nil
+					},
+				}
+				for j := 0; j < 20; j++ {
+					// main and f(8) to f(0)
+					ret, err := vm.Run(nil, Int(8))
+					require.NoError(t, err)
+					require.Equal(t, Int(8), ret)
+
+					_, err = vm.Run(nil, Int(8), other)
+					require.True(t, errors.Is(err, patcher.ErrCallDepth), "%v", err)
+					var depthErr *patcher.CallDepthError
+					require.True(t, errors.As(err, &depthErr))
+					require.Equal(t, "func@(main):4:2", depthErr.Func)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
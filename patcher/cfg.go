@@ -0,0 +1,376 @@
+package patcher
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ozanh/ugo"
+)
+
+// EdgeKind is the kind of a control flow edge.
+type EdgeKind byte
+
+// List of edge kinds.
+const (
+	// EdgeFallthrough is the edge to the next block.
+	EdgeFallthrough EdgeKind = iota
+	// EdgeJump is the edge of an unconditional jump.
+	EdgeJump
+	// EdgeBranch is the taken edge of a conditional jump, the other one is
+	// EdgeFallthrough.
+	EdgeBranch
+	// EdgeCatch is the edge from the block setting up a try statement to its
+	// catch block.
+	EdgeCatch
+	// EdgeFinally is the edge from the block setting up a try statement to its
+	// finally block.
+	EdgeFinally
+)
+
+var edgeKindNames = [...]string{
+	EdgeFallthrough: "fallthrough",
+	EdgeJump:        "jump",
+	EdgeBranch:      "branch",
+	EdgeCatch:       "catch",
+	EdgeFinally:     "finally",
+}
+
+func (k EdgeKind) String() string {
+	if int(k) < len(edgeKindNames) {
+		return edgeKindNames[k]
+	}
+	return fmt.Sprintf("EdgeKind(%d)", k)
+}
+
+// Edge is a control flow edge between two blocks identified by their indexes.
+type Edge struct {
+	From int
+	To   int
+	Kind EdgeKind
+	// Back reports whether To dominates From, i.e. the edge closes a loop.
+	Back bool
+}
+
+// Block is a basic block of a CFG, which is a sequence of instructions in
+// [Start, End) range that can only be entered from the first instruction.
+type Block struct {
+	Index    int
+	Start    int
+	End      int
+	NumInsts int
+	Succs    []Edge
+	Preds    []Edge
+	// Reachable reports whether the block is reachable from the entry block.
+	Reachable bool
+	// Idom is the index of the immediate dominator of the block, or -1 for the
+	// entry block and unreachable blocks.
+	Idom int
+	// LoopHeader reports whether the block is the header of a loop.
+	LoopHeader bool
+	// LoopDepth is the number of loops containing the block.
+	LoopDepth int
+}
+
+// Loop is a natural loop of a CFG.
+type Loop struct {
+	// Header is the index of the block dominating the blocks of the loop.
+	Header int
+	// Latches are the indexes of the blocks having back edges to the header.
+	Latches []int
+	// Blocks are the indexes of the blocks of the loop in order, including
+	// the header.
+	Blocks []int
+}
+
+// CFG is the control flow graph of a compiled function.
+type CFG struct {
+	Func *ugo.CompiledFunction
+	// Blocks are the basic blocks in the order of their positions, the first
+	// one is the entry block.
+	Blocks []*Block
+	// Loops are the natural loops in the order of their headers.
+	Loops []*Loop
+}
+
+// BuildCFG returns the control flow graph of given function. A block ends
+// after a jump, a return, a throw or the setup of a try statement, or before a
+// jump target. As every instruction in a try statement may throw, catch and
+// finally edges are added from the block setting up the try statement instead
+// of the blocks throwing errors. Jumps to finally blocks from the returns and
+// the loop exits in try statements, and the jumps back from the end of finally
+// blocks, are not represented as they are resolved at runtime.
+func BuildCFG(fn *ugo.CompiledFunction) (*CFG, error) {
+	blocks, err := basicBlocks(fn.Instructions)
+	if err != nil {
+		return nil, err
+	}
+	g := &CFG{Func: fn, Blocks: make([]*Block, len(blocks))}
+	byStart := make(map[int]int, len(blocks))
+	for i, b := range blocks {
+		g.Blocks[i] = &Block{
+			Index:    i,
+			Start:    b.start,
+			End:      b.end,
+			NumInsts: b.numInsts,
+			Idom:     -1,
+		}
+		byStart[b.start] = i
+	}
+
+	addEdge := func(from, target int, kind EdgeKind) error {
+		to, ok := byStart[target]
+		if !ok {
+			return fmt.Errorf("cfg: invalid jump target %d in block %d", target, from)
+		}
+		e := Edge{From: from, To: to, Kind: kind}
+		g.Blocks[from].Succs = append(g.Blocks[from].Succs, e)
+		g.Blocks[to].Preds = append(g.Blocks[to].Preds, e)
+		return nil
+	}
+
+	var index int
+	it := NewIterator(fn.Instructions)
+	for it.Next() {
+		b := g.Blocks[index]
+		next := it.Pos() + it.Offset() + 1
+		if next < b.End {
+			continue
+		}
+		index++
+		operands := it.Operands()
+		falls := true
+		switch it.Opcode() {
+		case ugo.OpJump:
+			falls = false
+			err = addEdge(b.Index, operands[0], EdgeJump)
+		case ugo.OpJumpFalsy, ugo.OpAndJump, ugo.OpOrJump:
+			err = addEdge(b.Index, operands[0], EdgeBranch)
+		case ugo.OpSetupTry:
+			if operands[0] > 0 {
+				err = addEdge(b.Index, operands[0], EdgeCatch)
+			}
+			if err == nil && operands[1] > 0 {
+				err = addEdge(b.Index, operands[1], EdgeFinally)
+			}
+		case ugo.OpReturn:
+			falls = false
+		case ugo.OpThrow:
+			// operand 0 is used at the end of finally blocks to rethrow the
+			// error or to go back to the return, otherwise it continues
+			falls = operands[0] == 0
+		}
+		if err == nil && falls && index < len(g.Blocks) {
+			err = addEdge(b.Index, next, EdgeFallthrough)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	if len(g.Blocks) > 0 {
+		g.dominators()
+		g.findLoops()
+	}
+	return g, nil
+}
+
+// dominators sets the reachability and the immediate dominators of the
+// blocks with the algorithm of Cooper, Harvey and Kennedy.
+func (g *CFG) dominators() {
+	var postorder []int
+	var visit func(i int)
+	visit = func(i int) {
+		g.Blocks[i].Reachable = true
+		for _, e := range g.Blocks[i].Succs {
+			if !g.Blocks[e.To].Reachable {
+				visit(e.To)
+			}
+		}
+		postorder = append(postorder, i)
+	}
+	visit(0)
+
+	order := make([]int, len(g.Blocks))
+	for i, b := range postorder {
+		order[b] = i
+	}
+	intersect := func(a, b int) int {
+		for a != b {
+			for order[a] < order[b] {
+				a = g.Blocks[a].Idom
+			}
+			for order[b] < order[a] {
+				b = g.Blocks[b].Idom
+			}
+		}
+		return a
+	}
+
+	g.Blocks[0].Idom = 0
+	for changed := true; changed; {
+		changed = false
+		for i := len(postorder) - 2; i >= 0; i-- {
+			b := g.Blocks[postorder[i]]
+			idom := -1
+			for _, e := range b.Preds {
+				if g.Blocks[e.From].Idom < 0 {
+					continue
+				}
+				if idom < 0 {
+					idom = e.From
+				} else {
+					idom = intersect(e.From, idom)
+				}
+			}
+			if b.Idom != idom {
+				b.Idom = idom
+				changed = true
+			}
+		}
+	}
+	g.Blocks[0].Idom = -1
+}
+
+// Dominates reports whether block a dominates block b, i.e. every path from
+// the entry block to b goes through a. A reachable block dominates itself.
+func (g *CFG) Dominates(a, b int) bool {
+	if !g.Blocks[a].Reachable || !g.Blocks[b].Reachable {
+		return false
+	}
+	for ; b >= 0; b = g.Blocks[b].Idom {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+// findLoops marks the back edges and collects the natural loops. Loops sharing
+// a header are merged.
+func (g *CFG) findLoops() {
+	loops := make(map[int]*Loop)
+	for _, b := range g.Blocks {
+		for i, e := range b.Succs {
+			if !g.Dominates(e.To, e.From) {
+				continue
+			}
+			b.Succs[i].Back = true
+			to := g.Blocks[e.To]
+			for j := range to.Preds {
+				if to.Preds[j] == e {
+					to.Preds[j].Back = true
+				}
+			}
+			to.LoopHeader = true
+			loop, ok := loops[e.To]
+			if !ok {
+				loop = &Loop{Header: e.To}
+				loops[e.To] = loop
+				g.Loops = append(g.Loops, loop)
+			}
+			if n := len(loop.Latches); n == 0 || loop.Latches[n-1] != e.From {
+				loop.Latches = append(loop.Latches, e.From)
+			}
+		}
+	}
+	sort.Slice(g.Loops, func(i, j int) bool {
+		return g.Loops[i].Header < g.Loops[j].Header
+	})
+
+	for _, loop := range g.Loops {
+		body := map[int]bool{loop.Header: true}
+		stack := append([]int(nil), loop.Latches...)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if body[i] {
+				continue
+			}
+			body[i] = true
+			for _, e := range g.Blocks[i].Preds {
+				if g.Blocks[e.From].Reachable {
+					stack = append(stack, e.From)
+				}
+			}
+		}
+		for i := range body {
+			loop.Blocks = append(loop.Blocks, i)
+			g.Blocks[i].LoopDepth++
+		}
+		sort.Ints(loop.Blocks)
+	}
+}
+
+// WriteDOT writes the graph in Graphviz DOT format with given graph name.
+// Blocks are labeled with their instructions, loop headers are drawn with
+// double borders, unreachable blocks are dotted, and back edges are bold.
+func (g *CFG) WriteDOT(w io.Writer, name string) error {
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(bw, "digraph %s {\n", dotQuote(name))
+	_, _ = bw.WriteString("\tnode [shape=box fontname=\"monospace\"];\n")
+
+	labels := make([]strings.Builder, len(g.Blocks))
+	var index int
+	it := NewIterator(g.Func.Instructions)
+	for it.Next() {
+		for it.Pos() >= g.Blocks[index].End {
+			index++
+		}
+		label := &labels[index]
+		if label.Len() == 0 {
+			fmt.Fprintf(label, "B%d\\l", index)
+		}
+		line := strings.TrimRight(fmt.Sprintf("%04d %-12s %s", it.Pos(),
+			ugo.OpcodeNames[it.Opcode()], formatOperands(it)), " ")
+		label.WriteString(dotEscape(line) + "\\l")
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	for _, b := range g.Blocks {
+		attrs := ""
+		if b.LoopHeader {
+			attrs += " peripheries=2"
+		}
+		if !b.Reachable {
+			attrs += " style=dotted"
+		}
+		_, _ = fmt.Fprintf(bw, "\tB%d [label=\"%s\"%s];\n",
+			b.Index, labels[b.Index].String(), attrs)
+	}
+	for _, b := range g.Blocks {
+		for _, e := range b.Succs {
+			var attrs []string
+			if e.Kind != EdgeFallthrough {
+				attrs = append(attrs, "label=\""+e.Kind.String()+"\"")
+			}
+			if e.Kind == EdgeCatch || e.Kind == EdgeFinally {
+				attrs = append(attrs, "style=dashed")
+			}
+			if e.Back {
+				attrs = append(attrs, "penwidth=2")
+			}
+			_, _ = fmt.Fprintf(bw, "\tB%d -> B%d", e.From, e.To)
+			if len(attrs) > 0 {
+				_, _ = fmt.Fprintf(bw, " [%s]", strings.Join(attrs, " "))
+			}
+			_, _ = bw.WriteString(";\n")
+		}
+	}
+	_, _ = bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+func dotQuote(s string) string {
+	return "\"" + dotEscape(s) + "\""
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,122 @@
+package patcher_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestBuildCFG(t *testing.T) {
+	type edge struct {
+		from, to int
+		kind     patcher.EdgeKind
+		back     bool
+	}
+	edges := func(g *patcher.CFG) []edge {
+		var out []edge
+		for _, b := range g.Blocks {
+			for _, e := range b.Succs {
+				out = append(out, edge{e.From, e.To, e.Kind, e.Back})
+			}
+		}
+		return out
+	}
+
+	expectCompile(t, `x := 0; for { x++; if x > 3 { break } }; return x`,
+		CompilerOptions{}, func(bc *Bytecode) {
+			g, err := patcher.BuildCFG(bc.Main)
+			require.NoError(t, err)
+			require.Len(t, g.Blocks, 6)
+			require.Equal(t, []edge{
+				{0, 1, patcher.EdgeFallthrough, false},
+				{1, 3, patcher.EdgeBranch, false},
+				{1, 2, patcher.EdgeFallthrough, false},
+				{2, 4, patcher.EdgeJump, false},
+				{3, 1, patcher.EdgeJump, true},
+			}, edges(g))
+			require.Len(t, g.Loops, 1)
+			require.Equal(t, patcher.Loop{Header: 1, Latches: []int{3}, Blocks: []int{1, 3}},
+				*g.Loops[0])
+			require.True(t, g.Blocks[1].LoopHeader)
+			require.Equal(t, 1, g.Blocks[3].LoopDepth)
+			require.Equal(t, 0, g.Blocks[2].LoopDepth)
+			require.Equal(t, 2, g.Blocks[4].Idom)
+			require.Equal(t, -1, g.Blocks[0].Idom)
+			require.False(t, g.Blocks[5].Reachable)
+			require.Equal(t, 3, g.Blocks[1].Preds[1].From)
+			require.True(t, g.Blocks[1].Preds[1].Back)
+
+			var buf bytes.Buffer
+			require.NoError(t, g.WriteDOT(&buf, "main"))
+			require.Equal(t, `digraph "main" {
+	node [shape=box fontname="monospace"];
+	B0 [label="B0\l0000 CONSTANT     0\l0003 DEFINELOCAL  0\l"];
+	B1 [label="B1\l0005 GETLOCAL     0\l0007 CONSTANT     1\l0010 BINARYOP     12\l0012 SETLOCAL     0\l0014 GETLOCAL     0\l0016 CONSTANT     2\l0019 BINARYOP     40\l0021 JUMPFALSY    L0031\l" peripheries=2];
+	B2 [label="B2\l0026 JUMP         L0036\l"];
+	B3 [label="B3\l0031 JUMP         L0005\l"];
+	B4 [label="B4\l0036 GETLOCAL     0\l0038 RETURN       1\l"];
+	B5 [label="B5\l0040 RETURN       0\l" style=dotted];
+	B0 -> B1;
+	B1 -> B3 [label="branch"];
+	B1 -> B2;
+	B2 -> B4 [label="jump"];
+	B3 -> B1 [label="jump" penwidth=2];
+}
+`, buf.String())
+		})
+
+	// try statements in nested loops
+	expectCompile(t, `
+	f := func(n) {
+		for i := 0; i < n; i++ {
+			for j := 0; j < i; j++ {
+				try {
+					if j { return 1 }
+					throw "x"
+				} catch e {
+					continue
+				} finally {
+					n--
+				}
+			}
+		}
+	}`, CompilerOptions{}, func(bc *Bytecode) {
+		g, err := patcher.BuildCFG(bc.Constants[len(bc.Constants)-1].(*CompiledFunction))
+		require.NoError(t, err)
+		require.Len(t, g.Loops, 2)
+		outer, inner := g.Loops[0], g.Loops[1]
+		require.Subset(t, outer.Blocks, inner.Blocks)
+		require.True(t, g.Dominates(outer.Header, inner.Header))
+		require.False(t, g.Dominates(inner.Header, outer.Header))
+		require.Equal(t, 2, g.Blocks[inner.Header].LoopDepth)
+
+		var kinds []patcher.EdgeKind
+		for _, b := range g.Blocks {
+			for _, e := range b.Succs {
+				if e.Kind == patcher.EdgeCatch || e.Kind == patcher.EdgeFinally {
+					kinds = append(kinds, e.Kind)
+					require.Equal(t, 2, g.Blocks[e.From].LoopDepth)
+				}
+			}
+		}
+		require.Equal(t, []patcher.EdgeKind{patcher.EdgeCatch, patcher.EdgeFinally}, kinds)
+		// block after throw is unreachable
+		var unreachable int
+		for _, b := range g.Blocks {
+			if !b.Reachable {
+				unreachable++
+			}
+		}
+		require.Equal(t, 1, unreachable)
+	})
+
+	g, err := patcher.BuildCFG(&CompiledFunction{})
+	require.NoError(t, err)
+	require.Empty(t, g.Blocks)
+	require.Equal(t, "branch", patcher.EdgeBranch.String())
+}
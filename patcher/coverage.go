@@ -0,0 +1,343 @@
+package patcher
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+)
+
+// PatchForCoverage modifies given ugo.Bytecode to add a hit counter callable
+// for each basic block of the functions and inserts a call to the counter at
+// the start of the block. Returned Coverage reports hit counts after running
+// the ugo.Bytecode. Source positions are resolved with the FileSet of the
+// ugo.Bytecode. If error is returned, given ugo.Bytecode must be discarded due
+// to invalid patching.
+func PatchForCoverage(bc *ugo.Bytecode) (*Coverage, error) {
+	pass, cov := CoveragePass()
+	if _, err := NewPipeline(pass).Run(bc); err != nil {
+		return nil, err
+	}
+	return cov, nil
+}
+
+// CoveragePass returns a Pass for Pipeline patching like PatchForCoverage and
+// the Coverage to report hit counts. Source positions are resolved with the
+// FileSet of the patched ugo.Bytecode.
+func CoveragePass() (Pass, *Coverage) {
+	// Generate following instructions to insert at the start of basic blocks.
+	/*
+		0000 CONSTANT <counter index>
+		0000 CALL 0 0
+		0000 POP
+	*/
+
+	cov := &Coverage{}
+	var pc *PassContext
+	var curFn *ugo.CompiledFunction
+	var blocks map[int]*coverBlock
+	var indexes map[*coverBlock]int
+
+	return Pass{
+		Name: "coverage",
+		Start: func(c *PassContext) error {
+			pc = c
+			cov.fileSet = pc.Bytecode().FileSet
+			indexes = make(map[*coverBlock]int)
+			return nil
+		},
+		Visit: func(it *Iterator) (Op, []byte, error) {
+			if curFn != it.Func() {
+				curFn = it.Func()
+				var err error
+				if blocks, err = cov.addBlocks(curFn); err != nil {
+					return Next, nil, err
+				}
+				for _, b := range cov.blocks[len(cov.blocks)-len(blocks):] {
+					indexes[b] = pc.AddConstant(&coverCounter{block: b})
+					// positions are stored by Cache to create the block
+					positions := make(ugo.Array, len(b.positions))
+					for i, pos := range b.positions {
+						positions[i] = ugo.Int(pos)
+					}
+					pc.setCached(indexes[b], positions)
+				}
+			}
+			b, ok := blocks[it.Pos()]
+			if !ok {
+				return Next, nil, nil
+			}
+			insts, err := makeCallInsts(indexes[b])
+			if err != nil {
+				return Next, nil, err
+			}
+			return blockStartOp(it.Opcode()), insts, nil
+		},
+		Attach: func(bc *ugo.Bytecode, consts []ugo.Object) error {
+			cov.fileSet = bc.FileSet
+			for i, c := range consts {
+				positions, ok := c.(ugo.Array)
+				if !ok {
+					return fmt.Errorf("attach: constant %d of type %s is not an array",
+						i, c.TypeName())
+				}
+				b := &coverBlock{index: len(cov.blocks)}
+				for _, v := range positions {
+					pos, ok := v.(ugo.Int)
+					if !ok {
+						return fmt.Errorf("attach: position of type %s is not an int",
+							v.TypeName())
+					}
+					b.positions = append(b.positions, parser.Pos(pos))
+				}
+				cov.blocks = append(cov.blocks, b)
+				consts[i] = &coverCounter{block: b}
+			}
+			return nil
+		},
+	}, cov
+}
+
+// Coverage holds the hit counts of the basic blocks of a ugo.Bytecode patched
+// by PatchForCoverage. It is safe for concurrent use.
+type Coverage struct {
+	fileSet *parser.SourceFileSet
+	blocks  []*coverBlock
+}
+
+// coverBlock holds the source positions of a basic block and its hit count.
+type coverBlock struct {
+	count     uint64 // keep first for 64-bit alignment of atomic operations
+	index     int
+	positions []parser.Pos
+}
+
+func (cov *Coverage) addBlocks(fn *ugo.CompiledFunction) (map[int]*coverBlock, error) {
+	blocks, err := basicBlocks(fn.Instructions)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int]*coverBlock, len(blocks))
+	for _, b := range blocks {
+		cb := &coverBlock{index: len(cov.blocks)}
+		for ip, pos := range fn.SourceMap {
+			if ip >= b.start && ip < b.end && parser.Pos(pos).IsValid() {
+				cb.positions = append(cb.positions, parser.Pos(pos))
+			}
+		}
+		sort.Slice(cb.positions, func(i, j int) bool {
+			return cb.positions[i] < cb.positions[j]
+		})
+		cov.blocks = append(cov.blocks, cb)
+		out[b.start] = cb
+	}
+	return out, nil
+}
+
+// Reset sets all hit counts to zero.
+func (cov *Coverage) Reset() {
+	for _, b := range cov.blocks {
+		atomic.StoreUint64(&b.count, 0)
+	}
+}
+
+// LineCount holds the hit count of a source line.
+type LineCount struct {
+	File  string
+	Line  int
+	Count uint64
+}
+
+// Lines returns the hit counts of source lines sorted by file name and line
+// number. Hit count of a line is the maximum hit count of the basic blocks
+// having an instruction on the line.
+func (cov *Coverage) Lines() []LineCount {
+	type fileLine struct {
+		file string
+		line int
+	}
+	counts := make(map[fileLine]uint64)
+	for _, b := range cov.blocks {
+		count := atomic.LoadUint64(&b.count)
+		for _, pos := range b.positions {
+			p := cov.position(pos)
+			if !p.IsValid() {
+				continue
+			}
+			k := fileLine{file: p.Filename, line: p.Line}
+			if c, ok := counts[k]; !ok || count > c {
+				counts[k] = count
+			}
+		}
+	}
+	lines := make([]LineCount, 0, len(counts))
+	for k, c := range counts {
+		lines = append(lines, LineCount{File: k.file, Line: k.line, Count: c})
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].File != lines[j].File {
+			return lines[i].File < lines[j].File
+		}
+		return lines[i].Line < lines[j].Line
+	})
+	return lines
+}
+
+// Percent returns the percentage of the covered source lines. It returns 0 if
+// there is no line to cover.
+func (cov *Coverage) Percent() float64 {
+	lines := cov.Lines()
+	if len(lines) == 0 {
+		return 0
+	}
+	var covered int
+	for _, l := range lines {
+		if l.Count > 0 {
+			covered++
+		}
+	}
+	return 100 * float64(covered) / float64(len(lines))
+}
+
+// WriteProfile writes the coverage profile in the format of Go's coverprofile
+// in "count" mode. Each basic block having a source position is written as a
+// separate line and number of statements is the number of source positions of
+// the block.
+func (cov *Coverage) WriteProfile(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("mode: count\n")
+	for _, b := range cov.blocks {
+		if len(b.positions) == 0 {
+			continue
+		}
+		start := cov.position(b.positions[0])
+		end := cov.position(b.positions[len(b.positions)-1])
+		if !start.IsValid() || !end.IsValid() {
+			continue
+		}
+		_, _ = fmt.Fprintf(bw, "%s:%d.%d,%d.%d %d %d\n",
+			start.Filename, start.Line, start.Column, end.Line, end.Column,
+			len(b.positions), atomic.LoadUint64(&b.count))
+	}
+	return bw.Flush()
+}
+
+// WriteHTML writes an HTML page showing given sources annotated with hit
+// counts. Sources are keyed by file names, "(main)" is the file name of the
+// main script unless ugo.CompilerOptions.ModulePath is set. Files not found in
+// sources are skipped.
+func (cov *Coverage) WriteHTML(w io.Writer, sources map[string][]byte) error {
+	lines := cov.Lines()
+	counts := make(map[string]map[int]uint64)
+	for _, l := range lines {
+		m, ok := counts[l.File]
+		if !ok {
+			m = make(map[int]uint64)
+			counts[l.File] = m
+		}
+		m[l.Line] = l.Count
+	}
+
+	type htmlLine struct {
+		Num   int
+		Class string
+		Count string
+		Text  string
+	}
+	type htmlFile struct {
+		Name    string
+		Percent string
+		Lines   []htmlLine
+	}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		if _, ok := counts[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	files := make([]htmlFile, 0, len(names))
+	for _, name := range names {
+		m := counts[name]
+		var covered int
+		f := htmlFile{Name: name}
+		src := strings.Split(string(sources[name]), "\n")
+		for i, text := range src {
+			l := htmlLine{Num: i + 1, Text: text}
+			if c, ok := m[i+1]; ok {
+				l.Count = fmt.Sprint(c)
+				if c > 0 {
+					l.Class = "cov"
+					covered++
+				} else {
+					l.Class = "nocov"
+				}
+			}
+			f.Lines = append(f.Lines, l)
+		}
+		f.Percent = fmt.Sprintf("%.1f%%", 100*float64(covered)/float64(len(m)))
+		files = append(files, f)
+	}
+	return coverHTMLTemplate.Execute(w, files)
+}
+
+func (cov *Coverage) position(pos parser.Pos) parser.SourceFilePos {
+	if cov.fileSet == nil {
+		return parser.SourceFilePos{}
+	}
+	return cov.fileSet.Position(pos)
+}
+
+var coverHTMLTemplate = template.Must(template.New("coverage").Parse(
+	`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>uGO Coverage</title>
+<style>
+body { font-family: monospace; background: #fff; color: #333; }
+table { border-collapse: collapse; }
+td { padding: 0 8px; white-space: pre; }
+.num, .count { color: #999; text-align: right; }
+.cov { background: #c8f0c8; }
+.nocov { background: #f8c8c8; }
+</style>
+</head>
+<body>
+{{range .}}<h3>{{.Name}} ({{.Percent}})</h3>
+<table>
+{{range .Lines}}<tr class="{{.Class}}"><td class="num">{{.Num}}</td><td class="count">{{.Count}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// coverCounter is the callable added to ugo.Bytecode by PatchForCoverage to
+// count the hits of a basic block.
+type coverCounter struct {
+	ugo.ObjectImpl
+	block *coverBlock
+}
+
+var _ ugo.ExCallerObject = (*coverCounter)(nil)
+
+func (c *coverCounter) String() string   { return "<coverCounter>" }
+func (c *coverCounter) TypeName() string { return c.String() }
+func (c *coverCounter) CanCall() bool    { return true }
+
+func (c *coverCounter) Call(args ...ugo.Object) (ugo.Object, error) {
+	return c.CallEx(ugo.Call{})
+}
+
+func (c *coverCounter) CallEx(_ ugo.Call) (ugo.Object, error) {
+	atomic.AddUint64(&c.block.count, 1)
+	return ugo.Undefined, nil
+}
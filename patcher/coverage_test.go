@@ -0,0 +1,72 @@
+package patcher_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPatchForCoverage(t *testing.T) {
+	script := `f := func(x) {
+	if x > 2 {
+		return "big"
+	}
+	return "small"
+}
+sum := 0
+for i := 0; i < 3; i++ {
+	sum += i
+}
+try {
+	throw "err"
+} catch err {
+	sum++
+}
+return [f(1), f(2), sum]`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		cov, err := patcher.PatchForCoverage(bc)
+		require.NoError(t, err)
+
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Array{String("small"), String("small"), Int(4)}, ret)
+
+		counts := map[int]uint64{}
+		for _, l := range cov.Lines() {
+			require.Equal(t, "(main)", l.File)
+			counts[l.Line] = l.Count
+		}
+		require.Equal(t, uint64(2), counts[2])
+		require.Equal(t, uint64(0), counts[3])
+		require.Equal(t, uint64(2), counts[5])
+		require.Equal(t, uint64(3), counts[9])
+		require.Equal(t, uint64(1), counts[12])
+		require.Equal(t, uint64(1), counts[14])
+		require.Equal(t, uint64(1), counts[16])
+		require.Less(t, cov.Percent(), 100.0)
+		require.Greater(t, cov.Percent(), 80.0)
+
+		var buf bytes.Buffer
+		require.NoError(t, cov.WriteProfile(&buf))
+		require.Contains(t, buf.String(), "mode: count\n")
+		require.Contains(t, buf.String(), "(main):3.3,3.10 2 0\n")
+
+		buf.Reset()
+		err = cov.WriteHTML(&buf, map[string][]byte{"(main)": []byte(script)})
+		require.NoError(t, err)
+		require.Contains(t, buf.String(), `<tr class="nocov"><td class="num">3</td>`)
+		require.Contains(t, buf.String(), "&#34;big&#34;")
+
+		cov.Reset()
+		for _, l := range cov.Lines() {
+			require.Equal(t, uint64(0), l.Count)
+		}
+		require.Equal(t, 0.0, cov.Percent())
+	})
+}
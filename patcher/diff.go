@@ -0,0 +1,553 @@
+package patcher
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+)
+
+// DiffKind is the kind of an instruction difference.
+type DiffKind int
+
+// List of instruction difference kinds.
+const (
+	// DiffEqual is an instruction found in both functions.
+	DiffEqual DiffKind = iota
+	// DiffInsert is an instruction found only in the new function.
+	DiffInsert
+	// DiffRemove is an instruction found only in the old function.
+	DiffRemove
+)
+
+// InstDiff is an aligned instruction of two versions of a function.
+type InstDiff struct {
+	Kind   DiffKind
+	Opcode ugo.Opcode
+	// OldPos and NewPos are the positions of the instruction in the old and new
+	// functions, or -1 if the instruction does not exist in the function.
+	OldPos, NewPos int
+	// OldOperands and NewOperands are the operands of the instruction in the
+	// old and new functions, or nil if the instruction does not exist.
+	OldOperands, NewOperands []int
+	// JumpChanged reports whether the new jump target of a jump or try
+	// instruction is not the new position of its old target.
+	JumpChanged bool
+	// OldSource and NewSource are the source positions of the instruction in
+	// the source maps. HasOldSource and HasNewSource report whether the source
+	// maps have the instruction.
+	OldSource, NewSource       parser.Pos
+	HasOldSource, HasNewSource bool
+}
+
+// Relocated reports whether an equal instruction is moved.
+func (d *InstDiff) Relocated() bool {
+	return d.Kind == DiffEqual && d.OldPos != d.NewPos
+}
+
+// SourceChanged reports whether the source position of an equal instruction
+// is changed.
+func (d *InstDiff) SourceChanged() bool {
+	return d.Kind == DiffEqual &&
+		(d.HasOldSource != d.HasNewSource || d.OldSource != d.NewSource)
+}
+
+// FuncDiff holds the aligned instructions of two versions of a function.
+type FuncDiff struct {
+	// Name is the name of the function, see FuncName.
+	Name string
+	// Index is the constant index of the function, -1 for main function.
+	Index int
+	Insts []InstDiff
+}
+
+// FuncDiffStats are the numbers of differences of a function.
+type FuncDiffStats struct {
+	Inserted, Removed, Relocated, JumpChanged, SourceChanged int
+}
+
+// Stats returns the numbers of differences.
+func (fd *FuncDiff) Stats() FuncDiffStats {
+	var st FuncDiffStats
+	for i := range fd.Insts {
+		d := &fd.Insts[i]
+		switch d.Kind {
+		case DiffInsert:
+			st.Inserted++
+		case DiffRemove:
+			st.Removed++
+		default:
+			if d.Relocated() {
+				st.Relocated++
+			}
+			if d.JumpChanged {
+				st.JumpChanged++
+			}
+			if d.SourceChanged() {
+				st.SourceChanged++
+			}
+		}
+	}
+	return st
+}
+
+// BytecodeDiff holds the differences of the functions of two ugo.Bytecode.
+type BytecodeDiff struct {
+	fileSet *parser.SourceFileSet
+	Funcs   []FuncDiff
+}
+
+// Diff aligns the instructions of the functions of given ugo.Bytecode values.
+// Main functions are compared with each other, and compiled functions are
+// compared if they are at the same constant index. Instructions are aligned
+// by the longest common subsequence of opcodes and operands, operands of jump
+// and try instructions are excluded from the comparison. Source positions are
+// resolved with the FileSet of after.
+func Diff(before, after *ugo.Bytecode) (*BytecodeDiff, error) {
+	if before.Main == nil || after.Main == nil {
+		return nil, fmt.Errorf("diff: no main function")
+	}
+	bd := &BytecodeDiff{fileSet: after.FileSet}
+	fd, err := diffFunc(before.Main, after.Main)
+	if err != nil {
+		return nil, err
+	}
+	fd.Name, _ = FuncName(after.FileSet, after.Main, -1)
+	fd.Index = -1
+	bd.Funcs = append(bd.Funcs, *fd)
+
+	n := len(before.Constants)
+	if len(after.Constants) > n {
+		n = len(after.Constants)
+	}
+	for i := 0; i < n; i++ {
+		var oldFn, newFn *ugo.CompiledFunction
+		if i < len(before.Constants) {
+			oldFn, _ = before.Constants[i].(*ugo.CompiledFunction)
+		}
+		if i < len(after.Constants) {
+			newFn, _ = after.Constants[i].(*ugo.CompiledFunction)
+		}
+		if oldFn == nil && newFn == nil {
+			continue
+		}
+		fd, err := diffFunc(oldFn, newFn)
+		if err != nil {
+			return nil, err
+		}
+		if newFn != nil {
+			fd.Name, _ = FuncName(after.FileSet, newFn, i)
+		} else {
+			fd.Name, _ = FuncName(before.FileSet, oldFn, i)
+		}
+		fd.Index = i
+		bd.Funcs = append(bd.Funcs, *fd)
+	}
+	return bd, nil
+}
+
+// diffInst is a decoded instruction.
+type diffInst struct {
+	pos      int
+	opcode   ugo.Opcode
+	operands []int
+}
+
+func decodeInsts(fn *ugo.CompiledFunction) ([]diffInst, error) {
+	if fn == nil {
+		return nil, nil
+	}
+	var insts []diffInst
+	it := NewIterator(fn.Instructions)
+	for it.Next() {
+		insts = append(insts, diffInst{
+			pos:      it.Pos(),
+			opcode:   it.Opcode(),
+			operands: append([]int(nil), it.Operands()...),
+		})
+	}
+	return insts, it.Error()
+}
+
+func isJumpOp(opcode ugo.Opcode) bool {
+	switch opcode {
+	case ugo.OpJump, ugo.OpJumpFalsy, ugo.OpAndJump, ugo.OpOrJump,
+		ugo.OpSetupTry:
+		return true
+	}
+	return false
+}
+
+func (a *diffInst) equal(b *diffInst) bool {
+	if a.opcode != b.opcode {
+		return false
+	}
+	if isJumpOp(a.opcode) {
+		return true
+	}
+	for i := range a.operands {
+		if a.operands[i] != b.operands[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func diffFunc(oldFn, newFn *ugo.CompiledFunction) (*FuncDiff, error) {
+	oldInsts, err := decodeInsts(oldFn)
+	if err != nil {
+		return nil, err
+	}
+	newInsts, err := decodeInsts(newFn)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &FuncDiff{Insts: alignInsts(oldInsts, newInsts)}
+
+	// map old positions to new positions to check jump targets
+	posMap := make(map[int]int)
+	for _, d := range fd.Insts {
+		if d.Kind == DiffEqual {
+			posMap[d.OldPos] = d.NewPos
+		}
+	}
+	for i := range fd.Insts {
+		d := &fd.Insts[i]
+		if oldFn != nil && d.OldPos >= 0 {
+			var v int
+			v, d.HasOldSource = oldFn.SourceMap[d.OldPos]
+			d.OldSource = parser.Pos(v)
+		}
+		if newFn != nil && d.NewPos >= 0 {
+			var v int
+			v, d.HasNewSource = newFn.SourceMap[d.NewPos]
+			d.NewSource = parser.Pos(v)
+		}
+		if d.Kind != DiffEqual || !isJumpOp(d.Opcode) {
+			continue
+		}
+		for j, target := range d.OldOperands {
+			if d.Opcode == ugo.OpSetupTry && target == 0 {
+				if d.NewOperands[j] != 0 {
+					d.JumpChanged = true
+				}
+				continue
+			}
+			if newTarget, ok := posMap[target]; !ok || newTarget != d.NewOperands[j] {
+				d.JumpChanged = true
+			}
+		}
+	}
+	return fd, nil
+}
+
+// alignInsts aligns the instructions by the shortest edit script found by the
+// linear space variant of Myers' O(ND) difference algorithm.
+func alignInsts(a, b []diffInst) []InstDiff {
+	al := &aligner{a: a, b: b, out: make([]InstDiff, 0, len(b))}
+	al.align(0, len(a), 0, len(b))
+	slideGroups(al.out)
+	return al.out
+}
+
+// slideGroups moves the groups of inserted or removed instructions down while
+// the instruction after a group is equal to its first one, like diff tools
+// do. Shortest edit scripts are ambiguous if an inserted sequence ends with a
+// copy of the instruction before it, e.g. calls inserted after a call, and
+// the original instruction is aligned with its first copy after sliding.
+func slideGroups(out []InstDiff) {
+	for k := 0; k < len(out); k++ {
+		kind := out[k].Kind
+		if kind == DiffEqual {
+			continue
+		}
+		e := k
+		for e < len(out) && out[e].Kind == kind {
+			e++
+		}
+		for e < len(out) && out[e].Kind == DiffEqual && slidable(&out[k], &out[e]) {
+			first, eq := out[k], out[e]
+			out[k] = eq
+			if kind == DiffInsert {
+				out[k].NewPos, out[k].NewOperands = first.NewPos, first.NewOperands
+				out[e] = InstDiff{Kind: DiffInsert, Opcode: eq.Opcode, OldPos: -1,
+					NewPos: eq.NewPos, NewOperands: eq.NewOperands}
+			} else {
+				out[k].OldPos, out[k].OldOperands = first.OldPos, first.OldOperands
+				out[e] = InstDiff{Kind: DiffRemove, Opcode: eq.Opcode,
+					OldPos: eq.OldPos, NewPos: -1, OldOperands: eq.OldOperands}
+			}
+			k++
+			for e < len(out) && out[e].Kind == kind {
+				e++
+			}
+		}
+		k = e - 1
+	}
+}
+
+// slidable reports whether the first instruction of an inserted or removed
+// group can be aligned with the original instruction of the equal one.
+func slidable(first, eq *InstDiff) bool {
+	if first.Kind == DiffInsert {
+		a := diffInst{opcode: eq.Opcode, operands: eq.OldOperands}
+		return a.equal(&diffInst{opcode: first.Opcode, operands: first.NewOperands})
+	}
+	b := diffInst{opcode: eq.Opcode, operands: eq.NewOperands}
+	return b.equal(&diffInst{opcode: first.Opcode, operands: first.OldOperands})
+}
+
+type aligner struct {
+	a, b []diffInst
+	out  []InstDiff
+}
+
+func (al *aligner) equal(i, j int) {
+	al.out = append(al.out, InstDiff{
+		Kind:        DiffEqual,
+		Opcode:      al.a[i].opcode,
+		OldPos:      al.a[i].pos,
+		NewPos:      al.b[j].pos,
+		OldOperands: al.a[i].operands,
+		NewOperands: al.b[j].operands,
+	})
+}
+
+func (al *aligner) insert(j int) {
+	al.out = append(al.out, InstDiff{
+		Kind:        DiffInsert,
+		Opcode:      al.b[j].opcode,
+		OldPos:      -1,
+		NewPos:      al.b[j].pos,
+		NewOperands: al.b[j].operands,
+	})
+}
+
+func (al *aligner) remove(i int) {
+	al.out = append(al.out, InstDiff{
+		Kind:        DiffRemove,
+		Opcode:      al.a[i].opcode,
+		OldPos:      al.a[i].pos,
+		NewPos:      -1,
+		OldOperands: al.a[i].operands,
+	})
+}
+
+// align appends the alignment of a[a0:a1] and b[b0:b1] after skipping their
+// common prefix and suffix. The rest is split at a point of a shortest edit
+// path found by bisect and each part is aligned recursively.
+func (al *aligner) align(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && al.a[a0].equal(&al.b[b0]) {
+		al.equal(a0, b0)
+		a0++
+		b0++
+	}
+	var suffix int
+	for a1 > a0 && b1 > b0 && al.a[a1-1].equal(&al.b[b1-1]) {
+		a1--
+		b1--
+		suffix++
+	}
+
+	x, y := -1, -1
+	if a0 < a1 && b0 < b1 {
+		x, y = al.bisect(a0, a1, b0, b1)
+	}
+	if x < 0 || x == a0 && y == b0 || x == a1 && y == b1 {
+		for j := b0; j < b1; j++ {
+			al.insert(j)
+		}
+		for i := a0; i < a1; i++ {
+			al.remove(i)
+		}
+	} else {
+		al.align(a0, x, b0, y)
+		al.align(x, a1, y, b1)
+	}
+
+	for k := 0; k < suffix; k++ {
+		al.equal(a1+k, b1+k)
+	}
+}
+
+// bisect returns the point where the forward and the reverse searches of a
+// shortest edit path of a[a0:a1] and b[b0:b1] meet, or -1 if there is no
+// common instruction. Memory usage is linear in the number of instructions.
+func (al *aligner) bisect(a0, a1, b0, b1 int) (int, int) {
+	n, m := a1-a0, b1-b0
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	// vf[offset+k] and vb[offset+k] are the furthest x reached on diagonal k
+	// by the forward and the reverse searches, x of the reverse search is
+	// counted from the end.
+	vf := make([]int, 2*maxD+2)
+	vb := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[offset+1], vb[offset+1] = 0, 0
+	delta := n - m
+	// if delta is odd, paths meet in the forward search, otherwise in the
+	// reverse search
+	front := delta%2 != 0
+	// number of diagonals trimmed from the start and the end of the ranges
+	// after reaching the edges
+	var kfStart, kfEnd, kbStart, kbEnd int
+	for d := 0; d < maxD; d++ {
+		for k := -d + kfStart; k <= d-kfEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || k != d && vf[i-1] < vf[i+1] {
+				x = vf[i+1]
+			} else {
+				x = vf[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && al.a[a0+x].equal(&al.b[b0+y]) {
+				x++
+				y++
+			}
+			vf[i] = x
+			switch {
+			case x > n:
+				kfEnd += 2
+			case y > m:
+				kfStart += 2
+			case front:
+				if j := offset + delta - k; j >= 0 && j < len(vb) && vb[j] != -1 {
+					if x >= n-vb[j] {
+						return a0 + x, b0 + y
+					}
+				}
+			}
+		}
+		for k := -d + kbStart; k <= d-kbEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || k != d && vb[i-1] < vb[i+1] {
+				x = vb[i+1]
+			} else {
+				x = vb[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && al.a[a1-x-1].equal(&al.b[b1-y-1]) {
+				x++
+				y++
+			}
+			vb[i] = x
+			switch {
+			case x > n:
+				kbEnd += 2
+			case y > m:
+				kbStart += 2
+			case !front:
+				if j := offset + delta - k; j >= 0 && j < len(vf) && vf[j] != -1 {
+					xf := vf[j]
+					yf := offset + xf - j
+					if xf >= n-x {
+						return a0 + xf, b0 + yf
+					}
+				}
+			}
+		}
+	}
+	return -1, -1
+}
+
+// WriteText writes the differences in a human readable form. Each function is
+// written with its statistics and the instructions. Instructions are prefixed
+// with "+" if inserted, "-" if removed, ">" if relocated and " " if unchanged.
+// Jump targets and source positions are annotated if they are changed. If
+// changesOnly is true, unchanged instructions and functions are skipped.
+func (bd *BytecodeDiff) WriteText(w io.Writer, changesOnly bool) error {
+	bw := bufio.NewWriter(w)
+	for i := range bd.Funcs {
+		fd := &bd.Funcs[i]
+		st := fd.Stats()
+		if changesOnly && st == (FuncDiffStats{}) {
+			continue
+		}
+		name := fd.Name
+		if fd.Index >= 0 {
+			name = fmt.Sprintf("%s (constant %d)", name, fd.Index)
+		}
+		_, _ = fmt.Fprintf(bw,
+			"%s: %d inserted, %d removed, %d relocated, %d jumps changed, "+
+				"%d source positions changed\n",
+			name, st.Inserted, st.Removed, st.Relocated, st.JumpChanged,
+			st.SourceChanged)
+		for j := range fd.Insts {
+			d := &fd.Insts[j]
+			if changesOnly && d.Kind == DiffEqual && !d.Relocated() &&
+				!d.JumpChanged && !d.SourceChanged() {
+				continue
+			}
+			_, _ = bw.WriteString(bd.formatInst(d))
+			_ = bw.WriteByte('\n')
+		}
+		_ = bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func (bd *BytecodeDiff) formatInst(d *InstDiff) string {
+	mark := " "
+	switch {
+	case d.Kind == DiffInsert:
+		mark = "+"
+	case d.Kind == DiffRemove:
+		mark = "-"
+	case d.Relocated():
+		mark = ">"
+	}
+	pos := func(p int) string {
+		if p < 0 {
+			return "----"
+		}
+		return fmt.Sprintf("%04d", p)
+	}
+	operands := d.NewOperands
+	if d.Kind == DiffRemove {
+		operands = d.OldOperands
+	}
+	ops := make([]string, 0, len(operands))
+	for _, v := range operands {
+		ops = append(ops, strconv.Itoa(v))
+	}
+	line := fmt.Sprintf("%s %s %s  %-12s %s", mark, pos(d.OldPos),
+		pos(d.NewPos), ugo.OpcodeNames[d.Opcode], strings.Join(ops, " "))
+
+	var notes []string
+	if d.JumpChanged {
+		old := make([]string, 0, len(d.OldOperands))
+		for _, v := range d.OldOperands {
+			old = append(old, strconv.Itoa(v))
+		}
+		notes = append(notes, fmt.Sprintf("jump changed from %s",
+			strings.Join(old, " ")))
+	}
+	if d.SourceChanged() {
+		notes = append(notes, fmt.Sprintf("source %s -> %s",
+			bd.source(d.OldSource, d.HasOldSource),
+			bd.source(d.NewSource, d.HasNewSource)))
+	}
+	if len(notes) > 0 {
+		line = fmt.Sprintf("%-40s ; %s", line, strings.Join(notes, "; "))
+	}
+	return strings.TrimRight(line, " ")
+}
+
+func (bd *BytecodeDiff) source(pos parser.Pos, ok bool) string {
+	if !ok {
+		return "none"
+	}
+	if bd.fileSet == nil || !pos.IsValid() {
+		return strconv.Itoa(int(pos))
+	}
+	return bd.fileSet.Position(pos).String()
+}
@@ -0,0 +1,169 @@
+package patcher_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestDiff(t *testing.T) {
+	script := `f := func(x) {
+	return x * 2
+}
+for i := 0; i < 3; i++ {
+	f(i)
+}
+return f("a")`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		before := copyBytecode(bc)
+		_, err := patcher.PatchForGosched(bc, 10)
+		require.NoError(t, err)
+
+		d, err := patcher.Diff(before, bc)
+		require.NoError(t, err)
+		require.Len(t, d.Funcs, 2)
+		require.Equal(t, "main", d.Funcs[0].Name)
+		require.Equal(t, -1, d.Funcs[0].Index)
+		require.Equal(t, patcher.FuncDiffStats{Inserted: 6, Relocated: 22},
+			d.Funcs[0].Stats())
+		require.Equal(t, 1, d.Funcs[1].Index)
+		require.Equal(t, patcher.FuncDiffStats{Inserted: 3, Relocated: 4},
+			d.Funcs[1].Stats())
+
+		first := d.Funcs[0].Insts[0]
+		require.Equal(t, patcher.DiffInsert, first.Kind)
+		require.Equal(t, OpConstant, first.Opcode)
+		require.Equal(t, -1, first.OldPos)
+		require.Equal(t, 0, first.NewPos)
+		require.False(t, first.HasNewSource)
+
+		var buf bytes.Buffer
+		require.NoError(t, d.WriteText(&buf, true))
+		out := buf.String()
+		require.True(t, strings.HasPrefix(out,
+			"main: 6 inserted, 0 removed, 22 relocated, 0 jumps changed, "+
+				"0 source positions changed\n"+
+				"+ ---- 0000  CONSTANT     6\n"), out)
+		require.Contains(t, out, "> 0039 0053  JUMP         17\n")
+	})
+
+	// jump targets change when instructions are inserted at jump targets
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		before := copyBytecode(bc)
+		_, err := patcher.PatchForCoverage(bc)
+		require.NoError(t, err)
+
+		d, err := patcher.Diff(before, bc)
+		require.NoError(t, err)
+		stats := d.Funcs[0].Stats()
+		require.Greater(t, stats.Inserted, 0)
+		require.Greater(t, stats.JumpChanged, 0)
+		require.Zero(t, stats.Removed)
+
+		var buf bytes.Buffer
+		require.NoError(t, d.WriteText(&buf, true))
+		require.Contains(t, buf.String(), "; jump changed from ")
+	})
+
+	// removed instructions
+	expectCompile(t, `a := 1; return a`, CompilerOptions{}, func(bc *Bytecode) {
+		before := copyBytecode(bc)
+		err := patcher.New(bc, func(it *patcher.Iterator) (patcher.Op, []byte) {
+			if it.Opcode() == OpReturn {
+				return patcher.Remove, nil
+			}
+			return patcher.Next, nil
+		}).Patch()
+		require.NoError(t, err)
+
+		d, err := patcher.Diff(before, bc)
+		require.NoError(t, err)
+		require.Equal(t, patcher.FuncDiffStats{Removed: 1}, d.Funcs[0].Stats())
+		last := d.Funcs[0].Insts[len(d.Funcs[0].Insts)-1]
+		require.Equal(t, patcher.DiffRemove, last.Kind)
+		require.Equal(t, -1, last.NewPos)
+
+		var buf bytes.Buffer
+		require.NoError(t, d.WriteText(&buf, true))
+		require.Equal(t, "main: 0 inserted, 1 removed, 0 relocated, "+
+			"0 jumps changed, 0 source positions changed\n"+
+			"- 0007 ----  RETURN       1\n\n", buf.String())
+
+		// unchanged instructions are written with a space mark
+		buf.Reset()
+		require.NoError(t, d.WriteText(&buf, false))
+		require.Contains(t, buf.String(), "  0005 0005  GETLOCAL     0\n")
+	})
+
+	// inserted calls after a call are aligned after it
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		before := copyBytecode(bc)
+		err := patcher.New(bc, func(it *patcher.Iterator) (patcher.Op, []byte) {
+			switch {
+			case it.FuncIndex() >= 0:
+			case it.Pos() == 0:
+				return patcher.InsertBefore,
+					concatInsts(makeInst(OpConstant, 0), makeInst(OpPop))
+			case it.Opcode() == OpReturn:
+				return patcher.InsertBefore, concatInsts(makeInst(OpConstant, 0),
+					makeInst(OpGetLocal, 0), makeInst(OpCall, 1, 0), makeInst(OpPop))
+			}
+			return patcher.Next, nil
+		}).Patch()
+		require.NoError(t, err)
+
+		d, err := patcher.Diff(before, bc)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, d.WriteText(&buf, true))
+		require.Contains(t, buf.String(), "> 0049 0053  CALL         1 0\n"+
+			"+ ---- 0056  CONSTANT     0\n")
+	})
+
+	_, err := patcher.Diff(&Bytecode{Main: &CompiledFunction{}},
+		&Bytecode{Main: &CompiledFunction{Instructions: []byte{255}}})
+	require.Error(t, err)
+}
+
+func TestDiffLargeFunction(t *testing.T) {
+	// a table of the lengths of all instruction pairs would take gigabytes
+	var sb strings.Builder
+	sb.WriteString("a := 0\n")
+	for i := 0; i < 2000; i++ {
+		sb.WriteString("a += 1\n")
+	}
+	sb.WriteString("return a")
+
+	expectCompile(t, sb.String(), CompilerOptions{}, func(bc *Bytecode) {
+		before := copyBytecode(bc)
+		require.NoError(t, patcher.PatchForTrace(bc, func(patcher.TraceEvent) error {
+			return nil
+		}))
+
+		d, err := patcher.Diff(before, bc)
+		require.NoError(t, err)
+		stats := d.Funcs[0].Stats()
+		require.Equal(t, len(d.Funcs[0].Insts)-stats.Inserted, countInsts(t, before.Main))
+		require.Equal(t, len(d.Funcs[0].Insts), countInsts(t, bc.Main))
+		require.Equal(t, 0, stats.Removed)
+		require.Equal(t, 0, stats.JumpChanged)
+	})
+}
+
+func countInsts(t *testing.T, fn *CompiledFunction) int {
+	t.Helper()
+	var n int
+	it := patcher.NewIterator(fn.Instructions)
+	for it.Next() {
+		n++
+	}
+	require.NoError(t, it.Error())
+	return n
+}
@@ -0,0 +1,236 @@
+package patcher
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+	"github.com/ozanh/ugo/token"
+)
+
+// DisasmOptions are the options of Disassemble.
+type DisasmOptions struct {
+	// Sources are the source files keyed by file names like in
+	// Coverage.WriteHTML. Each source line is printed before its first
+	// instruction if its file is found.
+	Sources map[string][]byte
+	// Original is the ugo.Bytecode compiled from the same source without
+	// patches. If it is set, instructions are aligned with the original ones
+	// like Diff does to find the inserted instructions. Otherwise, the
+	// instructions without a source position are assumed to be inserted, as
+	// the compiler maps every instruction it emits. Note that Prepend moves
+	// the source position of the instruction to the first inserted one, so
+	// the instruction is marked instead of the first inserted one without the
+	// original.
+	Original *ugo.Bytecode
+}
+
+// Disassemble writes the instructions of the main function and the compiled
+// functions of given ugo.Bytecode to w in a human readable form. Operands are
+// decoded, jump targets are shown as labels, and constants, builtins and
+// operators are resolved in comments. Instructions inserted by patches are
+// marked with "+", see DisasmOptions.
+func Disassemble(w io.Writer, bc *ugo.Bytecode, opts DisasmOptions) error {
+	d := &disassembler{
+		bw:       bufio.NewWriter(w),
+		bc:       bc,
+		original: opts.Original,
+		sources:  make(map[string][]string, len(opts.Sources)),
+	}
+	for name, src := range opts.Sources {
+		d.sources[name] = strings.Split(string(src), "\n")
+	}
+	if bc.Main != nil {
+		if err := d.function(bc.Main, -1); err != nil {
+			return err
+		}
+	}
+	for i, c := range bc.Constants {
+		if fn, ok := c.(*ugo.CompiledFunction); ok {
+			if err := d.function(fn, i); err != nil {
+				return err
+			}
+		}
+	}
+	return d.bw.Flush()
+}
+
+type disassembler struct {
+	bw       *bufio.Writer
+	bc       *ugo.Bytecode
+	original *ugo.Bytecode
+	sources  map[string][]string
+}
+
+// inserted returns the positions of the instructions of the function at given
+// constant index inserted by patches.
+func (d *disassembler) inserted(fn *ugo.CompiledFunction, index int) (map[int]struct{}, error) {
+	out := make(map[int]struct{})
+	if d.original == nil {
+		it := NewIterator(fn.Instructions)
+		for it.Next() {
+			if _, ok := fn.SourceMap[it.Pos()]; !ok {
+				out[it.Pos()] = struct{}{}
+			}
+		}
+		return out, it.Error()
+	}
+
+	var orig *ugo.CompiledFunction
+	if index < 0 {
+		orig = d.original.Main
+	} else if index < len(d.original.Constants) {
+		orig, _ = d.original.Constants[index].(*ugo.CompiledFunction)
+	}
+	fd, err := diffFunc(orig, fn)
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range fd.Insts {
+		if inst.Kind == DiffInsert {
+			out[inst.NewPos] = struct{}{}
+		}
+	}
+	return out, nil
+}
+
+func (d *disassembler) function(fn *ugo.CompiledFunction, index int) error {
+	name, _ := FuncName(d.bc.FileSet, fn, index)
+	if index >= 0 {
+		name = fmt.Sprintf("%s (constant %d)", name, index)
+	}
+	_, _ = fmt.Fprintf(d.bw, "%s: Params:%d Variadic:%t Locals:%d\n",
+		name, fn.NumParams, fn.Variadic, fn.NumLocals)
+
+	labels := make(map[int]struct{})
+	it := NewIterator(fn.Instructions)
+	for it.Next() {
+		switch it.Opcode() {
+		case ugo.OpJump, ugo.OpJumpFalsy, ugo.OpAndJump, ugo.OpOrJump:
+			labels[it.Operands()[0]] = struct{}{}
+		case ugo.OpSetupTry:
+			for _, target := range it.Operands() {
+				if target != 0 {
+					labels[target] = struct{}{}
+				}
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	added, err := d.inserted(fn, index)
+	if err != nil {
+		return err
+	}
+
+	var lastFile string
+	var lastLine int
+	it.Reset(fn.Instructions)
+	for it.Next() {
+		pos := it.Pos()
+		if _, ok := labels[pos]; ok {
+			_, _ = fmt.Fprintf(d.bw, "L%04d:\n", pos)
+		}
+		srcPos, ok := fn.SourceMap[pos]
+		if ok && parser.Pos(srcPos).IsValid() && d.bc.FileSet != nil {
+			p := d.bc.FileSet.Position(parser.Pos(srcPos))
+			if p.Filename != lastFile || p.Line != lastLine {
+				lastFile, lastLine = p.Filename, p.Line
+				d.sourceLine(p.Filename, p.Line)
+			}
+		}
+		mark := " "
+		if _, ok := added[pos]; ok {
+			mark = "+"
+		}
+		line := fmt.Sprintf("  %04d %s %-12s %s", pos, mark,
+			ugo.OpcodeNames[it.Opcode()], formatOperands(it))
+		if comment := d.comment(it); comment != "" {
+			line = fmt.Sprintf("%-40s ; %s", line, comment)
+		}
+		_, _ = d.bw.WriteString(strings.TrimRight(line, " "))
+		_ = d.bw.WriteByte('\n')
+	}
+	_ = d.bw.WriteByte('\n')
+	return it.Error()
+}
+
+func (d *disassembler) sourceLine(file string, line int) {
+	lines := d.sources[file]
+	if line < 1 || line > len(lines) {
+		_, _ = fmt.Fprintf(d.bw, "%s:%d\n", file, line)
+		return
+	}
+	_, _ = fmt.Fprintf(d.bw, "%s:%d  %s\n",
+		file, line, strings.TrimSpace(lines[line-1]))
+}
+
+// formatOperands returns the operands of the current instruction of it, jump
+// targets are formatted as labels.
+func formatOperands(it *Iterator) string {
+	operands := it.Operands()
+	switch it.Opcode() {
+	case ugo.OpJump, ugo.OpJumpFalsy, ugo.OpAndJump, ugo.OpOrJump:
+		return fmt.Sprintf("L%04d", operands[0])
+	case ugo.OpSetupTry:
+		targets := make([]string, 0, 2)
+		for _, target := range operands {
+			if target == 0 {
+				targets = append(targets, "-")
+			} else {
+				targets = append(targets, fmt.Sprintf("L%04d", target))
+			}
+		}
+		return strings.Join(targets, " ")
+	}
+	out := make([]string, 0, len(operands))
+	for _, v := range operands {
+		out = append(out, strconv.Itoa(v))
+	}
+	return strings.Join(out, " ")
+}
+
+func (d *disassembler) comment(it *Iterator) string {
+	operands := it.Operands()
+	switch it.Opcode() {
+	case ugo.OpConstant, ugo.OpGetGlobal, ugo.OpSetGlobal, ugo.OpLoadModule,
+		ugo.OpClosure:
+		return d.constant(operands[0])
+	case ugo.OpGetBuiltin:
+		if operands[0] < len(ugo.BuiltinObjects) && ugo.BuiltinObjects[operands[0]] != nil {
+			return ugo.BuiltinObjects[operands[0]].String()
+		}
+	case ugo.OpBinaryOp, ugo.OpUnary:
+		return token.Token(operands[0]).String()
+	}
+	return ""
+}
+
+// maxConstLen is the maximum length of the constants shown in comments.
+const maxConstLen = 40
+
+func (d *disassembler) constant(index int) string {
+	if index >= len(d.bc.Constants) {
+		return "<out of range>"
+	}
+	var s string
+	switch v := d.bc.Constants[index].(type) {
+	case *ugo.CompiledFunction:
+		s, _ = FuncName(d.bc.FileSet, v, index)
+	case ugo.String:
+		s = strconv.Quote(string(v))
+	case nil:
+		s = "<nil>"
+	default:
+		s = v.String()
+	}
+	if r := []rune(s); len(r) > maxConstLen {
+		s = string(r[:maxConstLen-3]) + "..."
+	}
+	return s
+}
@@ -0,0 +1,130 @@
+package patcher_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestDisassemble(t *testing.T) {
+	script := `f := func(x) {
+	return x * 2
+}
+for i := 0; i < 3; i++ {
+	f(i)
+}
+return f("a")`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		_, err := patcher.PatchForGosched(bc, 10)
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		err = patcher.Disassemble(&buf, bc, patcher.DisasmOptions{
+			Sources: map[string][]byte{"(main)": []byte(script)},
+		})
+		require.NoError(t, err)
+		require.Equal(t, trimLines(`
+main: Params:0 Variadic:false Locals:2
+  0000 + CONSTANT     6                  ; <gosched>
+  0003 + CALL         0 0
+  0006 + POP
+(main):1  f := func(x) {
+  0007   CONSTANT     1                  ; func@(main):2:2
+  0010   DEFINELOCAL  0
+(main):4  for i := 0; i < 3; i++ {
+  0012   CONSTANT     2                  ; 0
+  0015   DEFINELOCAL  1
+L0017:
+  0017   GETLOCAL     1
+  0019   CONSTANT     3                  ; 3
+  0022   BINARYOP     39                 ; <
+  0024   JUMPFALSY    L0058
+(main):5  f(i)
+  0029   GETLOCAL     0
+  0031   GETLOCAL     1
+  0033   CALL         1 0
+  0036   POP
+(main):4  for i := 0; i < 3; i++ {
+  0037   GETLOCAL     1
+  0039   CONSTANT     4                  ; 1
+  0042   BINARYOP     12                 ; +
+  0044   SETLOCAL     1
+  0046 + CONSTANT     6                  ; <gosched>
+  0049 + CALL         0 0
+  0052 + POP
+  0053   JUMP         L0017
+L0058:
+(main):7  return f("a")
+  0058   GETLOCAL     0
+  0060   CONSTANT     5                  ; "a"
+  0063   CALL         1 0
+  0066   RETURN       1
+  0068   RETURN       0
+
+func@(main):2:2 (constant 1): Params:1 Variadic:false Locals:1
+  0000 + CONSTANT     6                  ; <gosched>
+  0003 + CALL         0 0
+  0006 + POP
+(main):2  return x * 2
+  0007   GETLOCAL     0
+  0009   CONSTANT     0                  ; 2
+  0012   BINARYOP     14                 ; *
+  0014   RETURN       1
+`), trimLines(buf.String()))
+
+		// without sources only positions are shown
+		buf.Reset()
+		require.NoError(t, patcher.Disassemble(&buf, bc, patcher.DisasmOptions{}))
+		require.Contains(t, buf.String(), "(main):7\n  0058   GETLOCAL     0\n")
+	})
+
+	// try statement targets are labeled
+	expectCompile(t, `x := "a"; try { throw len(x) } catch e {} finally {}`, CompilerOptions{},
+		func(bc *Bytecode) {
+			var buf bytes.Buffer
+			require.NoError(t, patcher.Disassemble(&buf, bc, patcher.DisasmOptions{}))
+			require.Regexp(t, `SETUPTRY +L\d{4} L\d{4}\n`, buf.String())
+			require.Regexp(t, `GETBUILTIN +\d+ +; <builtinFunction:len>`, buf.String())
+		})
+}
+
+func TestDisassembleOriginal(t *testing.T) {
+	script := "a := 1\nreturn a"
+	orig, err := Compile([]byte(script), CompilerOptions{})
+	require.NoError(t, err)
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		_, err := patcher.PatchForInstructionLimit(bc, 100)
+		require.NoError(t, err)
+
+		// prepended instructions are found by aligning with the original
+		var buf bytes.Buffer
+		require.NoError(t, patcher.Disassemble(&buf, bc,
+			patcher.DisasmOptions{Original: orig}))
+		require.Equal(t, trimLines(`
+main: Params:0 Variadic:false Locals:1
+(main):1
+  0000 + CONSTANT     1                  ; <instructionMeter>
+  0003 + CONSTANT     2                  ; 4
+  0006 + CALL         1 0
+  0009 + POP
+  0010   CONSTANT     0                  ; 1
+  0013   DEFINELOCAL  0
+(main):2
+  0015   GETLOCAL     0
+  0017   RETURN       1
+`), trimLines(buf.String()))
+
+		// source position of the instruction is moved to the first prepended
+		// one which is not marked without the original
+		buf.Reset()
+		require.NoError(t, patcher.Disassemble(&buf, bc, patcher.DisasmOptions{}))
+		require.Contains(t, buf.String(), "  0000   CONSTANT     1")
+		require.Contains(t, buf.String(), "  0010 + CONSTANT     0")
+	})
+}
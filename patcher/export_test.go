@@ -1,14 +1,34 @@
 package patcher
 
+import (
+	"time"
+
+	"github.com/ozanh/ugo"
+)
+
 // Exported for testing purposes only.
 
-type NumCallsGetter interface {
-	NumCalls() uint64
+func SetGoschedClock(g Gosched, now func() time.Time) {
+	g.(*goschedFunc).now = now
+}
+
+func NewGoschedRun() ugo.Object {
+	return &goschedRun{}
 }
 
-func (g *goschedFunc) NumCalls() uint64 {
-	g.mu.Lock()
-	defer g.mu.Unlock()
+func SetProfileClock(p *Profile, now func() time.Time) {
+	p.now = now
+}
+
+func ProfileDepth(p *Profile) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stack.Len()
+}
 
-	return g.numCalls
+func SetCacheBuild(build string) (restore func()) {
+	prev := cacheBuild
+	cacheBuild = build
+	return func() { cacheBuild = prev }
 }
@@ -0,0 +1,605 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ozanh/ugo"
+)
+
+// PatchForGosched modifies given ugo.Bytecode to add a callable to the given
+// ugo.Bytecode that tries to park the VM goroutine when the number of calls to
+// the callable reaches the given threshold. This patch should be used in single
+// threaded application e.g. WebAssembly. If error is returned, given
+// ugo.Bytecode must be discarded due to invalid patching.
+func PatchForGosched(bc *ugo.Bytecode, callThreshold uint32) (int, error) {
+	if callThreshold == 0 {
+		panic("callThreshold must be greater than 0")
+	}
+	_, numInserts, err := patchForGosched(bc,
+		GoschedOptions{CallThreshold: callThreshold})
+	return numInserts, err
+}
+
+// PatchForGoschedContext is like PatchForGosched but the added callable also
+// checks whether given context is done on each call. Once the context is done,
+// every call to the callable throws an error wrapping ctx.Err(), so that the
+// error cannot be swallowed by the script's error handlers. Unlike aborting the
+// VM from another goroutine, this lets single threaded applications cancel
+// scripts running tight loops promptly.
+func PatchForGoschedContext(
+	ctx context.Context,
+	bc *ugo.Bytecode,
+	callThreshold uint32,
+) (int, error) {
+	if ctx == nil {
+		panic("nil context")
+	}
+	if callThreshold == 0 {
+		panic("callThreshold must be greater than 0")
+	}
+	_, numInserts, err := patchForGosched(bc,
+		GoschedOptions{Context: ctx, CallThreshold: callThreshold})
+	return numInserts, err
+}
+
+// GoschedOptions configures the callable added by PatchForGoschedOptions.
+type GoschedOptions struct {
+	// Context is checked on each call if not nil. Once it is done, every call
+	// throws an error wrapping its error like in PatchForGoschedContext.
+	Context context.Context
+	// CallThreshold is the number of calls between yields if Quantum is zero.
+	// Otherwise, it is the number of calls between reading the clock to
+	// reduce the overhead of the time slice mode, zero reads the clock on each
+	// call.
+	CallThreshold uint32
+	// Quantum enables the time slice mode if it is greater than zero, the
+	// callable yields when the given wall-clock time has elapsed since the
+	// last yield.
+	Quantum time.Duration
+	// Park is called to yield the VM goroutine. If it is nil,
+	// runtime.Gosched is called and the goroutine sleeps for a nanosecond if
+	// there is a single CPU or GOMAXPROCS is 1, which lets the event loop of
+	// WebAssembly hosts run.
+	Park func()
+	// Placement selects where the calls to the callable are inserted.
+	Placement GoschedPlacement
+	// PerRun keeps the counters of each run in the module cache of its VM
+	// instead of sharing the counters between the VMs, so that Gosched.Run
+	// returns the statistics of a run while other VMs run the same bytecode.
+	// It reserves a module of the bytecode and inserts two more instructions
+	// with each call to the callable.
+	PerRun bool
+}
+
+// GoschedPlacement is the strategy to place the calls to the callable added by
+// the gosched patches. Every strategy guarantees that the callable is called
+// in every loop iteration and on every function call which may recurse, but
+// the number of calls differs, so does the meaning of CallThreshold.
+type GoschedPlacement byte
+
+// List of placements.
+const (
+	// GoschedBackJumps inserts calls at the start of every function and before
+	// every backward jump. It is the default placement.
+	GoschedBackJumps GoschedPlacement = iota
+	// GoschedLoops inserts calls at the headers of loops and at the start of
+	// the blocks having calls, so leaf functions having no loops or calls are
+	// not instrumented, and the runs of functions returning without a call,
+	// like the base cases of recursive functions, do not call the callable.
+	// The call in a loop header is omitted if every iteration of the loop goes
+	// through the header of an instrumented inner loop, and the call in a
+	// block having calls is omitted if the block is dominated by another
+	// instrumented block, so loop nests and call paths are instrumented once
+	// where it is safe.
+	GoschedLoops
+)
+
+func (p GoschedPlacement) String() string {
+	switch p {
+	case GoschedBackJumps:
+		return "backjumps"
+	case GoschedLoops:
+		return "loops"
+	}
+	return fmt.Sprintf("GoschedPlacement(%d)", p)
+}
+
+// GoschedStats is the statistics of the callable added by the gosched patches.
+type GoschedStats struct {
+	// Calls is the number of calls.
+	Calls uint64
+	// Yields is the number of times the VM goroutine is parked.
+	Yields uint64
+	// Parked is the total time spent while parking.
+	Parked time.Duration
+	// MaxSlice is the maximum time between the first call or the end of a
+	// yield and the start of the next yield.
+	MaxSlice time.Duration
+}
+
+// Gosched is implemented by the callables added to ugo.Bytecode by the
+// gosched patches. It can be found in the last constant after
+// PatchForGosched and PatchForGoschedContext. The same patched ugo.Bytecode
+// can be run by many VMs concurrently, the counters are shared by the VMs and
+// updated atomically unless GoschedOptions.PerRun is set, which keeps the
+// counters of a run in its VM.
+type Gosched interface {
+	ugo.Object
+	// Stats returns the statistics of the calls from all runs so far. With
+	// GoschedOptions.PerRun, the calls of a run are added to them at yields
+	// and when the run returns. Calls after the last yield of a failed run
+	// are added when its VM starts the next run, or when Run returns.
+	Stats() GoschedStats
+	// Run runs given VM like ugo.VM.Run and returns the statistics of the
+	// calls in this run, which are also added to the ones returned by Stats.
+	// Without GoschedOptions.PerRun, the returned statistics are the
+	// difference of Stats after and before the run, so they include the calls
+	// of concurrent runs, and MaxSlice is the one of Stats.
+	Run(vm *ugo.VM, globals ugo.Object, args ...ugo.Object) (
+		ugo.Object, GoschedStats, error)
+}
+
+// PatchForGoschedOptions modifies given ugo.Bytecode like PatchForGosched but
+// the callable is configured with given options and returned to get its
+// statistics. Either CallThreshold or Quantum must be greater than zero. If
+// error is returned, given ugo.Bytecode must be discarded due to invalid
+// patching.
+func PatchForGoschedOptions(bc *ugo.Bytecode, opts GoschedOptions) (Gosched, error) {
+	g, _, err := patchForGosched(bc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func patchForGosched(bc *ugo.Bytecode, opts GoschedOptions) (*goschedFunc, int, error) {
+	pass, g := GoschedPass(opts)
+	report, err := NewPipeline(pass).Run(bc)
+	if err != nil {
+		return nil, 0, err
+	}
+	return g.(*goschedFunc), report.Passes[0].Inserts, nil
+}
+
+// GoschedPass returns a Pass for Pipeline patching like PatchForGoschedOptions
+// and the callable to get its statistics.
+func GoschedPass(opts GoschedOptions) (Pass, Gosched) {
+	// Generate following instructions to insert before backward jumps and
+	// function start points, or loop headers for GoschedLoops placement.
+	/*
+		0000 CONSTANT <index>
+		0000 CALL 0 0
+		0000 POP
+	*/
+	// With PerRun option, the counters of the run are created at the start
+	// of the main function and added to the statistics before its returns,
+	// and they are passed to the callable, see runState.
+	/*
+		0000 CONSTANT <index>
+		0000 LOADMODULE <start index> <module>
+		0000 POP
+		0000 CALL 1 0
+		0000 POP
+	*/
+
+	if opts.CallThreshold == 0 && opts.Quantum <= 0 {
+		panic("either callThreshold or quantum must be greater than 0")
+	}
+
+	fn := newGoschedFunc(opts)
+	var insert []byte
+	var curFn *ugo.CompiledFunction
+	var sites map[int]Op
+	return Pass{
+		Name: "gosched",
+		Key:  goschedKey(opts),
+		Start: func(pc *PassContext) (err error) {
+			if !opts.PerRun {
+				insert, err = makeCallInsts(pc.AddConstant(fn))
+				return
+			}
+			rs, err := pc.addRunState(&goschedRunSite{g: fn},
+				&goschedRunSite{g: fn, end: true})
+			if err != nil {
+				return err
+			}
+			insert, err = rs.callInsts(pc.AddConstant(fn))
+			return err
+		},
+		Visit: func(it *Iterator) (Op, []byte, error) {
+			if opts.Placement == GoschedLoops {
+				if curFn != it.Func() {
+					curFn = it.Func()
+					var err error
+					if sites, err = loopSites(curFn); err != nil {
+						return Next, nil, err
+					}
+				}
+				if op, ok := sites[it.Pos()]; ok {
+					return op, insert, nil
+				}
+				return Next, nil, nil
+			}
+
+			pos := it.Pos()
+			if pos == 0 {
+				// insert at the top of function
+				return InsertBefore, insert, nil
+			}
+			opcode := it.Opcode()
+			if opcode == ugo.OpJump {
+				// if jump backward, insert instructions before jump
+				if it.Operands()[0] < pos {
+					return InsertBefore, insert, nil
+				}
+			}
+			return Next, nil, nil
+		},
+		Attach: func(_ *ugo.Bytecode, consts []ugo.Object) error {
+			if !opts.PerRun {
+				return attachConstants(consts, fn)
+			}
+			return attachConstants(consts, &goschedRunSite{g: fn},
+				&goschedRunSite{g: fn, end: true}, fn)
+		},
+	}, fn
+}
+
+func goschedKey(opts GoschedOptions) string {
+	if opts.PerRun {
+		return opts.Placement.String() + ",perrun"
+	}
+	return opts.Placement.String()
+}
+
+// loopSites returns the positions and the operations to insert calls for
+// GoschedLoops placement in given function.
+func loopSites(fn *ugo.CompiledFunction) (map[int]Op, error) {
+	g, err := BuildCFG(fn)
+	if err != nil {
+		return nil, err
+	}
+	sites := make(map[int]Op)
+	addSite := func(b int) {
+		// calls in block starts must be run by the jumps to the block
+		start := g.Blocks[b].Start
+		sites[start] = blockStartOp(ugo.Opcode(fn.Instructions[start]))
+	}
+
+	// visit inner loops first, which have less blocks than the outer ones
+	loops := append([]*Loop(nil), g.Loops...)
+	sort.SliceStable(loops, func(i, j int) bool {
+		return len(loops[i].Blocks) < len(loops[j].Blocks)
+	})
+	var checked []int
+	for _, loop := range loops {
+		if !innerChecked(g, loop, checked) {
+			addSite(loop.Header)
+			checked = append(checked, loop.Header)
+		}
+	}
+
+	// A run of the function must call the callable before its first call,
+	// which is the case if a block having calls is dominated by an
+	// instrumented block. Blocks are visited in the order of their positions
+	// where dominators usually precede the blocks they dominate. Blocks
+	// unreachable in the CFG are instrumented as they may be reached by the
+	// jumps resolved at runtime.
+	for _, b := range callBlocks(g) {
+		dominated := false
+		for start := range sites {
+			if d := blockAt(g, start); d != b.Index && g.Dominates(d, b.Index) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			addSite(b.Index)
+		}
+	}
+	return sites, nil
+}
+
+// callBlocks returns the blocks of given CFG having calls in the order of
+// their positions.
+func callBlocks(g *CFG) []*Block {
+	var blocks []*Block
+	for _, b := range g.Blocks {
+		it := NewIterator(g.Func.Instructions[b.Start:b.End])
+		for it.Next() {
+			if op := it.Opcode(); op == ugo.OpCall || op == ugo.OpCallName {
+				blocks = append(blocks, b)
+				break
+			}
+		}
+	}
+	return blocks
+}
+
+// blockAt returns the index of the block starting at given position.
+func blockAt(g *CFG, start int) int {
+	return sort.Search(len(g.Blocks), func(i int) bool {
+		return g.Blocks[i].Start >= start
+	})
+}
+
+// innerChecked reports whether one of the checked headers in the loop
+// dominates all its latches, so every iteration of the loop goes through it.
+func innerChecked(g *CFG, loop *Loop, checked []int) bool {
+	for _, h := range checked {
+		i := sort.SearchInts(loop.Blocks, h)
+		if h == loop.Header || i == len(loop.Blocks) || loop.Blocks[i] != h {
+			continue
+		}
+		dominates := true
+		for _, latch := range loop.Latches {
+			if !g.Dominates(h, latch) {
+				dominates = false
+				break
+			}
+		}
+		if dominates {
+			return true
+		}
+	}
+	return false
+}
+
+type goschedFunc struct {
+	ugo.ObjectImpl
+	ctx           context.Context
+	callThreshold uint32
+	quantum       time.Duration
+	park          func()
+	now           func() time.Time
+	perRun        bool
+	pending       sync.Map // *ugo.VM -> *goschedRun, during Run
+	calls         atomic.Uint64
+	yields        atomic.Uint64
+	parked        atomic.Int64
+	maxSlice      atomic.Int64
+	// sliceStart is the start of the time slice of the shared counters.
+	sliceStart atomic.Pointer[time.Time]
+}
+
+// goschedRun holds the counters of a run, which is kept in the module cache of
+// the VM and only used by the goroutine running the VM.
+type goschedRun struct {
+	ugo.ObjectImpl
+	counter    uint32
+	sliceStart time.Time
+	stats      GoschedStats
+	// flushed is the part of stats added to the totals of goschedFunc.
+	flushed GoschedStats
+}
+
+func (r *goschedRun) String() string   { return "<goschedRun>" }
+func (r *goschedRun) TypeName() string { return r.String() }
+
+var _ Gosched = (*goschedFunc)(nil)
+var _ ugo.ExCallerObject = (*goschedFunc)(nil)
+
+func newGoschedFunc(opts GoschedOptions) *goschedFunc {
+	park := opts.Park
+	if park == nil {
+		park = defaultPark(runtime.NumCPU() == 1 || runtime.GOMAXPROCS(0) == 1)
+	}
+	return &goschedFunc{
+		ctx:           opts.Context,
+		callThreshold: opts.CallThreshold,
+		quantum:       opts.Quantum,
+		park:          park,
+		now:           time.Now,
+		perRun:        opts.PerRun,
+	}
+}
+
+func defaultPark(sleep bool) func() {
+	return func() {
+		runtime.Gosched()
+
+		if sleep {
+			//lint:ignore SA1004 // Park the current goroutine.
+			time.Sleep(1) // I couldn't find another way to park the goroutine.
+		}
+	}
+}
+
+func (g *goschedFunc) String() string   { return "<gosched>" }
+func (g *goschedFunc) TypeName() string { return g.String() }
+func (g *goschedFunc) CanCall() bool    { return true }
+
+func (g *goschedFunc) Call(args ...ugo.Object) (ugo.Object, error) {
+	return g.CallEx(ugo.NewCall(nil, args))
+}
+
+func (g *goschedFunc) CallEx(c ugo.Call) (ugo.Object, error) {
+	if c.Len() > 0 {
+		if r, ok := c.Get(0).(*goschedRun); ok {
+			return g.call(r)
+		}
+	}
+	return g.callShared()
+}
+
+// callShared counts the call with the counters shared by the VMs, which are
+// used without PerRun option, or if a VM has not run the main function.
+func (g *goschedFunc) callShared() (ugo.Object, error) {
+	calls := g.calls.Add(1)
+	if err := g.canceled(); err != nil {
+		return ugo.Undefined, err
+	}
+	if calls == 1 {
+		now := g.now()
+		g.sliceStart.Store(&now)
+	}
+
+	if g.callThreshold > 0 && calls%uint64(g.callThreshold) != 0 {
+		return ugo.Undefined, nil
+	}
+
+	start := g.now()
+	var slice time.Duration
+	if sliceStart := g.sliceStart.Load(); sliceStart != nil {
+		slice = start.Sub(*sliceStart)
+	}
+	if slice < g.quantum {
+		return ugo.Undefined, nil
+	}
+	storeMax(&g.maxSlice, int64(slice))
+
+	g.park()
+
+	end := g.now()
+	g.sliceStart.Store(&end)
+	g.yields.Add(1)
+	g.parked.Add(int64(end.Sub(start)))
+	return ugo.Undefined, nil
+}
+
+func (g *goschedFunc) canceled() error {
+	if g.ctx != nil {
+		select {
+		case <-g.ctx.Done():
+			return fmt.Errorf("script canceled: %w", g.ctx.Err())
+		default:
+		}
+	}
+	return nil
+}
+
+func (g *goschedFunc) call(r *goschedRun) (ugo.Object, error) {
+	r.stats.Calls++
+	if err := g.canceled(); err != nil {
+		return ugo.Undefined, err
+	}
+	if r.stats.Calls == 1 {
+		r.sliceStart = g.now()
+	}
+
+	if g.callThreshold > 0 {
+		r.counter++
+		if r.counter < g.callThreshold {
+			return ugo.Undefined, nil
+		}
+		r.counter = 0
+	}
+
+	start := g.now()
+	slice := start.Sub(r.sliceStart)
+	if slice < g.quantum {
+		return ugo.Undefined, nil
+	}
+	if slice > r.stats.MaxSlice {
+		r.stats.MaxSlice = slice
+	}
+
+	g.park()
+
+	r.sliceStart = g.now()
+	r.stats.Yields++
+	r.stats.Parked += r.sliceStart.Sub(start)
+	g.flush(r)
+	return ugo.Undefined, nil
+}
+
+// flush adds the statistics of given run which are not added yet to the
+// totals.
+func (g *goschedFunc) flush(r *goschedRun) {
+	g.calls.Add(r.stats.Calls - r.flushed.Calls)
+	g.yields.Add(r.stats.Yields - r.flushed.Yields)
+	g.parked.Add(int64(r.stats.Parked - r.flushed.Parked))
+	storeMax(&g.maxSlice, int64(r.stats.MaxSlice))
+	r.flushed = r.stats
+}
+
+// storeMax stores given value in v if it is greater than the value of v.
+func storeMax(v *atomic.Int64, value int64) {
+	for {
+		max := v.Load()
+		if value <= max || v.CompareAndSwap(max, value) {
+			return
+		}
+	}
+}
+
+func (g *goschedFunc) Stats() GoschedStats {
+	return GoschedStats{
+		Calls:    g.calls.Load(),
+		Yields:   g.yields.Load(),
+		Parked:   time.Duration(g.parked.Load()),
+		MaxSlice: time.Duration(g.maxSlice.Load()),
+	}
+}
+
+func (g *goschedFunc) Run(
+	vm *ugo.VM,
+	globals ugo.Object,
+	args ...ugo.Object,
+) (ugo.Object, GoschedStats, error) {
+	if !g.perRun {
+		before := g.Stats()
+		ret, err := vm.Run(globals, args...)
+		stats := g.Stats()
+		stats.Calls -= before.Calls
+		stats.Yields -= before.Yields
+		stats.Parked -= before.Parked
+		return ret, stats, err
+	}
+
+	r := &goschedRun{}
+	g.pending.Store(vm, r)
+	defer g.pending.Delete(vm)
+
+	ret, err := vm.Run(globals, args...)
+	g.flush(r)
+	return ret, r.stats, err
+}
+
+// goschedRunSite is the callable added to ugo.Bytecode to start the runs of
+// VMs with new counters, and to add the counters to the statistics when the
+// runs end.
+type goschedRunSite struct {
+	ugo.ObjectImpl
+	g   *goschedFunc
+	end bool
+}
+
+var _ runStarter = (*goschedRunSite)(nil)
+
+func (s *goschedRunSite) String() string {
+	if s.end {
+		return "<goschedEnd>"
+	}
+	return "<goschedStart>"
+}
+
+func (s *goschedRunSite) TypeName() string { return s.String() }
+func (s *goschedRunSite) CanCall() bool    { return true }
+func (s *goschedRunSite) runStarter()      {}
+
+func (s *goschedRunSite) Call(args ...ugo.Object) (ugo.Object, error) {
+	return s.CallEx(ugo.NewCall(nil, args))
+}
+
+func (s *goschedRunSite) CallEx(c ugo.Call) (ugo.Object, error) {
+	if c.Len() > 0 {
+		// on start, the previous run has unadded calls if it failed
+		if r, ok := c.Get(0).(*goschedRun); ok {
+			s.g.flush(r)
+		}
+	}
+	if s.end {
+		return ugo.Undefined, nil
+	}
+	if v, ok := s.g.pending.Load(c.VM()); ok {
+		return v.(*goschedRun), nil
+	}
+	return &goschedRun{}, nil
+}
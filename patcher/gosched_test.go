@@ -0,0 +1,454 @@
+package patcher_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPatchForGoschedOptions(t *testing.T) {
+	script := `for i := 0; i < 100; i++ {}`
+
+	// clock advances a millisecond on each read
+	newClock := func() func() time.Time {
+		var now time.Time
+		return func() time.Time {
+			now = now.Add(time.Millisecond)
+			return now
+		}
+	}
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var parks uint64
+		g, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+			Quantum: 5 * time.Millisecond,
+			Park:    func() { parks++ },
+		})
+		require.NoError(t, err)
+		require.Same(t, g, bc.Constants[len(bc.Constants)-1])
+		patcher.SetGoschedClock(g, newClock())
+
+		_, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, patcher.GoschedStats{
+			Calls:    101,
+			Yields:   20,
+			Parked:   20 * time.Millisecond,
+			MaxSlice: 5 * time.Millisecond,
+		}, g.Stats())
+		require.Equal(t, uint64(20), parks)
+	})
+
+	// clock is read on every 10th call
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var parks uint64
+		g, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+			CallThreshold: 10,
+			Quantum:       2 * time.Millisecond,
+			Park:          func() { parks++ },
+		})
+		require.NoError(t, err)
+		patcher.SetGoschedClock(g, newClock())
+
+		_, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		stats := g.Stats()
+		require.Equal(t, uint64(101), stats.Calls)
+		require.Equal(t, uint64(5), stats.Yields)
+		require.Equal(t, stats.Yields, parks)
+		require.Equal(t, 5*time.Millisecond, stats.Parked)
+		require.Equal(t, 2*time.Millisecond, stats.MaxSlice)
+	})
+
+	// fixed call threshold
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var parks uint64
+		g, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+			CallThreshold: 10,
+			Park:          func() { parks++ },
+		})
+		require.NoError(t, err)
+
+		_, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		stats := g.Stats()
+		require.Equal(t, uint64(101), stats.Calls)
+		require.Equal(t, uint64(10), stats.Yields)
+		require.Equal(t, stats.Yields, parks)
+	})
+
+	require.Panics(t, func() {
+		_, _ = patcher.PatchForGoschedOptions(&Bytecode{}, patcher.GoschedOptions{})
+	})
+}
+
+func TestGoschedPlacement(t *testing.T) {
+	run := func(t *testing.T, script string, placement patcher.GoschedPlacement) (
+		Object, int, patcher.GoschedStats) {
+		t.Helper()
+		var ret Object
+		var inserts int
+		var stats patcher.GoschedStats
+		expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+			pass, g := patcher.GoschedPass(patcher.GoschedOptions{
+				CallThreshold: 1 << 30,
+				Placement:     placement,
+			})
+			report, err := patcher.NewPipeline(pass).Run(bc)
+			require.NoError(t, err)
+			inserts = report.Passes[0].Inserts
+			ret, err = NewVM(bc).Run(nil)
+			require.NoError(t, err)
+			stats = g.Stats()
+		})
+		return ret, inserts, stats
+	}
+	expect := func(t *testing.T, script string, expected Object,
+		backJumps, loops [2]int) {
+		t.Helper()
+		ret, inserts, stats := run(t, script, patcher.GoschedBackJumps)
+		require.Equal(t, expected, ret)
+		require.Equal(t, backJumps, [2]int{inserts, int(stats.Calls)}, "backjumps")
+		ret, inserts, stats = run(t, script, patcher.GoschedLoops)
+		require.Equal(t, expected, ret)
+		require.Equal(t, loops, [2]int{inserts, int(stats.Calls)}, "loops")
+	}
+
+	// leaf functions are skipped
+	expect(t, `f := func(a) { return a + 1 }; return f(1)`, Int(2),
+		[2]int{2, 2}, [2]int{1, 1})
+	expect(t, `return 1`, Int(1), [2]int{1, 1}, [2]int{0, 0})
+
+	// inner loop header is run in every iteration of the outer loop
+	expect(t, `
+	x := 0
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ { x++ }
+	}
+	return x`, Int(12), [2]int{3, 16}, [2]int{1, 15})
+
+	// inner loop is conditional
+	expect(t, `
+	x := 0
+	for i := 0; i < 3; i++ {
+		if i > 1 {
+			for j := 0; j < 4; j++ { x++ }
+		}
+	}
+	return x`, Int(4), [2]int{3, 8}, [2]int{2, 9})
+
+	// recursive functions are instrumented before their calls, so the base
+	// cases do not call the callable
+	expect(t, `
+	var fib
+	fib = func(n) {
+		if n < 2 { return n }
+		return fib(n-1) + fib(n-2)
+	}
+	return fib(10)`, Int(55), [2]int{2, 178}, [2]int{2, 89})
+
+	// calls in a branch are instrumented in the branch
+	expect(t, `
+	f := func(a) { return a + 1 }
+	g := func(x) {
+		if x { return f(1) + f(2) }
+		return 0
+	}
+	return g(true) + g(false)`, Int(5), [2]int{3, 5}, [2]int{2, 2})
+
+	// calls dominated by an instrumented loop header are not instrumented
+	expect(t, `
+	add := func(a, b) { return a + b }
+	x := 0
+	for i := 0; i < 3; i++ { x = add(x, i) }
+	return x`, Int(3), [2]int{3, 7}, [2]int{1, 4})
+
+	// infinite loops are canceled
+	for _, script := range []string{
+		`for {}`,
+		`for { for j := 0; j < 2; j++ {} }`,
+		`for { try { continue } finally {} }`,
+		`var f; f = func() { f() }; f()`,
+	} {
+		expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var parks int
+			_, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+				Context:       ctx,
+				CallThreshold: 10,
+				Placement:     patcher.GoschedLoops,
+				Park: func() {
+					if parks++; parks == 10 {
+						cancel()
+					}
+				},
+			})
+			require.NoError(t, err)
+			_, err = NewVM(bc).Run(nil)
+			if !errors.Is(err, context.Canceled) {
+				// unbounded recursion may exhaust the stack first
+				require.ErrorIs(t, err, ErrStackOverflow, script)
+				require.NotZero(t, parks, script)
+			}
+		})
+	}
+
+	require.Equal(t, "loops", patcher.GoschedLoops.String())
+}
+
+func TestGoschedConcurrentVMs(t *testing.T) {
+	script := `param fail
+for i := 0; i < 1000; i++ {}
+if fail { throw "fail" }`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		g, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+			CallThreshold: 100,
+			Park:          func() {},
+			PerRun:        true,
+		})
+		require.NoError(t, err)
+
+		const numVMs = 8
+		runs := make([][]patcher.GoschedStats, numVMs)
+		var wg sync.WaitGroup
+		for i := range runs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				vm := NewVM(bc)
+				for j := 0; j < 3; j++ {
+					_, stats, err := g.Run(vm, nil)
+					require.NoError(t, err)
+					runs[i] = append(runs[i], stats)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// counters are not kept across the runs of a VM
+		for _, stats := range runs {
+			require.Len(t, stats, 3)
+			for _, s := range stats {
+				require.Equal(t, uint64(1001), s.Calls)
+				require.Equal(t, uint64(10), s.Yields)
+			}
+		}
+		total := g.Stats()
+		require.Equal(t, uint64(numVMs*3*1001), total.Calls)
+		require.Equal(t, uint64(numVMs*30), total.Yields)
+
+		// failed runs are counted by Run
+		vm := NewVM(bc)
+		_, stats, err := g.Run(vm, nil, True)
+		require.Error(t, err)
+		require.Equal(t, uint64(1001), stats.Calls)
+		require.Equal(t, total.Calls+1001, g.Stats().Calls)
+
+		// calls after the last yield of a failed run are counted on the next
+		// run of the VM
+		_, err = vm.Run(nil, True)
+		require.Error(t, err)
+		require.Equal(t, total.Calls+1001+1000, g.Stats().Calls)
+		_, err = vm.Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, total.Calls+3*1001, g.Stats().Calls)
+	})
+}
+
+func TestGoschedSharedCounters(t *testing.T) {
+	script := `for i := 0; i < 1000; i++ {}`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var parks atomic.Uint64
+		g, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+			CallThreshold: 100,
+			Park:          func() { parks.Add(1) },
+		})
+		require.NoError(t, err)
+
+		const numVMs = 8
+		var wg sync.WaitGroup
+		for i := 0; i < numVMs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				vm := NewVM(bc)
+				for j := 0; j < 3; j++ {
+					_, err := vm.Run(nil)
+					require.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// counters are shared, so the yields are counted from all calls
+		stats := g.Stats()
+		require.Equal(t, uint64(numVMs*3*1001), stats.Calls)
+		require.Equal(t, stats.Calls/100, stats.Yields)
+		require.Equal(t, stats.Yields, parks.Load())
+
+		_, runStats, err := g.Run(NewVM(bc), nil)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1001), runStats.Calls)
+		require.Equal(t, stats.Calls+1001, g.Stats().Calls)
+	})
+}
+
+// mutexGosched is the gosched callable taking a lock on every call, which is
+// used as the baseline in benchmarks.
+type mutexGosched struct {
+	ObjectImpl
+	mu            sync.Mutex
+	numCalls      uint64
+	counter       uint32
+	callThreshold uint32
+}
+
+func (g *mutexGosched) CanCall() bool { return true }
+
+func (g *mutexGosched) Call(args ...Object) (Object, error) {
+	return g.CallEx(Call{})
+}
+
+func (g *mutexGosched) CallEx(_ Call) (Object, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.numCalls++
+	g.counter++
+	if g.counter == g.callThreshold {
+		g.counter = 0
+	}
+	return Undefined, nil
+}
+
+func BenchmarkGosched(b *testing.B) {
+	modes := []string{"mutex", "shared", "perrun"}
+	newCallee := func(b *testing.B, mode string) (*Bytecode, ExCallerObject) {
+		bc, err := Compile([]byte(`return`), CompilerOptions{})
+		require.NoError(b, err)
+		if mode == "mutex" {
+			return bc, &mutexGosched{callThreshold: 1 << 30}
+		}
+		g, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+			CallThreshold: 1 << 30,
+			PerRun:        mode == "perrun",
+		})
+		require.NoError(b, err)
+		return bc, g.(ExCallerObject)
+	}
+	newCall := func(bc *Bytecode, mode string) Call {
+		if mode == "perrun" {
+			return NewCall(NewVM(bc), []Object{patcher.NewGoschedRun()})
+		}
+		return NewCall(NewVM(bc), nil)
+	}
+
+	for _, mode := range modes {
+		b.Run(mode, func(b *testing.B) {
+			bc, callee := newCallee(b, mode)
+			c := newCall(bc, mode)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = callee.CallEx(c)
+			}
+		})
+		b.Run(mode+"-parallel", func(b *testing.B) {
+			bc, callee := newCallee(b, mode)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c := newCall(bc, mode)
+				for pb.Next() {
+					_, _ = callee.CallEx(c)
+				}
+			})
+		})
+	}
+
+	// run a script calling the callable in a loop
+	script := `for i := 0; i < 1000; i++ {}`
+	for _, mode := range modes {
+		b.Run("script-"+mode, func(b *testing.B) {
+			bc, err := Compile([]byte(script), CompilerOptions{})
+			require.NoError(b, err)
+			_, err = patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+				CallThreshold: 1 << 30,
+				PerRun:        mode == "perrun",
+			})
+			require.NoError(b, err)
+			if mode == "mutex" {
+				bc.Constants[len(bc.Constants)-1] = &mutexGosched{
+					callThreshold: 1 << 30,
+				}
+			}
+			vm := NewVM(bc)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := vm.Run(nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGoschedPlacement(b *testing.B) {
+	scripts := []struct {
+		name   string
+		script string
+	}{
+		{"recursive", `
+		var fib
+		fib = func(n) {
+			if n < 2 { return n }
+			return fib(n-1) + fib(n-2)
+		}
+		return fib(20)`},
+		{"loops", `
+		add := func(a, b) { return a + b }
+		x := 0
+		for i := 0; i < 100; i++ {
+			for j := 0; j < 100; j++ {
+				for k := 0; k < 10; k++ {
+					x = add(x, k)
+				}
+			}
+		}
+		return x`},
+	}
+	for _, s := range scripts {
+		for _, placement := range []int{-1, int(patcher.GoschedBackJumps),
+			int(patcher.GoschedLoops)} {
+			name := s.name + "/none"
+			bc, err := Compile([]byte(s.script), CompilerOptions{})
+			require.NoError(b, err)
+			if placement >= 0 {
+				name = s.name + "/" + patcher.GoschedPlacement(placement).String()
+				_, err = patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+					CallThreshold: 1000,
+					Park:          func() {},
+					Placement:     patcher.GoschedPlacement(placement),
+				})
+				require.NoError(b, err)
+			}
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := NewVM(bc).Run(nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package patcher
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+)
+
+// Hooks creates the callables to be called at function entries, at the first
+// instruction of source lines and before returns. Returning nil from a hook
+// skips the site. Enter is called first for each function, so Line and Exit
+// hooks belong to the function of the last Enter call. Function index is the
+// constant index of the function or -1 for the main function.
+type Hooks struct {
+	Enter func(fn *ugo.CompiledFunction, index int) ugo.Object
+	Line  func(pos parser.Pos, opcode ugo.Opcode) ugo.Object
+	Exit  func() ugo.Object
+	// LineLocals passes the local variables of the function to the callables
+	// created by Line as arguments in the order of local indexes. At most
+	// MaxHookLocals locals are passed.
+	LineLocals bool
+	// Try creates the callables to be called before try statements, whose
+	// results are stored in a local variable added to the function. Unwind
+	// creates the callables to be called at the start of catch and finally
+	// blocks with the result of the last Try callable of the function. They
+	// must be set together, see CallStack.SetUnwindHooks.
+	Try    func() ugo.Object
+	Unwind func() ugo.Object
+}
+
+// MaxHookLocals is the maximum number of local variables passed to the line
+// hooks.
+const MaxHookLocals = 255
+
+// PatchForHooks modifies given ugo.Bytecode to insert calls to the callables
+// created by hooks and appends the callables to the constants. Note that tail
+// call optimization of the VM is disabled if Exit hook is set. If error is
+// returned, given ugo.Bytecode must be discarded due to invalid patching.
+func PatchForHooks(bc *ugo.Bytecode, hooks Hooks) error {
+	// Generate following instructions to insert at function entry points,
+	// source line starts and before returns. Locals are loaded only for line
+	// hooks if requested.
+	/*
+		0000 CONSTANT <site index>
+		0000 GETLOCAL 0
+		....
+		0000 GETLOCAL <n-1>
+		0000 CALL <n> 0
+		0000 POP
+	*/
+
+	constIndex := len(bc.Constants)
+	var sites []ugo.Object
+
+	addSite := func(obj ugo.Object, numLocals int) ([]byte, error) {
+		if obj == nil {
+			return nil, nil
+		}
+		sites = append(sites, obj)
+		return makeLocalsCallInsts(constIndex+len(sites)-1, numLocals)
+	}
+	addTry := func(obj ugo.Object, local int) ([]byte, error) {
+		if obj == nil {
+			return nil, nil
+		}
+		sites = append(sites, obj)
+		return makeInsts([]int{int(ugo.OpConstant), constIndex + len(sites) - 1},
+			[]int{int(ugo.OpCall), 0, 0},
+			[]int{int(ugo.OpDefineLocal), local})
+	}
+	addUnwind := func(obj ugo.Object, local int) ([]byte, error) {
+		if obj == nil {
+			return nil, nil
+		}
+		sites = append(sites, obj)
+		return makeInsts([]int{int(ugo.OpConstant), constIndex + len(sites) - 1},
+			[]int{int(ugo.OpGetLocal), local},
+			[]int{int(ugo.OpCall), 1, 0},
+			[]int{int(ugo.OpPop)})
+	}
+
+	// Try results are stored with the following instructions, and passed to
+	// the unwind hooks with a GETLOCAL instruction.
+	/*
+		0000 CONSTANT <site index>
+		0000 CALL 0 0
+		0000 DEFINELOCAL <try local>
+	*/
+
+	if (hooks.Try == nil) != (hooks.Unwind == nil) {
+		panic("Try and Unwind hooks must be set together")
+	}
+
+	// First pass inserts line and exit hooks which must be executed if jumped
+	// to the instruction. Second pass inserts entry hooks which must be
+	// executed once at the beginning of the function.
+	entries := make(map[*ugo.CompiledFunction][]byte)
+	var curFn *ugo.CompiledFunction
+	var leaders map[int]struct{}
+	var lastLine, numLocals, tryLocal int
+	var err error
+
+	p := New(bc, func(it *Iterator) (Op, []byte) {
+		if err != nil {
+			return Next, nil
+		}
+		if curFn != it.Func() {
+			curFn = it.Func()
+			if hooks.Enter != nil {
+				entries[curFn], err = addSite(hooks.Enter(curFn, it.FuncIndex()), 0)
+				if err != nil {
+					return Next, nil
+				}
+			}
+			var blocks []basicBlock
+			if blocks, err = basicBlocks(curFn.Instructions); err != nil {
+				return Next, nil
+			}
+			leaders = make(map[int]struct{}, len(blocks))
+			for _, b := range blocks {
+				leaders[b.start] = struct{}{}
+			}
+			lastLine = 0
+			// try local is not passed to line hooks
+			numLocals = curFn.NumLocals
+			tryLocal = -1
+		}
+
+		var insts []byte
+		switch it.Opcode() {
+		case ugo.OpSetupCatch, ugo.OpSetupFinally:
+			if hooks.Unwind != nil && tryLocal >= 0 {
+				if insts, err = addUnwind(hooks.Unwind(), tryLocal); err != nil {
+					return Next, nil
+				}
+			}
+		}
+		if _, ok := leaders[it.Pos()]; ok {
+			lastLine = 0
+		}
+		pos := parser.Pos(curFn.SourceMap[it.Pos()])
+		if hooks.Line != nil && pos.IsValid() {
+			if line := sourceLine(bc.FileSet, pos); line != lastLine {
+				lastLine = line
+				n := 0
+				if hooks.LineLocals {
+					n = numLocals
+				}
+				var line []byte
+				line, err = addSite(hooks.Line(pos, it.Opcode()), n)
+				if err != nil {
+					return Next, nil
+				}
+				insts = append(insts, line...)
+			}
+		}
+		if hooks.Try != nil && it.Opcode() == ugo.OpSetupTry {
+			if tryLocal < 0 {
+				if curFn.NumLocals > 255 {
+					err = fmt.Errorf("no local variable left for try hooks: %d",
+						curFn.NumLocals)
+					return Next, nil
+				}
+				tryLocal = curFn.NumLocals
+				curFn.NumLocals++
+			}
+			var try []byte
+			if try, err = addTry(hooks.Try(), tryLocal); err != nil {
+				return Next, nil
+			}
+			insts = append(insts, try...)
+		}
+		if hooks.Exit != nil && it.Opcode() == ugo.OpReturn {
+			var exit []byte
+			exit, err = addSite(hooks.Exit(), 0)
+			if err != nil {
+				return Next, nil
+			}
+			insts = append(insts, exit...)
+		}
+		if len(insts) == 0 {
+			return Next, nil
+		}
+		return blockStartOp(it.Opcode()), insts
+	})
+	if err2 := p.Patch(); err2 != nil {
+		return err2
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		p = New(bc, func(it *Iterator) (Op, []byte) {
+			if insts := entries[it.Func()]; it.Pos() == 0 && len(insts) > 0 {
+				return InsertBefore, insts
+			}
+			return Next, nil
+		})
+		if err := p.Patch(); err != nil {
+			return err
+		}
+	}
+
+	bc.Constants = append(bc.Constants, sites...)
+	return debugVerify(bc)
+}
+
+// CallStack is a shadow call stack of the functions patched by PatchForHooks,
+// whose frames are pushed by Enter hooks and popped by Exit hooks. Thrown
+// errors skip the Exit hooks of the frames they leave, so the stack is cut
+// back to its height before the try statement handling the error by the hooks
+// set by SetUnwindHooks. CallStack is not safe for concurrent use.
+type CallStack[F any] struct {
+	frames []F
+}
+
+// Len returns the number of the frames.
+func (s *CallStack[F]) Len() int {
+	return len(s.frames)
+}
+
+// Push pushes given frame to the top of the stack.
+func (s *CallStack[F]) Push(f F) {
+	s.frames = append(s.frames, f)
+}
+
+// Pop removes the top frame and returns it, ok is false if stack is empty.
+func (s *CallStack[F]) Pop() (f F, ok bool) {
+	n := len(s.frames)
+	if n == 0 {
+		return f, false
+	}
+	f = s.frames[n-1]
+	var zero F
+	s.frames[n-1] = zero
+	s.frames = s.frames[:n-1]
+	return f, true
+}
+
+// Top returns the top frame, ok is false if stack is empty.
+func (s *CallStack[F]) Top() (f F, ok bool) {
+	if n := len(s.frames); n > 0 {
+		return s.frames[n-1], true
+	}
+	return f, false
+}
+
+// Frames returns the frames from the bottom to the top. Returned slice must
+// not be modified and it is valid until the stack is modified.
+func (s *CallStack[F]) Frames() []F {
+	return s.frames
+}
+
+// Cut removes the frames above given height and calls drop with them from the
+// bottom to the top if drop is not nil.
+func (s *CallStack[F]) Cut(height int, drop func(frames []F)) {
+	if height < 0 {
+		height = 0
+	}
+	if height >= len(s.frames) {
+		return
+	}
+	if drop != nil {
+		drop(s.frames[height:])
+	}
+	var zero F
+	for i := height; i < len(s.frames); i++ {
+		s.frames[i] = zero
+	}
+	s.frames = s.frames[:height]
+}
+
+// SetUnwindHooks sets the Try and Unwind hooks of h to cut the stack back to
+// its height before the try statements at the start of their catch and
+// finally blocks. mu is locked while accessing the stack, and drop is called
+// with the removed frames like Cut if it is not nil.
+func (s *CallStack[F]) SetUnwindHooks(h *Hooks, mu sync.Locker, drop func(frames []F)) {
+	if mu == nil {
+		panic("mu must not be nil")
+	}
+	h.Try = func() ugo.Object {
+		return &stackSite[F]{stack: s, mu: mu}
+	}
+	h.Unwind = func() ugo.Object {
+		return &stackSite[F]{stack: s, mu: mu, drop: drop, unwind: true}
+	}
+}
+
+// stackSite is the callable added to ugo.Bytecode by the hooks set by
+// CallStack.SetUnwindHooks, which returns the height of the stack or cuts the
+// stack back to the height passed as argument.
+type stackSite[F any] struct {
+	ugo.ObjectImpl
+	stack  *CallStack[F]
+	mu     sync.Locker
+	drop   func(frames []F)
+	unwind bool
+}
+
+var _ ugo.ExCallerObject = (*stackSite[int])(nil)
+
+func (s *stackSite[F]) String() string   { return "<stackSite>" }
+func (s *stackSite[F]) TypeName() string { return s.String() }
+func (s *stackSite[F]) CanCall() bool    { return true }
+
+func (s *stackSite[F]) Call(args ...ugo.Object) (ugo.Object, error) {
+	return s.CallEx(ugo.NewCall(nil, args))
+}
+
+func (s *stackSite[F]) CallEx(c ugo.Call) (ugo.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.unwind {
+		return ugo.Int(s.stack.Len()), nil
+	}
+	if c.Len() == 1 {
+		if height, ok := c.Get(0).(ugo.Int); ok {
+			s.stack.Cut(int(height), s.drop)
+		}
+	}
+	return ugo.Undefined, nil
+}
+
+// sourceLine returns the line number of given position. If fileSet is nil,
+// position itself is returned to distinguish the positions.
+func sourceLine(fileSet *parser.SourceFileSet, pos parser.Pos) int {
+	if fileSet == nil {
+		return int(pos)
+	}
+	return fileSet.Position(pos).Line
+}
+
+// makeLocalsCallInsts returns the instructions calling the constant at fnIndex
+// with the first numLocals local variables as arguments.
+func makeLocalsCallInsts(fnIndex, numLocals int) ([]byte, error) {
+	if numLocals > MaxHookLocals {
+		numLocals = MaxHookLocals
+	}
+	insts := make([]byte, 0, 3+2*numLocals+3+1)
+	b := make([]byte, 8)
+	b, err := ugo.MakeInstruction(b, ugo.OpConstant, fnIndex)
+	if err != nil {
+		return nil, err
+	}
+	insts = append(insts, b...)
+	for i := 0; i < numLocals; i++ {
+		b, err = ugo.MakeInstruction(b, ugo.OpGetLocal, i)
+		if err != nil {
+			return nil, err
+		}
+		insts = append(insts, b...)
+	}
+	b, err = ugo.MakeInstruction(b, ugo.OpCall, numLocals, 0)
+	if err != nil {
+		return nil, err
+	}
+	insts = append(insts, b...)
+	b, err = ugo.MakeInstruction(b, ugo.OpPop)
+	if err != nil {
+		return nil, err
+	}
+	return append(insts, b...), nil
+}
+
+// FuncName returns a name for the function at given constant index and its
+// first source position. Main function with index -1 is named as "main" and
+// the others are named after their first source position.
+func FuncName(
+	fileSet *parser.SourceFileSet,
+	fn *ugo.CompiledFunction,
+	index int,
+) (string, parser.Pos) {
+	var first parser.Pos
+	for _, pos := range fn.SourceMap {
+		p := parser.Pos(pos)
+		if p.IsValid() && (!first.IsValid() || p < first) {
+			first = p
+		}
+	}
+	if index < 0 {
+		return "main", first
+	}
+	if fileSet != nil && first.IsValid() {
+		return fmt.Sprintf("func@%s", fileSet.Position(first)), first
+	}
+	return fmt.Sprintf("func#%d", index), first
+}
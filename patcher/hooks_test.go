@@ -0,0 +1,174 @@
+package patcher_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugo/parser"
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+type hookFunc struct {
+	ObjectImpl
+	fn func(c Call)
+}
+
+func (h *hookFunc) String() string   { return "<hookFunc>" }
+func (h *hookFunc) TypeName() string { return h.String() }
+func (h *hookFunc) CanCall() bool    { return true }
+
+func (h *hookFunc) Call(args ...Object) (Object, error) {
+	return h.CallEx(NewCall(nil, args))
+}
+
+func (h *hookFunc) CallEx(c Call) (Object, error) {
+	h.fn(c)
+	return Undefined, nil
+}
+
+func TestPatchForHooks(t *testing.T) {
+	script := `f := func(a) {
+	b := a * 2
+	return b
+}
+x := f(1)
+return x`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var events []string
+		var lineLocals [][]Object
+		err := patcher.PatchForHooks(bc, patcher.Hooks{
+			Enter: func(fn *CompiledFunction, index int) Object {
+				name, _ := patcher.FuncName(bc.FileSet, fn, index)
+				return &hookFunc{fn: func(Call) {
+					events = append(events, "enter "+name)
+				}}
+			},
+			Line: func(pos parser.Pos, _ Opcode) Object {
+				line := bc.FileSet.Position(pos).Line
+				if line == 5 {
+					// skip the site
+					return nil
+				}
+				return &hookFunc{fn: func(c Call) {
+					events = append(events, fmt.Sprint("line ", line))
+					locals := make([]Object, c.Len())
+					for i := range locals {
+						locals[i] = c.Get(i)
+					}
+					lineLocals = append(lineLocals, locals)
+				}}
+			},
+			Exit: func() Object {
+				return &hookFunc{fn: func(Call) {
+					events = append(events, "exit")
+				}}
+			},
+			LineLocals: true,
+		})
+		require.NoError(t, err)
+
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(2), ret)
+		require.Equal(t, []string{
+			"enter main",
+			"line 1",
+			"enter func@(main):2:2",
+			"line 2",
+			"line 3",
+			"exit",
+			"line 6",
+			"exit",
+		}, events)
+		require.Equal(t, [][]Object{
+			{Undefined, Undefined},
+			{Int(1), Undefined},
+			{Int(1), Int(2)},
+			{lineLocals[3][0], Int(2)},
+		}, lineLocals)
+	})
+}
+
+func TestCallStack(t *testing.T) {
+	// errors thrown through the frames of a recursive function are caught by
+	// an outer frame of the same function
+	script := `var g
+g = func(k, n) {
+	if n > 0 {
+		if n == 1 {
+			throw "x"
+		}
+		return g(k, n-1)
+	}
+	try {
+		g(k, 4)
+	} catch e {
+	}
+	if k == 0 {
+		return "ok"
+	}
+	return g(k-1, 0)
+}
+return g(10, 0)`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var mu sync.Mutex
+		var stack patcher.CallStack[string]
+		var maxLen, dropped int
+		hooks := patcher.Hooks{
+			Enter: func(fn *CompiledFunction, index int) Object {
+				name, _ := patcher.FuncName(bc.FileSet, fn, index)
+				return &hookFunc{fn: func(Call) {
+					mu.Lock()
+					defer mu.Unlock()
+					stack.Push(name)
+					if stack.Len() > maxLen {
+						maxLen = stack.Len()
+					}
+				}}
+			},
+			Exit: func() Object {
+				return &hookFunc{fn: func(Call) {
+					mu.Lock()
+					defer mu.Unlock()
+					stack.Pop()
+				}}
+			},
+		}
+		stack.SetUnwindHooks(&hooks, &mu, func(frames []string) {
+			dropped += len(frames)
+		})
+		require.NoError(t, patcher.PatchForHooks(bc, hooks))
+
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, String("ok"), ret)
+		require.Equal(t, 0, stack.Len())
+		// main, 11 calls of g(k, 0) and 4 calls of g(0, n)
+		require.Equal(t, 16, maxLen)
+		require.Equal(t, 11*4, dropped)
+	})
+
+	var s patcher.CallStack[int]
+	for i := 1; i <= 3; i++ {
+		s.Push(i)
+	}
+	f, ok := s.Top()
+	require.True(t, ok)
+	require.Equal(t, 3, f)
+	s.Cut(1, func(frames []int) {
+		require.Equal(t, []int{2, 3}, frames)
+	})
+	require.Equal(t, []int{1}, s.Frames())
+	f, ok = s.Pop()
+	require.True(t, ok)
+	require.Equal(t, 1, f)
+	_, ok = s.Pop()
+	require.False(t, ok)
+}
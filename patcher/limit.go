@@ -0,0 +1,169 @@
+package patcher
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ozanh/ugo"
+)
+
+// ErrInstructionLimit is the error matched by InstructionLimitError with
+// errors.Is.
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// InstructionLimitError is the error thrown by the callable added by
+// PatchForInstructionLimit when the instruction budget is exhausted. Errors
+// returned from ugo.VM wrap it, use errors.As to get it.
+type InstructionLimitError struct {
+	Limit uint64
+}
+
+func (e *InstructionLimitError) Error() string {
+	return fmt.Sprintf("%s: %d", ErrInstructionLimit, e.Limit)
+}
+
+// Is reports whether target is ErrInstructionLimit.
+func (e *InstructionLimitError) Is(target error) bool {
+	return target == ErrInstructionLimit
+}
+
+// PatchForInstructionLimit modifies given ugo.Bytecode to add a callable to the
+// given ugo.Bytecode that charges the number of instructions of each basic
+// block when the block is entered. Once the total charge exceeds the limit,
+// every call to the callable throws an *InstructionLimitError, so that the
+// error cannot be swallowed by the script's error handlers. Returned
+// InstructionMeter reports consumed amount after running the ugo.Bytecode. If
+// error is returned, given ugo.Bytecode must be discarded due to invalid
+// patching.
+func PatchForInstructionLimit(bc *ugo.Bytecode, limit uint64) (*InstructionMeter, error) {
+	pass, m := InstructionLimitPass(limit)
+	if _, err := NewPipeline(pass).Run(bc); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// InstructionLimitPass returns a Pass for Pipeline patching like
+// PatchForInstructionLimit and the InstructionMeter to get consumed amount.
+func InstructionLimitPass(limit uint64) (Pass, *InstructionMeter) {
+	// Generate following instructions to insert at the start of basic blocks.
+	/*
+		0000 CONSTANT <meter index>
+		0000 CONSTANT <cost index>
+		0000 CALL 1 0
+		0000 POP
+	*/
+
+	if limit == 0 {
+		panic("limit must be greater than 0")
+	}
+
+	m := &InstructionMeter{limit: limit}
+	var pc *PassContext
+	var meterIndex int
+	costIndexes := make(map[int]int)
+
+	var curFn *ugo.CompiledFunction
+	var costs map[int]int
+
+	return Pass{
+		Name: "instruction-limit",
+		Start: func(c *PassContext) error {
+			pc = c
+			meterIndex = pc.AddConstant(m)
+			return nil
+		},
+		Visit: func(it *Iterator) (Op, []byte, error) {
+			if curFn != it.Func() {
+				curFn = it.Func()
+				blocks, err := basicBlocks(curFn.Instructions)
+				if err != nil {
+					return Next, nil, err
+				}
+				costs = make(map[int]int, len(blocks))
+				for _, b := range blocks {
+					costs[b.start] = b.numInsts
+				}
+			}
+			cost, ok := costs[it.Pos()]
+			if !ok {
+				return Next, nil, nil
+			}
+			costIndex, ok := costIndexes[cost]
+			if !ok {
+				costIndex = pc.AddConstant(ugo.Int(cost))
+				costIndexes[cost] = costIndex
+			}
+			insts, err := makeCallInsts(meterIndex, costIndex)
+			if err != nil {
+				return Next, nil, err
+			}
+			return blockStartOp(it.Opcode()), insts, nil
+		},
+		Attach: func(_ *ugo.Bytecode, consts []ugo.Object) error {
+			return attachConstants(consts, m)
+		},
+	}, m
+}
+
+// InstructionMeter is the callable added to ugo.Bytecode by
+// PatchForInstructionLimit to charge executed instructions.
+type InstructionMeter struct {
+	ugo.ObjectImpl
+	mu    sync.Mutex
+	used  uint64
+	limit uint64
+}
+
+var _ ugo.ExCallerObject = (*InstructionMeter)(nil)
+
+func (m *InstructionMeter) String() string   { return "<instructionMeter>" }
+func (m *InstructionMeter) TypeName() string { return m.String() }
+func (m *InstructionMeter) CanCall() bool    { return true }
+
+func (m *InstructionMeter) Call(args ...ugo.Object) (ugo.Object, error) {
+	return m.CallEx(ugo.NewCall(nil, args))
+}
+
+func (m *InstructionMeter) CallEx(c ugo.Call) (ugo.Object, error) {
+	if err := c.CheckLen(1); err != nil {
+		return ugo.Undefined, err
+	}
+	cost, ok := c.Get(0).(ugo.Int)
+	if !ok || cost < 0 {
+		return ugo.Undefined, ugo.NewArgumentTypeError(
+			"first", "non-negative int", c.Get(0).TypeName())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.used+uint64(cost) > m.limit {
+		m.used = m.limit
+		return ugo.Undefined, &InstructionLimitError{Limit: m.limit}
+	}
+	m.used += uint64(cost)
+	return ugo.Undefined, nil
+}
+
+// Used returns the number of charged instructions. It never exceeds the limit.
+func (m *InstructionMeter) Used() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.used
+}
+
+// Limit returns the instruction limit.
+func (m *InstructionMeter) Limit() uint64 {
+	return m.limit
+}
+
+// Reset sets the consumed amount to zero to run the ugo.Bytecode again.
+func (m *InstructionMeter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.used = 0
+}
@@ -0,0 +1,113 @@
+package patcher_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPatchForInstructionLimit(t *testing.T) {
+	opts := CompilerOptions{}
+
+	runLimit := func(t *testing.T, script string, limit uint64) (
+		*patcher.InstructionMeter, Object, error) {
+		t.Helper()
+		var m *patcher.InstructionMeter
+		var ret Object
+		var err error
+		expectCompile(t, script, opts, func(bc *Bytecode) {
+			m, err = patcher.PatchForInstructionLimit(bc, limit)
+			require.NoError(t, err)
+			ret, err = NewVM(bc).Run(nil)
+		})
+		return m, ret, err
+	}
+
+	// Charged instructions equals to the number of executed instructions of
+	// the original bytecode.
+	m, ret, err := runLimit(t, `return 1`, 100)
+	require.NoError(t, err)
+	require.Equal(t, Int(1), ret)
+	require.Equal(t, uint64(2), m.Used())
+	require.Equal(t, uint64(100), m.Limit())
+
+	script := `
+	sum := 0
+	for i := 0; i < 10; i++ {
+		sum += i
+	}
+	return sum`
+	m, ret, err = runLimit(t, script, 1000)
+	require.NoError(t, err)
+	require.Equal(t, Int(45), ret)
+	used := m.Used()
+	require.Greater(t, used, uint64(10*5))
+
+	_, _, err = runLimit(t, script, used)
+	require.NoError(t, err)
+
+	m, _, err = runLimit(t, script, used-1)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, patcher.ErrInstructionLimit))
+	var limitErr *patcher.InstructionLimitError
+	require.True(t, errors.As(err, &limitErr))
+	require.Equal(t, used-1, limitErr.Limit)
+	require.Equal(t, used-1, m.Used())
+
+	// Error handlers cannot swallow the error.
+	_, _, err = runLimit(t, `
+	f := func() {
+		for {}
+	}
+	for {
+		try {
+			f()
+		} catch err {
+			f()
+		} finally {
+			f()
+		}
+	}`, 1000)
+	require.True(t, errors.Is(err, patcher.ErrInstructionLimit))
+
+	// Jumps to the start of blocks are charged.
+	m, ret, err = runLimit(t, `
+	var fib
+	fib = func(x) {
+		if x <= 1 {
+			return x
+		}
+		return fib(x-1) + fib(x-2)
+	}
+	return fib(10)`, 1e6)
+	require.NoError(t, err)
+	require.Equal(t, Int(55), ret)
+	used = m.Used()
+	m.Reset()
+	require.Equal(t, uint64(0), m.Used())
+	expectCompile(t, `
+	var fib
+	fib = func(x) {
+		if x <= 1 {
+			return x
+		}
+		return fib(x-1) + fib(x-2)
+	}
+	return fib(10)`, opts, func(bc *Bytecode) {
+		m, err := patcher.PatchForInstructionLimit(bc, used)
+		require.NoError(t, err)
+		vm := NewVM(bc)
+		for i := 0; i < 2; i++ {
+			ret, err := vm.Run(nil)
+			require.NoError(t, err)
+			require.Equal(t, Int(55), ret)
+			require.Equal(t, used, m.Used())
+			m.Reset()
+		}
+	})
+}
@@ -0,0 +1,650 @@
+package patcher
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/token"
+)
+
+// ErrMemoryLimit is the error matched by MemoryLimitError with errors.Is.
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+// MemoryLimitError is the error thrown by the callables added by
+// PatchForMemoryLimit when the byte budget is exhausted. Errors returned from
+// ugo.VM wrap it, use errors.As to get it.
+type MemoryLimitError struct {
+	Limit uint64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("%s: %d bytes", ErrMemoryLimit, e.Limit)
+}
+
+// Is reports whether target is ErrMemoryLimit.
+func (e *MemoryLimitError) Is(target error) bool {
+	return target == ErrMemoryLimit
+}
+
+// Approximate sizes charged for allocations.
+const (
+	// memObjectSize is the size of an element of an array.
+	memObjectSize = 16
+	// memMapEntrySize is the size of a key value pair of a map.
+	memMapEntrySize = 64
+	// memSliceSize is the size of a slice header, slicing shares the memory
+	// of the sliced value.
+	memSliceSize = 24
+)
+
+// PatchForMemoryLimit modifies given ugo.Bytecode to add callables to the given
+// ugo.Bytecode that charge the approximate number of bytes allocated by array
+// and map literals, slicing, addition (e.g. string concatenation), new keys of
+// maps set by index and calls to append and repeat builtins. Costs of literals
+// and slicing are computed at patch time and charged before the instruction,
+// the results of additions are charged after the instruction unless both
+// operands are known to be numbers, index assignments are charged before the
+// instruction, and append and repeat are charged before they allocate.
+// Allocations are accumulated, memory released by the garbage collector is not
+// subtracted. Once the total charge exceeds the limit, every call to the
+// callables throws a *MemoryLimitError. Returned MemoryMeter reports consumed
+// amount after running the ugo.Bytecode. Functions using more than 254 local
+// variables may not be patched since additions, index assignments and builtin
+// loads require temporary local variables. If error is returned, given
+// ugo.Bytecode must be discarded due to invalid patching.
+func PatchForMemoryLimit(bc *ugo.Bytecode, limit uint64) (*MemoryMeter, error) {
+	pass, m := MemoryLimitPass(limit)
+	if _, err := NewPipeline(pass).Run(bc); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MemoryLimitPass returns a Pass for Pipeline patching like
+// PatchForMemoryLimit and the MemoryMeter to get consumed amount.
+func MemoryLimitPass(limit uint64) (Pass, *MemoryMeter) {
+	// Generate following instructions to insert before literals and slicing.
+	/*
+		0000 CONSTANT <meter index>
+		0000 CONSTANT <cost index>
+		0000 CALL 1 0
+		0000 POP
+	*/
+	// Generate following instructions to insert after additions, the callable
+	// returns its argument.
+	/*
+		0000 DEFINELOCAL <temp index>
+		0000 CONSTANT <size index>
+		0000 GETLOCAL <temp index>
+		0000 CALL 1 0
+	*/
+	// Generate following instructions to insert before index assignments,
+	// which keep the target and the index on the stack.
+	/*
+		0000 DEFINELOCAL <temp index + 1>
+		0000 DEFINELOCAL <temp index>
+		0000 CONSTANT <set index>
+		0000 GETLOCAL <temp index>
+		0000 GETLOCAL <temp index + 1>
+		0000 CALL 2 0
+		0000 POP
+		0000 GETLOCAL <temp index>
+		0000 GETLOCAL <temp index + 1>
+	*/
+	// Generate following instructions to insert after loads of append and
+	// repeat builtins, the callable returns a wrapper of the loaded builtin,
+	// which may be replaced by another pass.
+	/*
+		0000 DEFINELOCAL <temp index>
+		0000 CONSTANT <wrapper index>
+		0000 GETLOCAL <temp index>
+		0000 CALL 1 0
+	*/
+
+	if limit == 0 {
+		panic("limit must be greater than 0")
+	}
+
+	m := &MemoryMeter{limit: limit}
+	callables := []ugo.Object{
+		m,
+		&memSizeFunc{meter: m},
+		&memSetIndexFunc{meter: m},
+		newMemWrapFunc(m, ugo.BuiltinAppend, appendCost),
+		newMemWrapFunc(m, ugo.BuiltinRepeat, repeatCost),
+	}
+	var pc *PassContext
+	var meterIndex, sizeIndex, setIndex, appendIndex, repeatIndex int
+	costIndexes := make(map[int]int)
+
+	var curFn *ugo.CompiledFunction
+	var temps []int
+	var numericAdds map[int]bool
+
+	chargeInsts := func(cost int) ([]byte, error) {
+		costIndex, ok := costIndexes[cost]
+		if !ok {
+			costIndex = pc.AddConstant(ugo.Int(cost))
+			costIndexes[cost] = costIndex
+		}
+		return makeCallInsts(meterIndex, costIndex)
+	}
+	// tempLocals returns n temporary local variables of the current function
+	// by adding them on demand.
+	tempLocals := func(n int) ([]int, error) {
+		for len(temps) < n {
+			if curFn.NumLocals > 255 {
+				return nil, fmt.Errorf(
+					"no local variable left for memory limit: %d",
+					curFn.NumLocals)
+			}
+			temps = append(temps, curFn.NumLocals)
+			curFn.NumLocals++
+		}
+		return temps[:n], nil
+	}
+	// wrapInsts returns the instructions to replace the value on top of the
+	// stack with the result of calling the callable at given constant index
+	// with it.
+	wrapInsts := func(index int) ([]byte, error) {
+		t, err := tempLocals(1)
+		if err != nil {
+			return nil, err
+		}
+		return makeInsts(
+			[]int{int(ugo.OpDefineLocal), t[0]},
+			[]int{int(ugo.OpConstant), index},
+			[]int{int(ugo.OpGetLocal), t[0]},
+			[]int{int(ugo.OpCall), 1, 0},
+		)
+	}
+
+	return Pass{
+		Name: "memory-limit",
+		Start: func(c *PassContext) error {
+			pc = c
+			meterIndex = pc.AddConstant(callables[0])
+			sizeIndex = pc.AddConstant(callables[1])
+			setIndex = pc.AddConstant(callables[2])
+			appendIndex = pc.AddConstant(callables[3])
+			repeatIndex = pc.AddConstant(callables[4])
+			return nil
+		},
+		Visit: func(it *Iterator) (Op, []byte, error) {
+			if curFn != it.Func() {
+				curFn = it.Func()
+				temps = nil
+				var err error
+				numericAdds, err = numericAddPositions(
+					pc.Bytecode().Constants, curFn)
+				if err != nil {
+					return Next, nil, err
+				}
+			}
+			operands := it.Operands()
+			switch it.Opcode() {
+			case ugo.OpArray:
+				insts, err := chargeInsts(operands[0] * memObjectSize)
+				return Prepend, insts, err
+			case ugo.OpMap:
+				insts, err := chargeInsts(operands[0] / 2 * memMapEntrySize)
+				return Prepend, insts, err
+			case ugo.OpSliceIndex:
+				insts, err := chargeInsts(memSliceSize)
+				return Prepend, insts, err
+			case ugo.OpSetIndex:
+				t, err := tempLocals(2)
+				if err != nil {
+					return Next, nil, err
+				}
+				insts, err := makeInsts(
+					[]int{int(ugo.OpDefineLocal), t[1]},
+					[]int{int(ugo.OpDefineLocal), t[0]},
+					[]int{int(ugo.OpConstant), setIndex},
+					[]int{int(ugo.OpGetLocal), t[0]},
+					[]int{int(ugo.OpGetLocal), t[1]},
+					[]int{int(ugo.OpCall), 2, 0},
+					[]int{int(ugo.OpPop)},
+					[]int{int(ugo.OpGetLocal), t[0]},
+					[]int{int(ugo.OpGetLocal), t[1]},
+				)
+				return InsertBefore, insts, err
+			case ugo.OpBinaryOp:
+				if token.Token(operands[0]) != token.Add || numericAdds[it.Pos()] {
+					break
+				}
+				insts, err := wrapInsts(sizeIndex)
+				return InsertAfter, insts, err
+			case ugo.OpGetBuiltin:
+				var index int
+				switch ugo.BuiltinType(operands[0]) {
+				case ugo.BuiltinAppend:
+					index = appendIndex
+				case ugo.BuiltinRepeat:
+					index = repeatIndex
+				default:
+					return Next, nil, nil
+				}
+				insts, err := wrapInsts(index)
+				return InsertAfter, insts, err
+			}
+			return Next, nil, nil
+		},
+		Attach: func(_ *ugo.Bytecode, consts []ugo.Object) error {
+			return attachConstants(consts, callables...)
+		},
+	}, m
+}
+
+// numericAddPositions returns the positions of the additions of given function
+// whose operands are known to be numbers, which do not allocate. Values are
+// tracked within basic blocks, and local variables are numbers if all the
+// values stored to them are numbers, except parameters and the ones captured
+// by closures.
+func numericAddPositions(
+	consts []ugo.Object,
+	fn *ugo.CompiledFunction,
+) (map[int]bool, error) {
+	blocks, err := basicBlocks(fn.Instructions)
+	if err != nil {
+		return nil, err
+	}
+	locals := make([]bool, fn.NumLocals)
+	for i := fn.NumParams; i < len(locals); i++ {
+		locals[i] = true
+	}
+	it := NewIterator(fn.Instructions)
+	for it.Next() {
+		if it.Opcode() == ugo.OpGetLocalPtr && it.Operands()[0] < len(locals) {
+			locals[it.Operands()[0]] = false
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	adds := make(map[int]bool)
+	var stack []bool
+	pop := func() bool {
+		if len(stack) == 0 {
+			return false
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	// run simulates the instructions and reports whether a local variable is
+	// found not to be a number.
+	run := func() bool {
+		var changed bool
+		var index int
+		it.Reset(fn.Instructions)
+		for it.Next() {
+			if index < len(blocks) && it.Pos() == blocks[index].start {
+				stack = stack[:0]
+				index++
+			}
+			operands := it.Operands()
+			switch it.Opcode() {
+			case ugo.OpConstant:
+				stack = append(stack, operands[0] < len(consts) &&
+					isNumber(consts[operands[0]]))
+			case ugo.OpGetLocal:
+				stack = append(stack, operands[0] < len(locals) &&
+					locals[operands[0]])
+			case ugo.OpDefineLocal, ugo.OpSetLocal:
+				if !pop() && operands[0] < len(locals) && locals[operands[0]] {
+					locals[operands[0]] = false
+					changed = true
+				}
+			case ugo.OpBinaryOp:
+				right, left := pop(), pop()
+				tok := token.Token(operands[0])
+				if tok == token.Add && left && right {
+					adds[it.Pos()] = true
+				}
+				stack = append(stack, left && right && arithmeticToken(tok))
+			case ugo.OpUnary:
+				switch token.Token(operands[0]) {
+				case token.Add, token.Sub, token.Xor:
+					stack = append(stack, pop())
+				default:
+					pop()
+					stack = append(stack, false)
+				}
+			case ugo.OpNull, ugo.OpTrue, ugo.OpFalse:
+				stack = append(stack, false)
+			case ugo.OpPop:
+				pop()
+			default:
+				// values below are unknown
+				stack = stack[:0]
+			}
+		}
+		return changed
+	}
+	for run() {
+		adds = make(map[int]bool)
+	}
+	return adds, it.Error()
+}
+
+// isNumber reports whether given object is a number.
+func isNumber(o ugo.Object) bool {
+	switch o.(type) {
+	case ugo.Int, ugo.Uint, ugo.Float, ugo.Char:
+		return true
+	}
+	return false
+}
+
+// arithmeticToken reports whether given binary operator results in a number
+// if both operands are numbers.
+func arithmeticToken(tok token.Token) bool {
+	switch tok {
+	case token.Add, token.Sub, token.Mul, token.Quo, token.Rem, token.And,
+		token.Or, token.Xor, token.AndNot, token.Shl, token.Shr:
+		return true
+	}
+	return false
+}
+
+// makeInsts returns the instructions made of given opcode and operands lists.
+func makeInsts(insts ...[]int) ([]byte, error) {
+	var out []byte
+	b := make([]byte, 8)
+	for _, inst := range insts {
+		var err error
+		b, err = ugo.MakeInstruction(b, ugo.Opcode(inst[0]), inst[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// memSize returns the approximate number of bytes allocated for given object.
+func memSize(o ugo.Object) int {
+	switch v := o.(type) {
+	case ugo.String:
+		return len(v)
+	case ugo.Bytes:
+		return len(v)
+	case ugo.Array:
+		return len(v) * memObjectSize
+	case ugo.Map:
+		return len(v) * memMapEntrySize
+	}
+	return 0
+}
+
+// appendCost returns the cost of append call before allocation.
+func appendCost(c ugo.Call) int {
+	n := c.Len() - 1
+	if n <= 0 {
+		return 0
+	}
+	if _, ok := c.Get(0).(ugo.Bytes); ok {
+		return n
+	}
+	return n * memObjectSize
+}
+
+// repeatCost returns the cost of repeat call before allocation.
+func repeatCost(c ugo.Call) int {
+	if c.Len() != 2 {
+		return 0
+	}
+	var count int
+	switch v := c.Get(1).(type) {
+	case ugo.Int:
+		count = int(v)
+	case ugo.Uint:
+		count = int(v)
+	}
+	if count <= 0 {
+		return 0
+	}
+	size := memSize(c.Get(0))
+	if size > 0 && count > int(^uint(0)>>1)/size {
+		// overflow, make it fail
+		return int(^uint(0) >> 1)
+	}
+	return size * count
+}
+
+// MemoryMeter is the callable added to ugo.Bytecode by PatchForMemoryLimit to
+// charge allocated bytes.
+type MemoryMeter struct {
+	ugo.ObjectImpl
+	mu    sync.Mutex
+	used  uint64
+	limit uint64
+}
+
+var _ ugo.ExCallerObject = (*MemoryMeter)(nil)
+
+func (m *MemoryMeter) String() string   { return "<memoryMeter>" }
+func (m *MemoryMeter) TypeName() string { return m.String() }
+func (m *MemoryMeter) CanCall() bool    { return true }
+
+func (m *MemoryMeter) Call(args ...ugo.Object) (ugo.Object, error) {
+	return m.CallEx(ugo.NewCall(nil, args))
+}
+
+func (m *MemoryMeter) CallEx(c ugo.Call) (ugo.Object, error) {
+	if err := c.CheckLen(1); err != nil {
+		return ugo.Undefined, err
+	}
+	cost, ok := c.Get(0).(ugo.Int)
+	if !ok || cost < 0 {
+		return ugo.Undefined, ugo.NewArgumentTypeError(
+			"first", "non-negative int", c.Get(0).TypeName())
+	}
+	return ugo.Undefined, m.charge(uint64(cost))
+}
+
+func (m *MemoryMeter) charge(cost uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cost > m.limit-m.used {
+		m.used = m.limit
+		return &MemoryLimitError{Limit: m.limit}
+	}
+	m.used += cost
+	return nil
+}
+
+// Used returns the number of charged bytes. It never exceeds the limit.
+func (m *MemoryMeter) Used() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.used
+}
+
+// Limit returns the byte limit.
+func (m *MemoryMeter) Limit() uint64 {
+	return m.limit
+}
+
+// Reset sets the consumed amount to zero to run the ugo.Bytecode again.
+func (m *MemoryMeter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.used = 0
+}
+
+// memSizeFunc charges the size of its argument and returns it.
+type memSizeFunc struct {
+	ugo.ObjectImpl
+	meter *MemoryMeter
+}
+
+var _ ugo.ExCallerObject = (*memSizeFunc)(nil)
+
+func (f *memSizeFunc) String() string   { return "<memorySize>" }
+func (f *memSizeFunc) TypeName() string { return f.String() }
+func (f *memSizeFunc) CanCall() bool    { return true }
+
+func (f *memSizeFunc) Call(args ...ugo.Object) (ugo.Object, error) {
+	return f.CallEx(ugo.NewCall(nil, args))
+}
+
+func (f *memSizeFunc) CallEx(c ugo.Call) (ugo.Object, error) {
+	if err := c.CheckLen(1); err != nil {
+		return ugo.Undefined, err
+	}
+	v := c.Get(0)
+	if err := f.meter.charge(uint64(memSize(v))); err != nil {
+		return ugo.Undefined, err
+	}
+	return v, nil
+}
+
+// memSetIndexFunc charges a map entry if the index assigned by SETINDEX is a
+// new key of a map.
+type memSetIndexFunc struct {
+	ugo.ObjectImpl
+	meter *MemoryMeter
+}
+
+var _ ugo.ExCallerObject = (*memSetIndexFunc)(nil)
+
+func (f *memSetIndexFunc) String() string   { return "<memorySetIndex>" }
+func (f *memSetIndexFunc) TypeName() string { return f.String() }
+func (f *memSetIndexFunc) CanCall() bool    { return true }
+
+func (f *memSetIndexFunc) Call(args ...ugo.Object) (ugo.Object, error) {
+	return f.CallEx(ugo.NewCall(nil, args))
+}
+
+func (f *memSetIndexFunc) CallEx(c ugo.Call) (ugo.Object, error) {
+	if err := c.CheckLen(2); err != nil {
+		return ugo.Undefined, err
+	}
+	var exists bool
+	switch v := c.Get(0).(type) {
+	case ugo.Map:
+		_, exists = v[c.Get(1).String()]
+	case *ugo.SyncMap:
+		_, exists = v.Get(c.Get(1).String())
+	default:
+		return ugo.Undefined, nil
+	}
+	if exists {
+		return ugo.Undefined, nil
+	}
+	return ugo.Undefined, f.meter.charge(memMapEntrySize)
+}
+
+// memWrapFunc returns a memBuiltinFunc wrapping its argument, which is the
+// loaded builtin function or its replacement, e.g. by ReplayPass.
+type memWrapFunc struct {
+	ugo.ObjectImpl
+	builtin *memBuiltinFunc
+}
+
+var _ ugo.ExCallerObject = (*memWrapFunc)(nil)
+
+func newMemWrapFunc(
+	m *MemoryMeter,
+	typ ugo.BuiltinType,
+	cost func(ugo.Call) int,
+) *memWrapFunc {
+	return &memWrapFunc{
+		builtin: &memBuiltinFunc{
+			meter: m,
+			fn:    ugo.BuiltinObjects[typ],
+			cost:  cost,
+		},
+	}
+}
+
+func (f *memWrapFunc) String() string {
+	return "<memoryWrap:" + f.builtin.fn.String() + ">"
+}
+func (f *memWrapFunc) TypeName() string { return f.String() }
+func (f *memWrapFunc) CanCall() bool    { return true }
+
+func (f *memWrapFunc) Call(args ...ugo.Object) (ugo.Object, error) {
+	return f.CallEx(ugo.NewCall(nil, args))
+}
+
+func (f *memWrapFunc) CallEx(c ugo.Call) (ugo.Object, error) {
+	if err := c.CheckLen(1); err != nil {
+		return ugo.Undefined, err
+	}
+	switch fn := c.Get(0); {
+	case fn == f.builtin.fn:
+		return f.builtin, nil
+	case !fn.CanCall():
+		// let the call fail like the original
+		return fn, nil
+	default:
+		return &memBuiltinFunc{
+			meter: f.builtin.meter,
+			fn:    fn,
+			cost:  f.builtin.cost,
+		}, nil
+	}
+}
+
+// memBuiltinFunc charges the cost of a builtin function call before calling
+// it.
+type memBuiltinFunc struct {
+	ugo.ObjectImpl
+	meter *MemoryMeter
+	fn    ugo.Object
+	cost  func(ugo.Call) int
+}
+
+var _ ugo.ExCallerObject = (*memBuiltinFunc)(nil)
+
+var _ ugo.Copier = (*memBuiltinFunc)(nil)
+
+func (f *memBuiltinFunc) String() string   { return f.fn.String() }
+func (f *memBuiltinFunc) TypeName() string { return f.fn.TypeName() }
+func (f *memBuiltinFunc) IsFalsy() bool    { return f.fn.IsFalsy() }
+func (f *memBuiltinFunc) CanCall() bool    { return true }
+
+// Equal compares the wrapped functions, so that the wrapped builtin functions
+// are compared like the builtin functions.
+func (f *memBuiltinFunc) Equal(right ugo.Object) bool {
+	if r, ok := right.(*memBuiltinFunc); ok {
+		right = r.fn
+	}
+	return f.fn.Equal(right)
+}
+
+// Copy wraps a copy of the wrapped function, which is not equal to the
+// original like the copies of the builtin functions.
+func (f *memBuiltinFunc) Copy() ugo.Object {
+	if c, ok := f.fn.(ugo.Copier); ok {
+		return &memBuiltinFunc{meter: f.meter, fn: c.Copy(), cost: f.cost}
+	}
+	return f
+}
+
+func (f *memBuiltinFunc) Call(args ...ugo.Object) (ugo.Object, error) {
+	return f.CallEx(ugo.NewCall(nil, args))
+}
+
+func (f *memBuiltinFunc) CallEx(c ugo.Call) (ugo.Object, error) {
+	if err := f.meter.charge(uint64(f.cost(c))); err != nil {
+		return ugo.Undefined, err
+	}
+	if ex, ok := f.fn.(ugo.ExCallerObject); ok {
+		return ex.CallEx(c)
+	}
+	args := make([]ugo.Object, c.Len())
+	for i := range args {
+		args[i] = c.Get(i)
+	}
+	return f.fn.Call(args...)
+}
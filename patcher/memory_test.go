@@ -0,0 +1,196 @@
+package patcher_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPatchForMemoryLimit(t *testing.T) {
+	opts := CompilerOptions{}
+
+	runLimit := func(t *testing.T, script string, limit uint64) (
+		*patcher.MemoryMeter, Object, error) {
+		t.Helper()
+		var m *patcher.MemoryMeter
+		var ret Object
+		var err error
+		expectCompile(t, script, opts, func(bc *Bytecode) {
+			m, err = patcher.PatchForMemoryLimit(bc, limit)
+			require.NoError(t, err)
+			ret, err = NewVM(bc).Run(nil)
+		})
+		return m, ret, err
+	}
+
+	expectUsed := func(t *testing.T, script string, used uint64, expected Object) {
+		t.Helper()
+		m, ret, err := runLimit(t, script, 1<<20)
+		require.NoError(t, err)
+		require.Equal(t, expected, ret)
+		require.Equal(t, used, m.Used())
+		require.Equal(t, uint64(1<<20), m.Limit())
+	}
+
+	expectUsed(t, `return 1 + 2`, 0, Int(3))
+	expectUsed(t, `a := 1; return [a, 2, 3]`, 3*16, Array{Int(1), Int(2), Int(3)})
+	expectUsed(t, `a := 1; return {a: a, b: 2}`, 2*64, Map{"a": Int(1), "b": Int(2)})
+	expectUsed(t, `a := "abc"; return a + "de"`, 5, String("abcde"))
+	expectUsed(t, `a := [1, 2]; return a + [3]`, 2*16+16+3*16,
+		Array{Int(1), Int(2), Int(3)})
+	expectUsed(t, `a := "abcdef"; return a[1:3]`, 24, String("bc"))
+	expectUsed(t, `a := []; return append(a, 1, 2)`, 2*16, Array{Int(1), Int(2)})
+	expectUsed(t, `a := bytes(); return append(a, 1, 2)`, 2, Bytes{1, 2})
+	expectUsed(t, `a := "ab"; return repeat(a, 3)`, 6, String("ababab"))
+	expectUsed(t, `return typeName(append)`, 0, String("builtinFunction"))
+
+	// additions in functions and conditional jumps to literals
+	expectUsed(t, `
+	f := func(a, b) {
+		x := a ? [b] : [b, b]
+		return x + x
+	}
+	return f(true, "a")`, 16+2*16, Array{String("a"), String("a")})
+
+	// new keys of maps are charged
+	expectUsed(t, `m := {}; m.a = 1; m.a = 2; m["b"] = 3; return m`, 2*64,
+		Map{"a": Int(2), "b": Int(3)})
+	expectUsed(t, `a := [1]; a[0] = 2; return a`, 16, Array{Int(2)})
+
+	// additions of numbers are not instrumented
+	for script, charged := range map[string]bool{
+		`s := 0; for i := 0; i < 10; i++ { s += i * 2 }; return s`: false,
+		`a := 1.5; b := -a; return a + b + 2`:                      false,
+		`f := func(a) { return a + 1 }; return f(1)`:               true,
+		`a := 1; a = "x"; return a + 1`:                            true,
+		`a := 1; f := func() { a = "x" }; f(); return a + 1`:       true,
+		`f := func() { return "a" }; return f() + 1`:               true,
+	} {
+		expectCompile(t, script, opts, func(bc *Bytecode) {
+			numLocals := countLocals(bc)
+			_, err := patcher.PatchForMemoryLimit(bc, 1<<20)
+			require.NoError(t, err)
+			require.Equal(t, charged, countLocals(bc) > numLocals, script)
+			_, err = NewVM(bc).Run(nil)
+			require.NoError(t, err, script)
+		})
+	}
+	expectUsed(t, `a := "x"; return a + 1`, 2, String("x1"))
+
+	// infinite append loop is stopped
+	script := `
+	a := []
+	for {
+		a = append(a, 1)
+	}`
+	m, _, err := runLimit(t, script, 1000)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, patcher.ErrMemoryLimit))
+	var limitErr *patcher.MemoryLimitError
+	require.True(t, errors.As(err, &limitErr))
+	require.Equal(t, uint64(1000), limitErr.Limit)
+	require.Equal(t, uint64(1000), m.Used())
+	require.Equal(t, "memory limit exceeded: 1000 bytes", limitErr.Error())
+
+	// huge repeat is stopped before allocating
+	_, _, err = runLimit(t, `return repeat("abc", 1 << 40)`, 1<<20)
+	require.True(t, errors.Is(err, patcher.ErrMemoryLimit))
+
+	// error cannot be swallowed
+	script = `
+	s := ""
+	for i := 0; i < 100; i++ {
+		try {
+			s += "abcdefghij"
+		} catch err {
+		}
+	}
+	return s + "x"`
+	_, _, err = runLimit(t, script, 500)
+	require.True(t, errors.Is(err, patcher.ErrMemoryLimit))
+
+	m.Reset()
+	require.Zero(t, m.Used())
+}
+
+// countLocals returns the number of local variables of all functions.
+func countLocals(bc *Bytecode) int {
+	n := bc.Main.NumLocals
+	for _, c := range bc.Constants {
+		if fn, ok := c.(*CompiledFunction); ok {
+			n += fn.NumLocals
+		}
+	}
+	return n
+}
+
+func TestMemoryLimitPassComposition(t *testing.T) {
+	script := `a := append([], 1, 2); return append(a, 3)`
+
+	// appends are charged after the builtin is replaced by another pass
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var log bytes.Buffer
+		rp := patcher.NewRecorder(&log)
+		pass, m := patcher.MemoryLimitPass(1 << 20)
+		_, err := patcher.NewPipeline(
+			pass,
+			patcher.ReplayPass(rp, []string{"append"}),
+		).Run(bc)
+		require.NoError(t, err)
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Array{Int(1), Int(2), Int(3)}, ret)
+		require.Equal(t, uint64(3*16), m.Used())
+		require.Equal(t, 2, rp.Calls())
+	})
+
+	// forbidden builtins are still found after memory limit pass
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		pass, _ := patcher.MemoryLimitPass(1 << 20)
+		var violations []patcher.PolicyViolation
+		_, err := patcher.NewPipeline(
+			pass,
+			patcher.ApplyPass("policy", func(bc *Bytecode) (err error) {
+				violations, err = patcher.PatchForPolicy(bc, patcher.Policy{
+					AllowedBuiltins: []string{},
+				})
+				return
+			}),
+		).Run(bc)
+		require.NoError(t, err)
+		require.Len(t, violations, 2)
+		_, err = NewVM(bc).Run(nil)
+		require.True(t, errors.Is(err, patcher.ErrForbidden))
+	})
+}
+
+func TestPatchForMemoryLimitBuiltins(t *testing.T) {
+	// wrapped builtins behave like the builtins
+	script := `
+	a := append
+	c := copy(append)
+	m := {f: repeat}
+	return [append == append, a == append, append == a, append == repeat,
+		m.f == repeat, repeat == m.f, c == append, append == c, len == append,
+		append == len, !append, append ? 1 : 2, typeName(c), string(a)]`
+
+	var expected Object
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var err error
+		expected, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+	})
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		_, err := patcher.PatchForMemoryLimit(bc, 1<<20)
+		require.NoError(t, err)
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, ret)
+	})
+}
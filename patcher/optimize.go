@@ -0,0 +1,205 @@
+package patcher
+
+import (
+	"github.com/ozanh/ugo"
+)
+
+// maxOptimizeRounds is the maximum number of rounds Optimize runs, as removing
+// instructions may reveal new optimizations, e.g. jumps to the next
+// instruction.
+const maxOptimizeRounds = 4
+
+// OptimizeStats holds the number of optimizations made by Optimize.
+type OptimizeStats struct {
+	// Pops is the number of removed pairs of a push without side effects,
+	// e.g. CONSTANT, and POP.
+	Pops int
+	// Jumps is the number of jumps retargeted to the end of jump chains or
+	// removed as they jump to the next instruction.
+	Jumps int
+	// Unreachable is the number of removed instructions of the unreachable
+	// blocks, e.g. the ones after RETURN and THROW.
+	Unreachable int
+	// Locals is the number of removed pairs of GETLOCAL and SETLOCAL of the
+	// same local variable.
+	Locals int
+}
+
+// Optimize modifies given ugo.Bytecode to remove redundant instructions with a
+// peephole optimizer. Pairs of pushes without side effects and POP, and pairs
+// of GETLOCAL and SETLOCAL of the same local are removed if the second
+// instruction is not a jump target. Jumps to unconditional jumps are
+// retargeted to the end of the chain, jumps to the next instruction and the
+// instructions of unreachable basic blocks are removed. Only the removed
+// instructions are dropped from the source maps, so runtime errors report the
+// same positions. It should be run before the other patches, so that they do
+// not instrument removed code. If error is returned, given ugo.Bytecode must
+// be discarded due to invalid patching.
+func Optimize(bc *ugo.Bytecode) (*OptimizeStats, error) {
+	stats := &OptimizeStats{}
+	for round := 0; round < maxOptimizeRounds; round++ {
+		removes := make(map[*ugo.CompiledFunction]map[int]bool)
+		var fns []*ugo.CompiledFunction
+		if bc.Main != nil {
+			fns = append(fns, bc.Main)
+		}
+		for _, c := range bc.Constants {
+			if fn, ok := c.(*ugo.CompiledFunction); ok {
+				fns = append(fns, fn)
+			}
+		}
+		for _, fn := range fns {
+			r, err := optimizeFunc(fn, stats)
+			if err != nil {
+				return nil, err
+			}
+			if len(r) > 0 {
+				removes[fn] = r
+			}
+		}
+		if len(removes) == 0 {
+			break
+		}
+		p := New(bc, func(it *Iterator) (Op, []byte) {
+			if removes[it.Func()][it.Pos()] {
+				return Remove, nil
+			}
+			return Next, nil
+		})
+		if err := p.Patch(); err != nil {
+			return nil, err
+		}
+	}
+	if err := debugVerify(bc); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// OptimizePass returns a Pass for Pipeline optimizing like Optimize and the
+// stats updated when the pass is run. It is applied on its own as it analyzes
+// the whole functions in multiple rounds.
+func OptimizePass() (Pass, *OptimizeStats) {
+	stats := &OptimizeStats{}
+	return ApplyPass("optimize", func(bc *ugo.Bytecode) error {
+		s, err := Optimize(bc)
+		if err == nil {
+			*stats = *s
+		}
+		return err
+	}), stats
+}
+
+// optimizeFunc retargets the jump chains of given function and returns the
+// positions of the instructions to remove.
+func optimizeFunc(fn *ugo.CompiledFunction, stats *OptimizeStats) (map[int]bool, error) {
+	if err := threadJumps(fn, stats); err != nil {
+		return nil, err
+	}
+	g, err := BuildCFG(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	removes := make(map[int]bool)
+	leaders := make(map[int]bool, len(g.Blocks))
+	for _, b := range g.Blocks {
+		leaders[b.Start] = true
+	}
+
+	var prevPos int
+	var prevOp ugo.Opcode
+	var prevOperands []int
+	var index int
+	it := NewIterator(fn.Instructions)
+	for it.Next() {
+		pos, op := it.Pos(), it.Opcode()
+		for pos >= g.Blocks[index].End {
+			index++
+		}
+		if !g.Blocks[index].Reachable {
+			removes[pos] = true
+			stats.Unreachable++
+			prevOp = ugo.OpNoOp
+			continue
+		}
+
+		switch {
+		case op == ugo.OpJump && it.Operands()[0] == pos+it.Offset()+1:
+			removes[pos] = true
+			stats.Jumps++
+		case leaders[pos] || removes[prevPos]:
+		case op == ugo.OpPop && pushOnly(prevOp):
+			removes[prevPos], removes[pos] = true, true
+			stats.Pops++
+		case op == ugo.OpSetLocal && prevOp == ugo.OpGetLocal &&
+			prevOperands[0] == it.Operands()[0]:
+			removes[prevPos], removes[pos] = true, true
+			stats.Locals++
+		}
+		prevPos, prevOp = pos, op
+		prevOperands = append(prevOperands[:0], it.Operands()...)
+	}
+	return removes, it.Error()
+}
+
+// pushOnly reports whether given opcode only pushes a value to the stack
+// without any side effects.
+func pushOnly(op ugo.Opcode) bool {
+	switch op {
+	case ugo.OpConstant, ugo.OpNull, ugo.OpTrue, ugo.OpFalse,
+		ugo.OpGetLocal, ugo.OpGetBuiltin:
+		return true
+	}
+	return false
+}
+
+// threadJumps retargets the jumps to unconditional jumps to the end of the
+// jump chain. Instructions are copied before modification.
+func threadJumps(fn *ugo.CompiledFunction, stats *OptimizeStats) error {
+	jumps := make(map[int]int)
+	it := NewIterator(fn.Instructions)
+	for it.Next() {
+		if it.Opcode() == ugo.OpJump {
+			jumps[it.Pos()] = it.Operands()[0]
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	var insts []byte
+	b := make([]byte, 8)
+	it.Reset(fn.Instructions)
+	for it.Next() {
+		switch op := it.Opcode(); op {
+		case ugo.OpJump, ugo.OpJumpFalsy, ugo.OpAndJump, ugo.OpOrJump:
+			target := it.Operands()[0]
+			seen := map[int]bool{it.Pos(): true}
+			for {
+				next, ok := jumps[target]
+				if !ok || seen[target] {
+					break
+				}
+				seen[target] = true
+				target = next
+			}
+			if target == it.Operands()[0] {
+				continue
+			}
+			var err error
+			if b, err = ugo.MakeInstruction(b, op, target); err != nil {
+				return err
+			}
+			if insts == nil {
+				insts = append([]byte(nil), fn.Instructions...)
+			}
+			copy(insts[it.Pos():], b)
+			stats.Jumps++
+		}
+	}
+	if insts != nil {
+		fn.Instructions = insts
+	}
+	return it.Error()
+}
@@ -0,0 +1,200 @@
+package patcher_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+	ugofmt "github.com/ozanh/ugo/stdlib/fmt"
+	ugojson "github.com/ozanh/ugo/stdlib/json"
+	ugostrings "github.com/ozanh/ugo/stdlib/strings"
+	ugotime "github.com/ozanh/ugo/stdlib/time"
+)
+
+func TestOptimize(t *testing.T) {
+	script := `x := 0
+1
+x = x
+for {
+	x++
+	if x > 3 {
+		if x { break } else { continue }
+	}
+}
+return x`
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		stats, err := patcher.Optimize(bc)
+		require.NoError(t, err)
+		require.Equal(t, patcher.OptimizeStats{
+			Pops: 1, Jumps: 5, Unreachable: 4, Locals: 1,
+		}, *stats)
+
+		var buf bytes.Buffer
+		require.NoError(t, patcher.Disassemble(&buf, bc, patcher.DisasmOptions{}))
+		require.Equal(t, trimLines(`
+main: Params:0 Variadic:false Locals:1
+(main):1
+  0000   CONSTANT     0                  ; 0
+  0003   DEFINELOCAL  0
+L0005:
+(main):5
+  0005   GETLOCAL     0
+  0007   CONSTANT     1                  ; 1
+  0010   BINARYOP     12                 ; +
+  0012   SETLOCAL     0
+(main):6
+  0014   GETLOCAL     0
+  0016   CONSTANT     2                  ; 3
+  0019   BINARYOP     40                 ; >
+  0021   JUMPFALSY    L0005
+(main):7
+  0026   GETLOCAL     0
+  0028   JUMPFALSY    L0005
+(main):10
+  0033   GETLOCAL     0
+  0035   RETURN       1
+`), trimLines(buf.String()))
+
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(4), ret)
+	})
+
+	// results and error positions are kept
+	for _, script := range []string{
+		`a := 0; b := 0; c := 0
+		for i := 0; i < 30; i++ {
+			if i % 2 == 0 {
+				if i % 3 == 0 { a++ } else { b++ }
+			} else {
+				if i % 5 == 0 { continue } else { c++ }
+			}
+		}
+		return [a, b, c]`,
+		`f := func(n) {
+			for i := 0; i < n; i++ {
+				try {
+					if i == 2 { return i }
+					throw "x"
+				} catch e {
+					continue
+				} finally {
+					n++
+				}
+			}
+		}
+		return f(5)`,
+		`x := 1; return x && 0 || "a"`,
+		`for i in [1, 2] { break }; return true`,
+		`x := 1
+		1
+		return x / 0`,
+		`f := func() { throw "y" }
+		"a"
+		f()`,
+	} {
+		var expected Object
+		var expectedErr error
+		expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+			expected, expectedErr = NewVM(bc).Run(nil)
+		})
+		expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+			_, err := patcher.Optimize(bc)
+			require.NoError(t, err)
+			ret, err := NewVM(bc).Run(nil)
+			require.Equal(t, expected, ret, script)
+			if expectedErr == nil {
+				require.NoError(t, err, script)
+			} else {
+				require.Error(t, err, script)
+				require.Equal(t, expectedErr.Error(), err.Error(), script)
+			}
+		})
+	}
+
+	// run in a pipeline before the other patches
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		op, stats := patcher.OptimizePass()
+		lp, m := patcher.InstructionLimitPass(1000)
+		_, err := patcher.NewPipeline(op, lp).Run(bc)
+		require.NoError(t, err)
+		require.Equal(t, 5, stats.Jumps)
+		_, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, uint64(38), m.Used())
+	})
+}
+
+func BenchmarkOptimize(b *testing.B) {
+	sample, err := os.ReadFile("../playground/cmd/wasm/testdata/sample.ugo")
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := CompilerOptions{
+		ModuleMap: NewModuleMap().
+			AddBuiltinModule("time", ugotime.Module).
+			AddBuiltinModule("strings", ugostrings.Module).
+			AddBuiltinModule("fmt", ugofmt.Module).
+			AddBuiltinModule("json", ugojson.Module),
+	}
+	scripts := []struct {
+		name   string
+		script []byte
+	}{
+		{"sample", sample},
+		{"branches", []byte(`
+		classify := func(n) {
+			a := 0; b := 0; c := 0
+			for i := 0; i < n; i++ {
+				if i % 2 == 0 {
+					if i % 3 == 0 { a++ } else { b++ }
+				} else {
+					if i % 5 == 0 { continue } else { c++ }
+				}
+			}
+			return a + b + c
+		}
+		return classify(10000)`)},
+	}
+
+	// discard the output of println builtin and fmt module
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	printWriter, stdout := PrintWriter, os.Stdout
+	PrintWriter, os.Stdout = io.Discard, devNull
+	b.Cleanup(func() {
+		PrintWriter, os.Stdout = printWriter, stdout
+		_ = devNull.Close()
+	})
+
+	for _, s := range scripts {
+		for _, optimize := range []bool{false, true} {
+			bc, err := Compile(s.script, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			name := s.name
+			if optimize {
+				name += "/optimized"
+				if _, err := patcher.Optimize(bc); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := NewVM(bc).Run(nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
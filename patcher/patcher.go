@@ -4,190 +4,132 @@ package patcher
 
 import (
 	"fmt"
-	"runtime"
-	"sync"
-	"time"
 
 	"github.com/ozanh/ugo"
 )
 
+// Op is the operation returned by PatchFunc to tell Patcher how to handle the
+// current instruction.
+type Op byte
+
+// List of operations.
 const (
-	patchNext byte = iota
-	patchInsertBefore
+	// Next keeps the current instruction as is and moves to the next one.
+	Next Op = iota
+	// InsertBefore inserts the returned instructions before the current
+	// instruction. Jumps targeting the current instruction are not redirected
+	// to the inserted instructions.
+	InsertBefore
+	// InsertAfter inserts the returned instructions after the current
+	// instruction. Jumps targeting the next instruction are not redirected to
+	// the inserted instructions.
+	InsertAfter
+	// Replace replaces the current instruction with the returned instructions.
+	// Jumps targeting the current instruction target the first returned
+	// instruction. If the current instruction is a jump, it is no longer
+	// tracked, returned instructions must have correct jump targets.
+	Replace
+	// Remove removes the current instruction. Jumps targeting the current
+	// instruction are redirected to the next surviving instruction. Patch
+	// returns an error if there is no instruction left to jump to.
+	Remove
+	// Prepend inserts the returned instructions before the current instruction
+	// like InsertBefore but jumps targeting the current instruction are
+	// redirected to the first inserted instruction. Source position of the
+	// current instruction is moved to the first inserted instruction.
+	Prepend
 )
 
-type patchFunc = func(*instsIterator) (op byte, insts []byte)
-
-// PatchForGosched modifies given ugo.Bytecode to add a callable to the given
-// ugo.Bytecode that tries to park the VM goroutine when the number of calls to
-// the callable reaches the given threshold. This patch should be used in single
-// threaded application e.g. WebAssembly. If error is returned, given
-// ugo.Bytecode must be discarded due to invalid patching.
-func PatchForGosched(bc *ugo.Bytecode, callThreshold uint32) (int, error) {
-	// Generate following instructions to insert before backward jumps and
-	// function start points.
-	/*
-		0000 CONSTANT <index>
-		0000 CALL 0 0
-		0000 POP
-	*/
-
-	if callThreshold == 0 {
-		panic("callThreshold must be greater than 0")
-	}
-
-	constIndex := len(bc.Constants)
-	insert := make([]byte, 0, 7)
-	b := make([]byte, 8)
-	b, err := ugo.MakeInstruction(b, ugo.OpConstant, constIndex)
-	if err != nil {
-		return 0, err
-	}
-	insert = append(insert, b...)
-	b, err = ugo.MakeInstruction(b, ugo.OpCall, 0, 0)
-	if err != nil {
-		return 0, err
-	}
-	insert = append(insert, b...)
-	b, err = ugo.MakeInstruction(b, ugo.OpPop)
-	if err != nil {
-		return 0, err
-	}
-	insert = append(insert, b...)
-	var numInserts int
-	bp := newBytecodePatcher(bc,
-		func(it *instsIterator) (byte, []byte) {
-			pos := it.Pos()
-			if pos == 0 {
-				// insert at the top of function
-				numInserts++
-				return patchInsertBefore, insert
-			}
-			opcode := it.Opcode()
-			if opcode == ugo.OpJump {
-				// if jump backward, insert instructions before jump
-				if it.Operands()[0] < pos {
-					numInserts++
-					return patchInsertBefore, insert
-				}
-			}
-			return patchNext, nil
-		},
-	)
-	if err := bp.patch(); err != nil {
-		return numInserts, err
-	}
-
-	fn := &goschedFunc{
-		callThreshold: callThreshold,
-		sleep:         runtime.NumCPU() == 1 || runtime.GOMAXPROCS(0) == 1,
-	}
-	bc.Constants = append(bc.Constants, fn)
-	return numInserts, nil
-}
-
-type goschedFunc struct {
-	ugo.ObjectImpl
-	mu            sync.Mutex
-	numCalls      uint64
-	counter       uint32
-	callThreshold uint32
-	sleep         bool
-}
-
-var _ ugo.ExCallerObject = (*goschedFunc)(nil)
-
-func (g *goschedFunc) String() string   { return "<gosched>" }
-func (g *goschedFunc) TypeName() string { return g.String() }
-func (g *goschedFunc) CanCall() bool    { return true }
-
-func (g *goschedFunc) Call(args ...ugo.Object) (ugo.Object, error) {
-	return g.CallEx(ugo.Call{})
-}
-
-func (g *goschedFunc) CallEx(_ ugo.Call) (ugo.Object, error) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
-
-	g.numCalls++
-	g.counter++
-	if g.counter == g.callThreshold {
-		g.counter = 0
-
-		runtime.Gosched()
-
-		if g.sleep {
-			//lint:ignore SA1004 // Park the current goroutine.
-			time.Sleep(1) // I couldn't find another way to park the goroutine.
-		}
-	}
-	return ugo.Undefined, nil
-}
-
-type bytecodePatcher struct {
-	it       *instsIterator
+// PatchFunc is called by Patcher for each instruction of the functions in
+// ugo.Bytecode. Returned Op determines what to do with the returned
+// instructions. Jump targets in the returned instructions are not updated.
+type PatchFunc = func(it *Iterator) (op Op, insts []byte)
+
+// Patcher modifies the instructions of the main function and the compiled
+// function constants of a ugo.Bytecode in place by calling a PatchFunc for each
+// instruction. Jump targets and source maps are updated after modification.
+// Constants appended to ugo.Bytecode during patching are not visited.
+type Patcher struct {
+	it       *Iterator
 	bc       *ugo.Bytecode
 	jumps    []posJump
 	smap     sourceMapper
 	newInsts []byte
 	curInsts []byte
-	modifier patchFunc
+	modifier PatchFunc
+	editor   func(it *Iterator) ([]patchEdit, error)
+}
+
+// New returns a new Patcher for given ugo.Bytecode which calls fn for each
+// instruction. It panics if fn is nil.
+func New(bc *ugo.Bytecode, fn PatchFunc) *Patcher {
+	if fn == nil {
+		panic("fn must not be nil")
+	}
+	p := newPatcher(bc)
+	p.modifier = fn
+	return p
 }
 
-func newBytecodePatcher(bc *ugo.Bytecode, fn patchFunc) *bytecodePatcher {
-	bm := &bytecodePatcher{
-		bc:       bc,
-		it:       &instsIterator{operands: make([]int, 4)},
-		modifier: fn,
+func newPatcher(bc *ugo.Bytecode) *Patcher {
+	return &Patcher{
+		bc: bc,
+		it: NewIterator(nil),
 	}
-	return bm
 }
 
-func (bp *bytecodePatcher) patch() (err error) {
-	curFn := bp.bc.Main
-	numConsts := len(bp.bc.Constants)
+// Patch walks through the instructions of ugo.Bytecode and applies the
+// modifications. If error is returned, ugo.Bytecode must be discarded due to
+// invalid patching.
+func (p *Patcher) Patch() (err error) {
+	curFn := p.bc.Main
+	numConsts := len(p.bc.Constants)
 	cidx := -1
 	for cidx < numConsts {
-		bp.curInsts = curFn.Instructions
-		bp.newInsts = make([]byte, 0, cap(bp.curInsts))
-		bp.smap.Reset(curFn.SourceMap)
-		if err = bp.saveJumpPos(); err != nil {
+		p.curInsts = curFn.Instructions
+		p.newInsts = make([]byte, 0, cap(p.curInsts))
+		p.smap.Reset(curFn.SourceMap)
+		p.it.fn, p.it.fnIndex = curFn, cidx
+		if err = p.saveJumpPos(); err != nil {
 			return
 		}
-		if err = bp.generate(); err != nil {
+		if err = p.generate(); err != nil {
 			return
 		}
-		if err = bp.updateJumps(); err != nil {
+		if err = p.updateJumps(); err != nil {
 			return
 		}
-		curFn.Instructions = bp.newInsts
-		curFn.SourceMap = bp.smap.MakeSourceMap()
+		curFn.Instructions = p.newInsts
+		curFn.SourceMap = p.smap.MakeSourceMap()
 
 		cidx++
 		for cidx < numConsts {
-			if f, ok := bp.bc.Constants[cidx].(*ugo.CompiledFunction); ok {
+			if f, ok := p.bc.Constants[cidx].(*ugo.CompiledFunction); ok {
 				curFn = f
 				break
 			}
 			cidx++
 		}
 	}
+	if Debug {
+		err = verify(p.bc, false)
+	}
 	return
 }
 
-func (bp *bytecodePatcher) saveJumpPos() error {
-	bp.jumps = bp.jumps[:0]
-	bp.it.Reset(bp.curInsts)
-	for bp.it.Next() {
-		switch op := bp.it.Opcode(); op {
+func (p *Patcher) saveJumpPos() error {
+	p.jumps = p.jumps[:0]
+	p.it.Reset(p.curInsts)
+	for p.it.Next() {
+		switch op := p.it.Opcode(); op {
 		case ugo.OpJumpFalsy,
 			ugo.OpJump,
 			ugo.OpAndJump,
 			ugo.OpOrJump,
 			ugo.OpSetupTry:
-			pos := bp.it.Pos()
-			operands := bp.it.Operands()
-			bp.jumps = append(bp.jumps,
+			pos := p.it.Pos()
+			operands := p.it.Operands()
+			p.jumps = append(p.jumps,
 				posJump{
 					pos:     pos,
 					jump:    operands[0],
@@ -196,7 +138,7 @@ func (bp *bytecodePatcher) saveJumpPos() error {
 				},
 			)
 			if op == ugo.OpSetupTry {
-				bp.jumps = append(bp.jumps,
+				p.jumps = append(p.jumps,
 					posJump{
 						pos:     pos,
 						jump:    operands[1],
@@ -207,48 +149,126 @@ func (bp *bytecodePatcher) saveJumpPos() error {
 			}
 		}
 	}
-	return bp.it.Error()
-}
-
-func (bp *bytecodePatcher) generate() error {
-	bp.it.Reset(bp.curInsts)
-	for bp.it.Next() {
-		op, insts := bp.modifier(bp.it)
-		pos, offset := bp.it.Pos(), bp.it.Offset()
-		switch op {
-		case patchNext:
-			bp.newInsts = append(bp.newInsts, bp.curInsts[pos:pos+offset+1]...)
-		case patchInsertBefore:
-			bp.insertAt(len(bp.newInsts), len(insts))
-			bp.newInsts = append(bp.newInsts, insts...)
-			bp.newInsts = append(bp.newInsts, bp.curInsts[pos:pos+offset+1]...)
+	return p.it.Error()
+}
+
+func (p *Patcher) generate() error {
+	p.it.Reset(p.curInsts)
+	for p.it.Next() {
+		var edits []patchEdit
+		if p.editor != nil {
+			var err error
+			if edits, err = p.editor(p.it); err != nil {
+				return err
+			}
+		} else {
+			op, insts := p.modifier(p.it)
+			edits = []patchEdit{{op: op, insts: insts}}
+		}
+		if err := p.apply(edits); err != nil {
+			return err
+		}
+	}
+	return p.it.Error()
+}
+
+// patchEdit is an operation and its instructions for the current instruction.
+type patchEdit struct {
+	op    Op
+	insts []byte
+}
+
+// apply applies given edits to the current instruction. Instructions of
+// InsertBefore edits are placed first, followed by the ones of Prepend edits,
+// the current instruction or its replacement, and the ones of InsertAfter
+// edits in the given order. At most one edit can replace or remove the
+// current instruction.
+func (p *Patcher) apply(edits []patchEdit) error {
+	pos, offset := p.it.Pos(), p.it.Offset()
+	var replace *patchEdit
+	for i := range edits {
+		switch edits[i].op {
+		case Next, InsertBefore, InsertAfter, Prepend:
+		case Replace, Remove:
+			if replace != nil {
+				return fmt.Errorf("generate: instruction at %d is replaced twice", pos)
+			}
+			replace = &edits[i]
 		default:
-			return fmt.Errorf("generate: unknown op: %d", op)
+			return fmt.Errorf("generate: unknown op: %d", edits[i].op)
+		}
+	}
+	for _, e := range edits {
+		if e.op == InsertBefore {
+			p.insertAt(len(p.newInsts), len(e.insts))
+			p.newInsts = append(p.newInsts, e.insts...)
+		}
+	}
+	for _, e := range edits {
+		if e.op == Prepend {
+			p.prependAt(len(p.newInsts), len(e.insts))
+			p.newInsts = append(p.newInsts, e.insts...)
 		}
 	}
-	return bp.it.Error()
+	switch {
+	case replace == nil:
+		p.newInsts = append(p.newInsts, p.curInsts[pos:pos+offset+1]...)
+	case replace.op == Replace:
+		p.replaceAt(len(p.newInsts), offset+1, len(replace.insts))
+		p.newInsts = append(p.newInsts, replace.insts...)
+	default:
+		p.replaceAt(len(p.newInsts), offset+1, 0)
+	}
+	for _, e := range edits {
+		if e.op == InsertAfter {
+			p.insertAt(len(p.newInsts), len(e.insts))
+			p.newInsts = append(p.newInsts, e.insts...)
+		}
+	}
+	return nil
+}
+
+func (p *Patcher) insertAt(pos, size int) {
+	for i := 0; i < len(p.jumps); i++ {
+		p.jumps[i].InsertAt(pos, size)
+	}
+	p.smap.InsertAt(pos, size)
+}
+
+func (p *Patcher) prependAt(pos, size int) {
+	for i := 0; i < len(p.jumps); i++ {
+		p.jumps[i].PrependAt(pos, size)
+	}
+	p.smap.PrependAt(pos, size)
 }
 
-func (bp *bytecodePatcher) insertAt(pos, size int) {
-	for i := 0; i < len(bp.jumps); i++ {
-		bp.jumps[i].InsertAt(pos, size)
+func (p *Patcher) replaceAt(pos, size, newSize int) {
+	for i := 0; i < len(p.jumps); i++ {
+		p.jumps[i].ReplaceAt(pos, size, newSize)
 	}
-	bp.smap.InsertAt(pos, size)
+	p.smap.ReplaceAt(pos, size, newSize)
 }
 
-func (bp *bytecodePatcher) updateJumps() error {
+func (p *Patcher) updateJumps() error {
 	operands := make([]int, 0, 2)
-	for _, v := range bp.jumps {
+	for _, v := range p.jumps {
+		if v.removed {
+			continue
+		}
+		if v.jump >= len(p.newInsts) {
+			msg := "updateJumps: %s at %d jumps out of instructions: %d"
+			return fmt.Errorf(msg, ugo.OpcodeNames[v.opcode], v.pos, v.jump)
+		}
 		if !v.updated {
 			continue
 		}
-		if bp.newInsts[v.pos] != v.opcode {
+		if p.newInsts[v.pos] != v.opcode {
 			msg := "updateJumps: opcodes expected: %d, got: %d"
-			return fmt.Errorf(msg, v.opcode, bp.newInsts[v.pos])
+			return fmt.Errorf(msg, v.opcode, p.newInsts[v.pos])
 		}
 		operands, _ = ugo.ReadOperands(
 			ugo.OpcodeOperands[v.opcode],
-			bp.newInsts[v.pos+1:],
+			p.newInsts[v.pos+1:],
 			operands,
 		)
 		operands[v.operand] = v.jump
@@ -257,19 +277,20 @@ func (bp *bytecodePatcher) updateJumps() error {
 		if err != nil {
 			return fmt.Errorf("updateJumps: %w", err)
 		}
-		copy(bp.newInsts[v.pos:], insts)
+		copy(p.newInsts[v.pos:], insts)
 	}
 	return nil
 }
 
 // posJump holds the jump instructions data to be able to update position and
-// jump target positions when instructions are inserted.
+// jump target positions when instructions are inserted, replaced or removed.
 type posJump struct {
 	pos     int
 	jump    int
 	opcode  byte
 	operand byte
 	updated bool
+	removed bool
 }
 
 func (pj *posJump) InsertAt(pos, size int) {
@@ -284,18 +305,67 @@ func (pj *posJump) InsertAt(pos, size int) {
 	pj.jump += size
 }
 
-// instsIterator is a lazy instructions iterator that gets operands on demand.
+func (pj *posJump) PrependAt(pos, size int) {
+	if pj.pos >= pos {
+		pj.updated = true
+		pj.pos += size
+	}
+	if pj.jump <= pos {
+		return
+	}
+	pj.updated = true
+	pj.jump += size
+}
+
+func (pj *posJump) ReplaceAt(pos, size, newSize int) {
+	end := pos + size
+	if pj.pos >= pos && pj.pos < end {
+		// jump instruction itself is replaced or removed
+		pj.removed = true
+		return
+	}
+	if pj.pos >= end {
+		pj.updated = true
+		pj.pos += newSize - size
+	}
+	if pj.opcode == ugo.OpSetupTry && pj.jump == 0 {
+		return
+	}
+	if pj.jump >= end {
+		pj.updated = true
+		pj.jump += newSize - size
+	} else if pj.jump > pos {
+		pj.updated = true
+		pj.jump = pos
+	}
+}
+
+// Iterator is a lazy instructions iterator that gets operands on demand.
 // Use Reset method to re-use the same instance.
-type instsIterator struct {
+type Iterator struct {
 	pos      int
 	insts    []byte
 	opcode   ugo.Opcode
 	operands []int
 	offset   int
 	err      error
+	fn       *ugo.CompiledFunction
+	fnIndex  int
 }
 
-func (it *instsIterator) Next() bool {
+// NewIterator returns a new Iterator for given instructions.
+func NewIterator(insts []byte) *Iterator {
+	return &Iterator{
+		insts:    insts,
+		operands: make([]int, 4),
+		fnIndex:  -1,
+	}
+}
+
+// Next moves the iterator to the next instruction and reports whether there is
+// an instruction to read. It returns false and sets Error if the opcode is
+// invalid or its operands exceed the instructions.
+func (it *Iterator) Next() bool {
 	if it.pos >= len(it.insts) || it.err != nil {
 		return false
 	}
@@ -306,15 +376,22 @@ func (it *instsIterator) Next() bool {
 	}
 	it.offset = opWidths[it.opcode]
 	it.pos += it.offset + 1
+	if it.pos > len(it.insts) {
+		it.err = fmt.Errorf("%s operands exceed instructions at %d",
+			ugo.OpcodeNames[it.opcode], it.Pos())
+		return false
+	}
 	return true
 }
 
-func (it *instsIterator) Opcode() ugo.Opcode {
+// Opcode returns the opcode of the current instruction.
+func (it *Iterator) Opcode() ugo.Opcode {
 	return it.opcode
 }
 
+// Operands returns the operands of the current instruction.
 // Returning slice is reused at next call, copy if required.
-func (it *instsIterator) Operands() []int {
+func (it *Iterator) Operands() []int {
 	it.operands, _ = ugo.ReadOperands(
 		ugo.OpcodeOperands[it.opcode],
 		it.insts[it.pos-it.offset:],
@@ -323,19 +400,37 @@ func (it *instsIterator) Operands() []int {
 	return it.operands
 }
 
-func (it *instsIterator) Offset() int {
+// Offset returns the total width of the operands of the current instruction.
+func (it *Iterator) Offset() int {
 	return it.offset
 }
 
-func (it *instsIterator) Pos() int {
+// Pos returns the position of the current instruction.
+func (it *Iterator) Pos() int {
 	return it.pos - it.offset - 1
 }
 
-func (it *instsIterator) Error() error {
+// Error returns the error occurred while iterating, if any.
+func (it *Iterator) Error() error {
 	return it.err
 }
 
-func (it *instsIterator) Reset(insts []byte) {
+// Func returns the function owning the instructions if iterator is used by
+// Patcher, otherwise it returns nil. Instructions of the function are not
+// modified until all instructions of the function are visited.
+func (it *Iterator) Func() *ugo.CompiledFunction {
+	return it.fn
+}
+
+// FuncIndex returns the constant index of the function owning the
+// instructions. It returns -1 for the main function of ugo.Bytecode or if
+// iterator is not used by Patcher.
+func (it *Iterator) FuncIndex() int {
+	return it.fnIndex
+}
+
+// Reset resets the iterator to iterate given instructions.
+func (it *Iterator) Reset(insts []byte) {
 	it.pos = 0
 	it.insts = insts
 	it.err = nil
@@ -371,6 +466,35 @@ func (sm *sourceMapper) InsertAt(pos, size int) {
 	}
 }
 
+func (sm *sourceMapper) PrependAt(pos, size int) {
+	for i, v := range sm.keys {
+		if v > pos {
+			sm.keys[i] = v + size
+		}
+	}
+}
+
+func (sm *sourceMapper) ReplaceAt(pos, size, newSize int) {
+	end := pos + size
+	var n int
+	for i, v := range sm.keys {
+		if v >= end {
+			v += newSize - size
+		} else if v >= pos {
+			if newSize == 0 {
+				// instruction is removed, drop its position
+				continue
+			}
+			v = pos
+		}
+		sm.keys[n] = v
+		sm.values[n] = sm.values[i]
+		n++
+	}
+	sm.keys = sm.keys[:n]
+	sm.values = sm.values[:n]
+}
+
 func (sm *sourceMapper) MakeSourceMap() map[int]int {
 	m := make(map[int]int, len(sm.keys))
 	for i, v := range sm.keys {
@@ -390,3 +514,32 @@ func getOpWidths() (opWidths []int) {
 	}
 	return opWidths
 }
+
+// makeCallInsts returns the instructions calling the constant at fnIndex with
+// the constants at argIndexes as arguments and popping the result.
+func makeCallInsts(fnIndex int, argIndexes ...int) ([]byte, error) {
+	insts := make([]byte, 0, 3*(len(argIndexes)+1)+3+1)
+	b := make([]byte, 8)
+	b, err := ugo.MakeInstruction(b, ugo.OpConstant, fnIndex)
+	if err != nil {
+		return nil, err
+	}
+	insts = append(insts, b...)
+	for _, idx := range argIndexes {
+		b, err = ugo.MakeInstruction(b, ugo.OpConstant, idx)
+		if err != nil {
+			return nil, err
+		}
+		insts = append(insts, b...)
+	}
+	b, err = ugo.MakeInstruction(b, ugo.OpCall, len(argIndexes), 0)
+	if err != nil {
+		return nil, err
+	}
+	insts = append(insts, b...)
+	b, err = ugo.MakeInstruction(b, ugo.OpPop)
+	if err != nil {
+		return nil, err
+	}
+	return append(insts, b...), nil
+}
@@ -2,9 +2,12 @@ package patcher_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -236,6 +239,263 @@ SourceMap:map[7:8 10:3 12:11 21:25 23:19 25:30 26:42 28:11 30:0]
 	})
 }
 
+func TestPatchForGoschedContext(t *testing.T) {
+	// error thrown in the function is caught but the one thrown before the
+	// backward jump of the loop is not
+	script := `
+f := func() {}
+for {
+	try {
+		f()
+	} catch err {
+	}
+}`
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Millisecond)
+		defer cancel()
+
+		n, err := patcher.PatchForGoschedContext(ctx, bc, 100)
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+
+		_, err = NewVM(bc).Run(nil)
+		require.Error(t, err)
+		require.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+		require.Contains(t, err.Error(), "script canceled")
+	})
+
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := patcher.PatchForGoschedContext(ctx, bc, 100)
+		require.NoError(t, err)
+		_, err = NewVM(bc).Run(nil)
+		require.True(t, errors.Is(err, context.Canceled), "%v", err)
+	})
+
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		_, err := patcher.PatchForGoschedContext(context.Background(), bc, 1)
+		require.NoError(t, err)
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(1), ret)
+	})
+}
+
+func TestPatcher(t *testing.T) {
+	opts := CompilerOptions{}
+	expectCompile(t, `
+	f := func(a) {
+		if a > 1 {
+			return a
+		}
+		return a + 1
+	}
+	return f(1) + f(2)
+	`, opts, func(bc *Bytecode) {
+		var numCalls int
+		counter := &Function{
+			Name: "counter",
+			Value: func(args ...Object) (Object, error) {
+				numCalls++
+				return Undefined, nil
+			},
+		}
+		constIndex := len(bc.Constants)
+		insert := concatInsts(
+			makeInst(OpConstant, constIndex),
+			makeInst(OpCall, 0, 0),
+			makeInst(OpPop),
+		)
+
+		var numReturns int
+		visited := map[int]*CompiledFunction{}
+		p := patcher.New(bc, func(it *patcher.Iterator) (patcher.Op, []byte) {
+			visited[it.FuncIndex()] = it.Func()
+			if it.Opcode() == OpReturn {
+				numReturns++
+				return patcher.InsertBefore, insert
+			}
+			return patcher.Next, nil
+		})
+		require.NoError(t, p.Patch())
+		bc.Constants = append(bc.Constants, counter)
+
+		require.Equal(t, 3, numReturns)
+		require.Len(t, visited, 2)
+		require.Same(t, bc.Main, visited[-1])
+		for i, f := range visited {
+			if i >= 0 {
+				require.Same(t, bc.Constants[i], f)
+			}
+		}
+
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(4), ret)
+		require.Equal(t, 3, numCalls)
+	})
+}
+
+func TestPatcherOps(t *testing.T) {
+	bc := &Bytecode{
+		Main: &CompiledFunction{
+			Instructions: concatInsts(
+				makeInst(OpNoOp),
+				makeInst(OpFalse),
+				makeInst(OpJumpFalsy, 12),
+				makeInst(OpConstant, 0),
+				makeInst(OpReturn, 1),
+				makeInst(OpNoOp),
+				makeInst(OpConstant, 1),
+				makeInst(OpReturn, 1),
+			),
+			SourceMap: map[int]int{
+				0: 1, 1: 2, 2: 3, 7: 4, 10: 5, 12: 6, 13: 7, 16: 8,
+			},
+		},
+		Constants: []Object{Int(10), Int(20), Int(30)},
+	}
+	replace := makeInst(OpConstant, 1)
+	insert := concatInsts(makeInst(OpPop), makeInst(OpConstant, 2))
+	err := patcher.New(bc, func(it *patcher.Iterator) (patcher.Op, []byte) {
+		switch it.Opcode() {
+		case OpNoOp:
+			return patcher.Remove, nil
+		case OpConstant:
+			if it.Operands()[0] == 0 {
+				return patcher.Replace, replace
+			}
+			return patcher.InsertAfter, insert
+		}
+		return patcher.Next, nil
+	}).Patch()
+	require.NoError(t, err)
+	expectCompiledFunctionsEqual(t, bc.Main, &CompiledFunction{
+		Instructions: concatInsts(
+			makeInst(OpFalse),
+			makeInst(OpJumpFalsy, 11),
+			makeInst(OpConstant, 1),
+			makeInst(OpReturn, 1),
+			makeInst(OpConstant, 1),
+			makeInst(OpPop),
+			makeInst(OpConstant, 2),
+			makeInst(OpReturn, 1),
+		),
+		SourceMap: map[int]int{0: 2, 1: 3, 6: 4, 9: 5, 11: 7, 18: 8},
+	})
+	ret, err := NewVM(bc).Run(nil)
+	require.NoError(t, err)
+	require.Equal(t, Int(30), ret)
+
+	// Jumps targeting the current instruction target prepended instructions.
+	bc.Main = &CompiledFunction{
+		Instructions: concatInsts(
+			makeInst(OpFalse),
+			makeInst(OpJumpFalsy, 7),
+			makeInst(OpNull),
+			makeInst(OpTrue),
+			makeInst(OpReturn, 1),
+		),
+		SourceMap: map[int]int{6: 1, 7: 2, 8: 3},
+	}
+	err = patcher.New(bc, func(it *patcher.Iterator) (patcher.Op, []byte) {
+		if it.Opcode() == OpTrue {
+			return patcher.Prepend, makeInst(OpNoOp)
+		}
+		return patcher.Next, nil
+	}).Patch()
+	require.NoError(t, err)
+	expectCompiledFunctionsEqual(t, bc.Main, &CompiledFunction{
+		Instructions: concatInsts(
+			makeInst(OpFalse),
+			makeInst(OpJumpFalsy, 7),
+			makeInst(OpNull),
+			makeInst(OpNoOp),
+			makeInst(OpTrue),
+			makeInst(OpReturn, 1),
+		),
+		SourceMap: map[int]int{6: 1, 7: 2, 9: 3},
+	})
+
+	// Removed jump instructions are not tracked.
+	bc.Main = &CompiledFunction{
+		Instructions: concatInsts(
+			makeInst(OpJump, 5),
+			makeInst(OpTrue),
+			makeInst(OpReturn, 1),
+		),
+	}
+	err = patcher.New(bc, func(it *patcher.Iterator) (patcher.Op, []byte) {
+		if it.Opcode() == OpJump {
+			return patcher.Remove, nil
+		}
+		return patcher.Next, nil
+	}).Patch()
+	require.NoError(t, err)
+	require.Equal(t,
+		concatInsts(makeInst(OpTrue), makeInst(OpReturn, 1)),
+		bc.Main.Instructions,
+	)
+
+	// No instruction is left to jump to.
+	bc.Main = &CompiledFunction{
+		Instructions: concatInsts(
+			makeInst(OpJump, 5),
+			makeInst(OpNoOp),
+		),
+	}
+	err = patcher.New(bc, func(it *patcher.Iterator) (patcher.Op, []byte) {
+		if it.Opcode() == OpNoOp {
+			return patcher.Remove, nil
+		}
+		return patcher.Next, nil
+	}).Patch()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "jumps out of instructions")
+}
+
+func TestIterator(t *testing.T) {
+	insts := concatInsts(
+		makeInst(OpConstant, 1),
+		makeInst(OpSetupTry, 10, 20),
+		makeInst(OpPop),
+		makeInst(OpReturn, 0),
+	)
+	it := patcher.NewIterator(insts)
+	var got [][]int
+	var pos []int
+	for it.Next() {
+		pos = append(pos, it.Pos())
+		got = append(got,
+			append([]int{int(it.Opcode())}, it.Operands()...))
+	}
+	require.NoError(t, it.Error())
+	require.Nil(t, it.Func())
+	require.Equal(t, -1, it.FuncIndex())
+	require.Equal(t, []int{0, 3, 12, 13}, pos)
+	require.Equal(t, [][]int{
+		{int(OpConstant), 1},
+		{int(OpSetupTry), 10, 20},
+		{int(OpPop)},
+		{int(OpReturn), 0},
+	}, got)
+
+	it.Reset([]byte{255})
+	require.False(t, it.Next())
+	require.Error(t, it.Error())
+
+	// truncated operands are reported instead of panicking in Operands
+	it.Reset(concatInsts(makeInst(OpPop), makeInst(OpSetupTry, 10, 20)[:5]))
+	require.True(t, it.Next())
+	require.False(t, it.Next())
+	require.EqualError(t, it.Error(), "SETUPTRY operands exceed instructions at 1")
+
+	require.Panics(t, func() { patcher.New(&Bytecode{}, nil) })
+}
+
 func trimLines(s string) string {
 	lines := strings.Split(strings.TrimSpace(s), "\n")
 	for i := range lines {
@@ -315,7 +575,7 @@ func expectPatch(t *testing.T, actual *Bytecode, expected expectedPatch) {
 		require.NoError(t, err, "VM error")
 		require.Equal(t, Undefined, ret, "tests must return undefined")
 
-		numCalls := obj.(patcher.NumCallsGetter).NumCalls()
+		numCalls := obj.(patcher.Gosched).Stats().Calls
 		require.Equal(t, expected.numCalls, numCalls, "number of calls not equal")
 	}
 
@@ -0,0 +1,284 @@
+package patcher
+
+import (
+	"fmt"
+
+	"github.com/ozanh/ugo"
+)
+
+// Pass is a patch pass run by Pipeline. Passes having Visit are run together
+// in a single traversal of the instructions, passes having Apply are run
+// alone in their order.
+type Pass struct {
+	// Name identifies the pass in PipelineReport.
+	Name string
+	// Start is called before the traversal. Constants used by the inserted
+	// instructions must be added with given PassContext, which can also be
+	// used in Visit and Finish.
+	Start func(pc *PassContext) error
+	// Visit is called for each instruction of the original functions like
+	// PatchFunc. Instructions inserted by the other passes are not visited.
+	Visit func(it *Iterator) (Op, []byte, error)
+	// Finish is called after the traversal.
+	Finish func() error
+	// Apply patches the bytecode on its own if it is set, e.g. with one of
+	// the PatchFor functions.
+	Apply func(bc *ugo.Bytecode) error
+	// Key is the configuration of the pass changing the patched instructions
+	// or the encodable constants, which is used with Name in the key of
+	// Cache.
+	Key string
+	// Attach is called by Cache with the decoded bytecode and the constants
+	// added or replaced by the pass in their order after decoding a patched
+	// bytecode. The constants which cannot be encoded, i.e. the callables of
+	// the pass, are ugo.Undefined unless the pass set the objects to store in
+	// place of them, and Attach must set them to the callables of this pass.
+	// Passes adding such constants cannot be cached without Attach.
+	Attach func(bc *ugo.Bytecode, consts []ugo.Object) error
+}
+
+// ApplyPass returns a Pass calling fn to patch the bytecode on its own.
+func ApplyPass(name string, fn func(bc *ugo.Bytecode) error) Pass {
+	return Pass{Name: name, Apply: fn}
+}
+
+// attachConstants sets the first constants of a pass to given callables in
+// Pass.Attach.
+func attachConstants(consts []ugo.Object, callables ...ugo.Object) error {
+	if len(consts) < len(callables) {
+		return fmt.Errorf("attach: %d constants, want at least %d",
+			len(consts), len(callables))
+	}
+	copy(consts, callables)
+	return nil
+}
+
+// PassContext is passed to Pass.Start to add constants to the bytecode.
+type PassContext struct {
+	bc     *ugo.Bytecode
+	report *PassReport
+	start  *[]byte
+	end    *[]byte
+}
+
+// Bytecode returns the bytecode being patched.
+func (pc *PassContext) Bytecode() *ugo.Bytecode {
+	return pc.bc
+}
+
+// AddConstant appends given object to the constants of the bytecode and
+// returns its index.
+func (pc *PassContext) AddConstant(obj ugo.Object) int {
+	index := len(pc.bc.Constants)
+	pc.bc.Constants = append(pc.bc.Constants, obj)
+	pc.report.Constants = append(pc.report.Constants, index)
+	return index
+}
+
+// replaceConstant replaces the constant at given index with given object. The
+// index is added to the constants of the pass and the replaced object is
+// stored by Cache in place of the new one.
+func (pc *PassContext) replaceConstant(index int, obj ugo.Object) {
+	pc.setCached(index, pc.bc.Constants[index])
+	pc.bc.Constants[index] = obj
+	pc.report.Constants = append(pc.report.Constants, index)
+}
+
+// setCached sets the object stored by Cache in place of the constant of the
+// pass at given index, which is passed to Pass.Attach after decoding. It must
+// be encodable, e.g. the data to create a callable.
+func (pc *PassContext) setCached(index int, obj ugo.Object) {
+	if pc.report.cached == nil {
+		pc.report.cached = make(map[int]ugo.Object)
+	}
+	pc.report.cached[index] = obj
+}
+
+// addRunState adds given starter and ender as constants and reserves a run
+// state created by the starter, see runState. Ender can be nil. Instructions
+// to start the run are inserted at the start of the main function before the
+// edits of the passes, and the ones to end it right before the returns of the
+// main function after the edits of the passes, which are not counted in
+// PassReport.
+func (pc *PassContext) addRunState(
+	starter runStarter,
+	ender ugo.Object,
+) (runState, error) {
+	starterIndex, enderIndex := pc.AddConstant(starter), -1
+	if ender != nil {
+		enderIndex = pc.AddConstant(ender)
+	}
+	rs, err := newRunState(pc.bc, starterIndex, enderIndex)
+	if err != nil {
+		return rs, err
+	}
+	start, err := rs.startInsts()
+	if err != nil {
+		return rs, err
+	}
+	end, err := rs.endInsts()
+	if err != nil {
+		return rs, err
+	}
+	*pc.start = append(*pc.start, start...)
+	*pc.end = append(*pc.end, end...)
+	return rs, nil
+}
+
+// PipelineReport is the combined report of the passes run by Pipeline.
+type PipelineReport struct {
+	Passes []PassReport
+}
+
+// Pass returns the report of the first pass with given name, or nil if it is
+// not found.
+func (r *PipelineReport) Pass(name string) *PassReport {
+	for i := range r.Passes {
+		if r.Passes[i].Name == name {
+			return &r.Passes[i]
+		}
+	}
+	return nil
+}
+
+// PassReport is the report of a pass run by Pipeline. Edits are only counted
+// for the passes having Visit.
+type PassReport struct {
+	Name string
+	// Inserts is the number of instructions the pass inserted instructions at.
+	Inserts int
+	// Replaces is the number of instructions the pass replaced or removed.
+	Replaces int
+	// FuncInserts is the number of inserts per function keyed by the constant
+	// index of the function, -1 for the main function.
+	FuncInserts map[int]int
+	// Constants is the indexes of the constants added or replaced by the pass
+	// in order.
+	Constants []int
+	// cached holds the objects stored by Cache in place of the constants.
+	cached map[int]ugo.Object
+}
+
+// Pipeline runs patch passes in the given order. Consecutive passes having
+// Visit are run in a single traversal. Passes are visited in their order for
+// each instruction, instructions of InsertBefore edits are placed first,
+// followed by the ones of Prepend edits, the instruction or its replacement,
+// and the ones of InsertAfter edits. Only a single pass can replace or remove
+// an instruction, Run fails if another pass replaces or removes it in the same
+// traversal. Constants are appended in the order the passes add them,
+// i.e. the constants added in Start in the order of passes, followed by the
+// ones added during the traversal in the order of instructions, which is
+// deterministic for the same bytecode and passes.
+type Pipeline struct {
+	passes []Pass
+}
+
+// NewPipeline returns a new Pipeline running given passes.
+func NewPipeline(passes ...Pass) *Pipeline {
+	return &Pipeline{passes: passes}
+}
+
+// Add appends given passes to the pipeline.
+func (pl *Pipeline) Add(passes ...Pass) *Pipeline {
+	pl.passes = append(pl.passes, passes...)
+	return pl
+}
+
+// Run runs the passes on given ugo.Bytecode. If error is returned, given
+// ugo.Bytecode must be discarded due to invalid patching.
+func (pl *Pipeline) Run(bc *ugo.Bytecode) (*PipelineReport, error) {
+	report := &PipelineReport{Passes: make([]PassReport, len(pl.passes))}
+	for i := 0; i < len(pl.passes); {
+		report.Passes[i].Name = pl.passes[i].Name
+		if apply := pl.passes[i].Apply; apply != nil {
+			numConsts := len(bc.Constants)
+			if err := apply(bc); err != nil {
+				return nil, fmt.Errorf("%s pass: %w", pl.passes[i].Name, err)
+			}
+			for j := numConsts; j < len(bc.Constants); j++ {
+				report.Passes[i].Constants = append(report.Passes[i].Constants, j)
+			}
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(pl.passes) && pl.passes[j].Apply == nil {
+			report.Passes[j].Name = pl.passes[j].Name
+			j++
+		}
+		if err := runPasses(bc, pl.passes[i:j], report.Passes[i:j]); err != nil {
+			return nil, err
+		}
+		i = j
+	}
+	if err := debugVerify(bc); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func runPasses(bc *ugo.Bytecode, passes []Pass, reports []PassReport) error {
+	var start, end []byte
+	for i, pass := range passes {
+		reports[i].FuncInserts = make(map[int]int)
+		if pass.Start == nil {
+			continue
+		}
+		pc := &PassContext{bc: bc, report: &reports[i], start: &start, end: &end}
+		if err := pass.Start(pc); err != nil {
+			return fmt.Errorf("%s pass: %w", pass.Name, err)
+		}
+	}
+
+	p := newPatcher(bc)
+	edits := make([]patchEdit, 0, len(passes))
+	p.editor = func(it *Iterator) ([]patchEdit, error) {
+		edits = edits[:0]
+		if len(start) > 0 && it.FuncIndex() < 0 && it.Pos() == 0 {
+			edits = append(edits, patchEdit{op: InsertBefore, insts: start})
+		}
+		replacer := -1
+		for i, pass := range passes {
+			if pass.Visit == nil {
+				continue
+			}
+			op, insts, err := pass.Visit(it)
+			if err != nil {
+				return nil, fmt.Errorf("%s pass: %w", pass.Name, err)
+			}
+			switch op {
+			case Next:
+				continue
+			case Replace, Remove:
+				if replacer >= 0 {
+					return nil, fmt.Errorf(
+						"%s pass: instruction at %d is already replaced by %s pass",
+						pass.Name, it.Pos(), passes[replacer].Name)
+				}
+				replacer = i
+				reports[i].Replaces++
+			default:
+				reports[i].Inserts++
+				reports[i].FuncInserts[it.FuncIndex()]++
+			}
+			edits = append(edits, patchEdit{op: op, insts: insts})
+		}
+		if len(end) > 0 && it.FuncIndex() < 0 && it.Opcode() == ugo.OpReturn {
+			edits = append(edits, patchEdit{op: Prepend, insts: end})
+		}
+		return edits, nil
+	}
+	if err := p.Patch(); err != nil {
+		return err
+	}
+
+	for _, pass := range passes {
+		if pass.Finish == nil {
+			continue
+		}
+		if err := pass.Finish(); err != nil {
+			return fmt.Errorf("%s pass: %w", pass.Name, err)
+		}
+	}
+	return nil
+}
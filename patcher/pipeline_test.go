@@ -0,0 +1,153 @@
+package patcher_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPipeline(t *testing.T) {
+	script := `f := func(x) {
+	return x * 2
+}
+sum := 0
+for i := 0; i < 10; i++ {
+	sum += f(i)
+}
+return sum`
+
+	run := func(t *testing.T) (*Bytecode, *patcher.PipelineReport,
+		patcher.Gosched, *patcher.InstructionMeter, *patcher.Coverage) {
+		t.Helper()
+		var bc *Bytecode
+		expectCompile(t, script, CompilerOptions{}, func(b *Bytecode) { bc = b })
+		goschedPass, g := patcher.GoschedPass(patcher.GoschedOptions{CallThreshold: 5})
+		limitPass, m := patcher.InstructionLimitPass(1000)
+		coveragePass, cov := patcher.CoveragePass()
+		report, err := patcher.NewPipeline(goschedPass, limitPass).
+			Add(coveragePass).
+			Run(bc)
+		require.NoError(t, err)
+		return bc, report, g, m, cov
+	}
+
+	bc, report, g, m, cov := run(t)
+	ret, err := NewVM(bc).Run(nil)
+	require.NoError(t, err)
+	require.Equal(t, Int(90), ret)
+	require.Equal(t, uint64(1+10+10), g.Stats().Calls)
+	require.Greater(t, m.Used(), uint64(0))
+	require.NotEmpty(t, cov.Lines())
+
+	require.Len(t, report.Passes, 3)
+	gosched := report.Pass("gosched")
+	require.Equal(t, 3, gosched.Inserts)
+	require.Equal(t, map[int]int{-1: 2, 1: 1}, gosched.FuncInserts)
+	require.Len(t, gosched.Constants, 1)
+	limit := report.Pass("instruction-limit")
+	coverage := report.Pass("coverage")
+	require.Equal(t, limit.Inserts, coverage.Inserts)
+	require.Equal(t, limit.FuncInserts, coverage.FuncInserts)
+	require.Nil(t, report.Pass("unknown"))
+
+	// the same number of instructions are executed as running patches one
+	// by one
+	expectCompile(t, script, CompilerOptions{}, func(bc2 *Bytecode) {
+		m2, err := patcher.PatchForInstructionLimit(bc2, 1000)
+		require.NoError(t, err)
+		_, err = NewVM(bc2).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, m2.Used(), m.Used())
+	})
+
+	// constants are in deterministic order
+	bc2, report2, _, _, _ := run(t)
+	require.Equal(t, report, report2)
+	require.Equal(t, len(bc.Constants), len(bc2.Constants))
+	for i := range bc.Constants {
+		require.Equal(t, fmt.Sprintf("%T %s", bc.Constants[i], bc.Constants[i]),
+			fmt.Sprintf("%T %s", bc2.Constants[i], bc2.Constants[i]))
+	}
+	require.Equal(t, bc.Main.Instructions, bc2.Main.Instructions)
+}
+
+func TestPipelineEdits(t *testing.T) {
+	visit := func(name string, op patcher.Op, match func(it *patcher.Iterator) bool,
+		insts []byte) patcher.Pass {
+		return patcher.Pass{
+			Name: name,
+			Visit: func(it *patcher.Iterator) (patcher.Op, []byte, error) {
+				if match(it) {
+					return op, insts, nil
+				}
+				return patcher.Next, nil, nil
+			},
+		}
+	}
+	isReturn := func(it *patcher.Iterator) bool { return it.Opcode() == OpReturn }
+
+	// edits are ordered by op and passes
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		_, err := patcher.NewPipeline(
+			visit("after", patcher.InsertAfter, isReturn, makeInst(OpTrue)),
+			visit("prepend", patcher.Prepend, isReturn, makeInst(OpNull)),
+			visit("before1", patcher.InsertBefore, isReturn, makeInst(OpFalse)),
+			visit("replace", patcher.Replace, isReturn, makeInst(OpReturn, 0)),
+			visit("before2", patcher.InsertBefore, isReturn, makeInst(OpPop)),
+		).Run(bc)
+		require.NoError(t, err)
+		require.Equal(t, concatInsts(
+			makeInst(OpConstant, 0),
+			makeInst(OpFalse),
+			makeInst(OpPop),
+			makeInst(OpNull),
+			makeInst(OpReturn, 0),
+			makeInst(OpTrue),
+		), bc.Main.Instructions)
+	})
+
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		_, err := patcher.NewPipeline(
+			visit("replace", patcher.Replace, isReturn, makeInst(OpReturn, 0)),
+			visit("remove", patcher.Remove, isReturn, nil),
+		).Run(bc)
+		require.EqualError(t, err,
+			"remove pass: instruction at 3 is already replaced by replace pass")
+	})
+
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		var applied bool
+		report, err := patcher.NewPipeline(
+			patcher.ApplyPass("apply", func(bc *Bytecode) error {
+				applied = true
+				bc.Constants = append(bc.Constants, Int(2))
+				return nil
+			}),
+			patcher.Pass{
+				Name: "failing",
+				Visit: func(it *patcher.Iterator) (patcher.Op, []byte, error) {
+					return patcher.Next, nil, fmt.Errorf("visit error")
+				},
+			},
+		).Run(bc)
+		require.True(t, applied)
+		require.Nil(t, report)
+		require.EqualError(t, err, "failing pass: visit error")
+	})
+
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		report, err := patcher.NewPipeline(
+			patcher.ApplyPass("apply", func(bc *Bytecode) error {
+				bc.Constants = append(bc.Constants, Int(2))
+				return nil
+			}),
+		).Run(bc)
+		require.NoError(t, err)
+		require.Equal(t, []int{1}, report.Passes[0].Constants)
+	})
+}
@@ -0,0 +1,236 @@
+package patcher
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+)
+
+// ErrForbidden is the error matched by ForbiddenError with errors.Is.
+var ErrForbidden = errors.New("forbidden by policy")
+
+// List of policy violation kinds.
+const (
+	PolicyBuiltin = "builtin"
+	PolicyModule  = "module"
+)
+
+// ForbiddenError is the error thrown by the callables added by PatchForPolicy
+// in place of forbidden builtins and modules. Errors returned from ugo.VM wrap
+// it, use errors.As to get it.
+type ForbiddenError struct {
+	// Kind is one of PolicyBuiltin and PolicyModule.
+	Kind string
+	Name string
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("%s: %s %q", ErrForbidden, e.Kind, e.Name)
+}
+
+// Is reports whether target is ErrForbidden.
+func (e *ForbiddenError) Is(target error) bool {
+	return target == ErrForbidden
+}
+
+// Policy restricts the builtins and modules used by a script.
+type Policy struct {
+	// AllowedBuiltins is the names of the builtins allowed to be used. All
+	// builtins are allowed if it is nil.
+	AllowedBuiltins []string
+	// AllowedModules is the names of the modules allowed to be imported. All
+	// modules are allowed if it is nil. Builtin modules are named after their
+	// AttrModuleName attribute and source modules are named after the file
+	// name of their source positions, which is the import name for modules
+	// of ugo.ModuleMap.
+	AllowedModules []string
+	// MaxCallDepth limits the depth of the calls of compiled functions
+	// including the main function if greater than zero. Entering a function
+	// deeper than the limit throws a *CallDepthError like PatchForCallDepth.
+	// Note that tail call optimization of the VM is disabled if it is set.
+	MaxCallDepth int
+}
+
+// PolicyViolation is a reference to a forbidden builtin or module found by
+// PatchForPolicy.
+type PolicyViolation struct {
+	// Kind is one of PolicyBuiltin and PolicyModule.
+	Kind   string
+	Name   string
+	Pos    parser.Pos
+	File   string
+	Line   int
+	Column int
+}
+
+func (v PolicyViolation) String() string {
+	if v.File == "" && v.Line == 0 {
+		return fmt.Sprintf("forbidden %s %q", v.Kind, v.Name)
+	}
+	return fmt.Sprintf("%s:%d:%d: forbidden %s %q",
+		v.File, v.Line, v.Column, v.Kind, v.Name)
+}
+
+// PatchForPolicy modifies given ugo.Bytecode to replace the loads of the
+// builtins and the imports of the modules forbidden by given policy with
+// calls throwing a *ForbiddenError, and to limit the call depth if set.
+// Returned violations are ordered by function and instruction positions, it is
+// not nil if any forbidden name is referenced, which allows rejecting the
+// script before running it. If error is returned, given ugo.Bytecode must be
+// discarded due to invalid patching.
+func PatchForPolicy(bc *ugo.Bytecode, policy Policy) ([]PolicyViolation, error) {
+	// Replace loads of forbidden builtins with the following instructions.
+	/*
+		0000 CONSTANT <forbidden index>
+		0000 CALL 0 0
+	*/
+	// Replace loads of forbidden modules with the following instructions
+	// which push a falsy value like a cached module for the subsequent jump.
+	/*
+		0000 CONSTANT <forbidden index>
+		0000 CALL 0 0
+		0000 NULL
+	*/
+
+	builtinNames := make(map[ugo.BuiltinType]string, len(ugo.BuiltinsMap))
+	for name, typ := range ugo.BuiltinsMap {
+		builtinNames[typ] = name
+	}
+	allowedBuiltins := makeStringSet(policy.AllowedBuiltins)
+	allowedModules := makeStringSet(policy.AllowedModules)
+
+	constIndex := len(bc.Constants)
+	var forbidden []ugo.Object
+	forbiddenIndexes := make(map[ForbiddenError]int)
+	var violations []PolicyViolation
+	var err error
+
+	forbid := func(it *Iterator, kind, name string) []byte {
+		fe := ForbiddenError{Kind: kind, Name: name}
+		index, ok := forbiddenIndexes[fe]
+		if !ok {
+			index = constIndex + len(forbidden)
+			forbiddenIndexes[fe] = index
+			forbidden = append(forbidden, &policyForbidden{err: fe})
+		}
+		v := PolicyViolation{
+			Kind: kind,
+			Name: name,
+			Pos:  parser.Pos(it.Func().SourceMap[it.Pos()]),
+		}
+		if bc.FileSet != nil && v.Pos.IsValid() {
+			p := bc.FileSet.Position(v.Pos)
+			v.File, v.Line, v.Column = p.Filename, p.Line, p.Column
+		}
+		violations = append(violations, v)
+
+		var insts []byte
+		if insts, err = makeCallInsts(index); err != nil {
+			return nil
+		}
+		// drop POP
+		return insts[:len(insts)-1]
+	}
+
+	p := New(bc, func(it *Iterator) (Op, []byte) {
+		if err != nil {
+			return Next, nil
+		}
+		operands := it.Operands()
+		switch it.Opcode() {
+		case ugo.OpGetBuiltin:
+			if allowedBuiltins == nil {
+				break
+			}
+			name, ok := builtinNames[ugo.BuiltinType(operands[0])]
+			if !ok {
+				name = fmt.Sprintf("builtin#%d", operands[0])
+			}
+			if _, ok := allowedBuiltins[name]; !ok {
+				return Replace, forbid(it, PolicyBuiltin, name)
+			}
+		case ugo.OpLoadModule:
+			if allowedModules == nil || isRunStateLoad(bc, operands[0]) {
+				break
+			}
+			name := moduleName(bc, operands[0])
+			if _, ok := allowedModules[name]; !ok {
+				insts := forbid(it, PolicyModule, name)
+				return Replace, append(insts, byte(ugo.OpNull))
+			}
+		}
+		return Next, nil
+	})
+	if err2 := p.Patch(); err2 != nil {
+		return nil, err2
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bc.Constants = append(bc.Constants, forbidden...)
+	if policy.MaxCallDepth > 0 {
+		if err := PatchForCallDepth(bc, policy.MaxCallDepth); err != nil {
+			return nil, err
+		}
+	}
+	if err := debugVerify(bc); err != nil {
+		return nil, err
+	}
+	return violations, nil
+}
+
+// moduleName returns the name of the module at given constant index, or an
+// empty string if it is unknown.
+func moduleName(bc *ugo.Bytecode, index int) string {
+	if index >= len(bc.Constants) {
+		return ""
+	}
+	switch v := bc.Constants[index].(type) {
+	case ugo.Map:
+		if name, ok := v[ugo.AttrModuleName].(ugo.String); ok {
+			return string(name)
+		}
+	case *ugo.CompiledFunction:
+		if _, pos := FuncName(bc.FileSet, v, index); pos.IsValid() &&
+			bc.FileSet != nil {
+			return bc.FileSet.Position(pos).Filename
+		}
+	}
+	return ""
+}
+
+func makeStringSet(list []string) map[string]struct{} {
+	if list == nil {
+		return nil
+	}
+	set := make(map[string]struct{}, len(list))
+	for _, s := range list {
+		set[s] = struct{}{}
+	}
+	return set
+}
+
+// policyForbidden is the callable added to ugo.Bytecode by PatchForPolicy to
+// throw an error in place of a forbidden builtin or module.
+type policyForbidden struct {
+	ugo.ObjectImpl
+	err ForbiddenError
+}
+
+var _ ugo.ExCallerObject = (*policyForbidden)(nil)
+
+func (f *policyForbidden) String() string   { return "<forbidden>" }
+func (f *policyForbidden) TypeName() string { return f.String() }
+func (f *policyForbidden) CanCall() bool    { return true }
+
+func (f *policyForbidden) Call(args ...ugo.Object) (ugo.Object, error) {
+	return f.CallEx(ugo.Call{})
+}
+
+func (f *policyForbidden) CallEx(_ ugo.Call) (ugo.Object, error) {
+	err := f.err
+	return ugo.Undefined, &err
+}
@@ -0,0 +1,153 @@
+package patcher_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+	ugotime "github.com/ozanh/ugo/stdlib/time"
+)
+
+func TestPatchForPolicy(t *testing.T) {
+	script := `time := import("time")
+mod := import("mod")
+x := len("abc")
+if x > 10 {
+	printf("%d\n", x)
+}
+return [x, typeName(time), mod]`
+
+	opts := CompilerOptions{
+		ModulePath: "(main)",
+		ModuleMap: NewModuleMap().
+			AddBuiltinModule("time", ugotime.Module).
+			AddSourceModule("mod", []byte(`x := 1; return string(x)`)),
+	}
+
+	// everything is allowed
+	expectCompile(t, script, opts, func(bc *Bytecode) {
+		violations, err := patcher.PatchForPolicy(bc, patcher.Policy{})
+		require.NoError(t, err)
+		require.Nil(t, violations)
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Array{Int(3), String("map"), String("1")}, ret)
+	})
+
+	expectCompile(t, script, opts, func(bc *Bytecode) {
+		violations, err := patcher.PatchForPolicy(bc, patcher.Policy{
+			AllowedBuiltins: []string{"len", "typeName"},
+			AllowedModules:  []string{"mod"},
+		})
+		require.NoError(t, err)
+		require.Len(t, violations, 3)
+		require.Equal(t, patcher.PolicyViolation{
+			Kind:   patcher.PolicyModule,
+			Name:   "time",
+			Pos:    violations[0].Pos,
+			File:   "(main)",
+			Line:   1,
+			Column: 9,
+		}, violations[0])
+		require.Equal(t, `(main):1:9: forbidden module "time"`,
+			violations[0].String())
+		require.Equal(t, `(main):5:2: forbidden builtin "printf"`,
+			violations[1].String())
+		// builtins of source modules are checked too
+		require.Equal(t, `mod:1:16: forbidden builtin "string"`,
+			violations[2].String())
+
+		_, err = NewVM(bc).Run(nil)
+		require.Error(t, err)
+		require.True(t, errors.Is(err, patcher.ErrForbidden))
+		var ferr *patcher.ForbiddenError
+		require.True(t, errors.As(err, &ferr))
+		require.Equal(t, patcher.ForbiddenError{
+			Kind: patcher.PolicyModule, Name: "time"}, *ferr)
+		require.Equal(t, `forbidden by policy: module "time"`, ferr.Error())
+	})
+
+	// forbidden builtin is thrown only if it is reached
+	expectCompile(t, `x := len("a"); if x > 1 { println(x) }; return x`,
+		CompilerOptions{}, func(bc *Bytecode) {
+			violations, err := patcher.PatchForPolicy(bc, patcher.Policy{
+				AllowedBuiltins: []string{"len"},
+			})
+			require.NoError(t, err)
+			require.Len(t, violations, 1)
+			ret, err := NewVM(bc).Run(nil)
+			require.NoError(t, err)
+			require.Equal(t, Int(1), ret)
+		})
+
+	// all modules are forbidden
+	expectCompile(t, script, opts, func(bc *Bytecode) {
+		violations, err := patcher.PatchForPolicy(bc, patcher.Policy{
+			AllowedModules: []string{},
+		})
+		require.NoError(t, err)
+		require.Len(t, violations, 2)
+		require.Equal(t, "mod", violations[1].Name)
+	})
+
+	// states of runs kept in the module cache are not modules
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		_, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+			CallThreshold: 10,
+			PerRun:        true,
+		})
+		require.NoError(t, err)
+		violations, err := patcher.PatchForPolicy(bc, patcher.Policy{
+			AllowedModules: []string{},
+		})
+		require.NoError(t, err)
+		require.Empty(t, violations)
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(1), ret)
+	})
+}
+
+func TestPatchForPolicyCallDepth(t *testing.T) {
+	script := `
+var f
+f = func(n) {
+	if n == 0 {
+		return 0
+	}
+	return f(n-1) + 1
+}
+g := func() { throw "error" }
+for i := 0; i < 100; i++ {
+	try {
+		g()
+	} catch err {
+	}
+}
+return f(n)`
+
+	run := func(t *testing.T, limit int, n Int) (Object, error) {
+		t.Helper()
+		var ret Object
+		var err error
+		expectCompile(t, "param n\n"+script, CompilerOptions{}, func(bc *Bytecode) {
+			_, err = patcher.PatchForPolicy(bc, patcher.Policy{MaxCallDepth: limit})
+			require.NoError(t, err)
+			ret, err = NewVM(bc).Run(nil, n)
+		})
+		return ret, err
+	}
+
+	// main and f(0) to f(8)
+	ret, err := run(t, 10, 8)
+	require.NoError(t, err)
+	require.Equal(t, Int(8), ret)
+
+	_, err = run(t, 10, 9)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, patcher.ErrCallDepth), "%v", err)
+}
@@ -0,0 +1,464 @@
+package patcher
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+)
+
+// PatchForProfile modifies given ugo.Bytecode to add callables recording call
+// counts and elapsed time of functions and source lines. Calls to the
+// callables are inserted at function entries, before returns and at the first
+// instruction of each source line. Returned Profile reports statistics after
+// running the ugo.Bytecode and exports them in pprof format. Note that tail
+// call optimization of the VM is disabled by this patch. If error is returned,
+// given ugo.Bytecode must be discarded due to invalid patching.
+func PatchForProfile(bc *ugo.Bytecode) (*Profile, error) {
+	prof := &Profile{
+		fileSet: bc.FileSet,
+		now:     time.Now,
+	}
+	var pf *profFunc
+	hooks := Hooks{
+		Enter: func(fn *ugo.CompiledFunction, index int) ugo.Object {
+			pf = prof.addFunc(fn, index)
+			return &profSite{prof: prof, fn: pf}
+		},
+		Line: func(pos parser.Pos, _ ugo.Opcode) ugo.Object {
+			return &profSite{prof: prof, fn: pf, line: prof.addLine(pf, pos)}
+		},
+		Exit: func() ugo.Object {
+			return &profSite{prof: prof, fn: pf, exit: true}
+		},
+	}
+	prof.stack.SetUnwindHooks(&hooks, &prof.mu, prof.drop)
+	if err := PatchForHooks(bc, hooks); err != nil {
+		return nil, err
+	}
+	return prof, nil
+}
+
+// Profile holds the statistics of a ugo.Bytecode patched by PatchForProfile.
+// Statistics are recorded for a single VM at a time, running the same patched
+// ugo.Bytecode concurrently results in inaccurate times.
+type Profile struct {
+	mu      sync.Mutex
+	fileSet *parser.SourceFileSet
+	now     func() time.Time
+	funcs   []*profFunc
+	lines   []*profLine
+	root    profNode
+	stack   CallStack[profFrame]
+	cur     *profNode
+	last    time.Time
+	start   time.Time
+	end     time.Time
+}
+
+type profFunc struct {
+	id     int
+	main   bool
+	active int
+	name   string
+	pos    parser.Pos
+	calls  uint64
+	time   time.Duration
+}
+
+type profLine struct {
+	id   int
+	fn   *profFunc
+	pos  parser.Pos
+	hits uint64
+	time time.Duration
+}
+
+// profNode is a node of the call tree whose path from the root is the stack of
+// the source lines.
+type profNode struct {
+	line     *profLine
+	parent   *profNode
+	children map[*profLine]*profNode
+	hits     uint64
+	time     time.Duration
+}
+
+func (n *profNode) child(l *profLine) *profNode {
+	c, ok := n.children[l]
+	if !ok {
+		if n.children == nil {
+			n.children = make(map[*profLine]*profNode)
+		}
+		c = &profNode{line: l, parent: n}
+		n.children[l] = c
+	}
+	return c
+}
+
+type profFrame struct {
+	fn    *profFunc
+	start time.Time
+	base  *profNode
+}
+
+func (f *profFrame) pop(now time.Time) {
+	f.fn.active--
+	if f.fn.active == 0 {
+		// do not count the time of recursive calls twice
+		f.fn.time += now.Sub(f.start)
+	}
+}
+
+func (prof *Profile) addFunc(fn *ugo.CompiledFunction, index int) *profFunc {
+	pf := &profFunc{id: len(prof.funcs) + 1, main: index < 0}
+	pf.name, pf.pos = FuncName(prof.fileSet, fn, index)
+	prof.funcs = append(prof.funcs, pf)
+	return pf
+}
+
+func (prof *Profile) addLine(fn *profFunc, pos parser.Pos) *profLine {
+	pl := &profLine{id: len(prof.lines) + 1, fn: fn, pos: pos}
+	prof.lines = append(prof.lines, pl)
+	return pl
+}
+
+func (prof *Profile) position(pos parser.Pos) parser.SourceFilePos {
+	if prof.fileSet == nil {
+		return parser.SourceFilePos{Line: int(pos)}
+	}
+	return prof.fileSet.Position(pos)
+}
+
+// account adds the elapsed time since the last event to the current node.
+func (prof *Profile) account(now time.Time) {
+	if prof.cur != nil && prof.cur.line != nil {
+		d := now.Sub(prof.last)
+		prof.cur.time += d
+		prof.cur.line.time += d
+	}
+	prof.last = now
+	prof.end = now
+}
+
+// drop pops the frames left by a thrown error.
+func (prof *Profile) drop(frames []profFrame) {
+	now := prof.now()
+	prof.account(now)
+	for i := len(frames) - 1; i >= 0; i-- {
+		frames[i].pop(now)
+	}
+	prof.cur = frames[0].base
+}
+
+func (prof *Profile) enter(fn *profFunc) {
+	prof.mu.Lock()
+	defer prof.mu.Unlock()
+
+	now := prof.now()
+	if fn.main {
+		// new run, drop the frames left by the previous run if it failed
+		prof.stack.Cut(0, func(frames []profFrame) {
+			for _, f := range frames {
+				f.fn.active = 0
+			}
+		})
+		prof.cur = &prof.root
+		prof.start = now
+	}
+	prof.account(now)
+	fn.calls++
+	fn.active++
+	prof.stack.Push(profFrame{fn: fn, start: now, base: prof.cur})
+}
+
+func (prof *Profile) exit() {
+	prof.mu.Lock()
+	defer prof.mu.Unlock()
+
+	now := prof.now()
+	prof.account(now)
+	if f, ok := prof.stack.Pop(); ok {
+		f.pop(now)
+		prof.cur = f.base
+	}
+}
+
+func (prof *Profile) line(l *profLine) {
+	prof.mu.Lock()
+	defer prof.mu.Unlock()
+
+	now := prof.now()
+	prof.account(now)
+	base := &prof.root
+	if f, ok := prof.stack.Top(); ok {
+		base = f.base
+	}
+	prof.cur = base.child(l)
+	prof.cur.hits++
+	l.hits++
+}
+
+// Reset clears all recorded statistics.
+func (prof *Profile) Reset() {
+	prof.mu.Lock()
+	defer prof.mu.Unlock()
+
+	for _, f := range prof.funcs {
+		f.calls, f.time, f.active = 0, 0, 0
+	}
+	for _, l := range prof.lines {
+		l.hits, l.time = 0, 0
+	}
+	prof.root = profNode{}
+	prof.stack.Cut(0, nil)
+	prof.cur = nil
+}
+
+// FuncStat holds the statistics of a function.
+type FuncStat struct {
+	Name  string
+	File  string
+	Line  int
+	Calls uint64
+	// Time is the total time spent in the function including the callees.
+	Time time.Duration
+}
+
+// Funcs returns the statistics of the called functions sorted by time in
+// descending order.
+func (prof *Profile) Funcs() []FuncStat {
+	prof.mu.Lock()
+	defer prof.mu.Unlock()
+
+	var stats []FuncStat
+	for _, f := range prof.funcs {
+		if f.calls == 0 {
+			continue
+		}
+		p := prof.position(f.pos)
+		stats = append(stats, FuncStat{
+			Name:  f.name,
+			File:  p.Filename,
+			Line:  p.Line,
+			Calls: f.calls,
+			Time:  f.time,
+		})
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Time > stats[j].Time
+	})
+	return stats
+}
+
+// LineStat holds the statistics of a source line.
+type LineStat struct {
+	Func string
+	File string
+	Line int
+	Hits uint64
+	// Time is the time spent on the line excluding the callees.
+	Time time.Duration
+}
+
+// Lines returns the statistics of the executed source lines sorted by time in
+// descending order.
+func (prof *Profile) Lines() []LineStat {
+	prof.mu.Lock()
+	defer prof.mu.Unlock()
+
+	var stats []LineStat
+	for _, l := range prof.lines {
+		if l.hits == 0 {
+			continue
+		}
+		p := prof.position(l.pos)
+		stats = append(stats, LineStat{
+			Func: l.fn.name,
+			File: p.Filename,
+			Line: p.Line,
+			Hits: l.hits,
+			Time: l.time,
+		})
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Time > stats[j].Time
+	})
+	return stats
+}
+
+// WriteProto writes the profile in gzipped profile.proto format which can be
+// opened with "go tool pprof". Samples have "hits/count" and "time/nanoseconds"
+// values and their stacks consist of source lines.
+func (prof *Profile) WriteProto(w io.Writer) error {
+	prof.mu.Lock()
+	defer prof.mu.Unlock()
+
+	var pb protoBuffer
+	strs := map[string]int{"": 0}
+	strTable := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = len(strTable)
+			strs[s] = i
+			strTable = append(strTable, s)
+		}
+		return uint64(i)
+	}
+
+	valueType := func(typ, unit string) []byte {
+		var vt protoBuffer
+		vt.uint64(1, str(typ))
+		vt.uint64(2, str(unit))
+		return vt.data
+	}
+	pb.bytes(1, valueType("hits", "count"))
+	pb.bytes(1, valueType("time", "nanoseconds"))
+
+	var walk func(n *profNode, stack []uint64)
+	walk = func(n *profNode, stack []uint64) {
+		if n.line != nil {
+			stack = append([]uint64{uint64(n.line.id)}, stack...)
+			var s protoBuffer
+			s.uint64s(1, stack)
+			s.int64s(2, []int64{int64(n.hits), int64(n.time)})
+			pb.bytes(2, s.data)
+		}
+		children := make([]*profNode, 0, len(n.children))
+		for _, c := range n.children {
+			children = append(children, c)
+		}
+		sort.Slice(children, func(i, j int) bool {
+			return children[i].line.id < children[j].line.id
+		})
+		for _, c := range children {
+			walk(c, stack)
+		}
+	}
+	walk(&prof.root, nil)
+
+	for _, l := range prof.lines {
+		var line, loc protoBuffer
+		line.uint64(1, uint64(l.fn.id))
+		line.int64(2, int64(prof.position(l.pos).Line))
+		loc.uint64(1, uint64(l.id))
+		loc.bytes(4, line.data)
+		pb.bytes(4, loc.data)
+	}
+	for _, f := range prof.funcs {
+		var fn protoBuffer
+		p := prof.position(f.pos)
+		fn.uint64(1, uint64(f.id))
+		fn.uint64(2, str(f.name))
+		fn.uint64(3, str(f.name))
+		fn.uint64(4, str(p.Filename))
+		fn.int64(5, int64(p.Line))
+		pb.bytes(5, fn.data)
+	}
+	pb.bytes(11, valueType("time", "nanoseconds"))
+	pb.int64(9, prof.start.UnixNano())
+	pb.int64(10, int64(prof.end.Sub(prof.start)))
+	for _, s := range strTable {
+		pb.string(6, s)
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(pb.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// profSite is the callable added to ugo.Bytecode by PatchForProfile to record
+// an event for a function entry, exit or source line.
+type profSite struct {
+	ugo.ObjectImpl
+	prof *Profile
+	fn   *profFunc
+	line *profLine
+	exit bool
+}
+
+var _ ugo.ExCallerObject = (*profSite)(nil)
+
+func (s *profSite) String() string   { return "<profSite>" }
+func (s *profSite) TypeName() string { return s.String() }
+func (s *profSite) CanCall() bool    { return true }
+
+func (s *profSite) Call(args ...ugo.Object) (ugo.Object, error) {
+	return s.CallEx(ugo.Call{})
+}
+
+func (s *profSite) CallEx(_ ugo.Call) (ugo.Object, error) {
+	switch {
+	case s.line != nil:
+		s.prof.line(s.line)
+	case s.exit:
+		s.prof.exit()
+	default:
+		s.prof.enter(s.fn)
+	}
+	return ugo.Undefined, nil
+}
+
+// protoBuffer is a minimal protocol buffers encoder to write pprof profiles.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) uint64s(field int, xs []uint64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(field, p.data)
+}
+
+func (b *protoBuffer) int64s(field int, xs []int64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(uint64(x))
+	}
+	b.bytes(field, p.data)
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.key(field, 2)
+	b.varint(uint64(len(s)))
+	b.data = append(b.data, s...)
+}
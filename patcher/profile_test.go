@@ -0,0 +1,129 @@
+package patcher_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPatchForProfile(t *testing.T) {
+	script := `var fib
+fib = func(x) {
+	if x <= 1 {
+		return x
+	}
+	return fib(x-1) + fib(x-2)
+}
+f := func() {
+	throw "error"
+}
+try {
+	f()
+} catch err {
+}
+return fib(5)`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		prof, err := patcher.PatchForProfile(bc)
+		require.NoError(t, err)
+
+		var tick time.Time
+		patcher.SetProfileClock(prof, func() time.Time {
+			tick = tick.Add(time.Millisecond)
+			return tick
+		})
+
+		for i := 0; i < 2; i++ {
+			prof.Reset()
+			ret, err := NewVM(bc).Run(nil)
+			require.NoError(t, err)
+			require.Equal(t, Int(5), ret)
+
+			funcs := map[string]patcher.FuncStat{}
+			for _, f := range prof.Funcs() {
+				funcs[f.Name] = f
+			}
+			require.Len(t, funcs, 3)
+			require.Equal(t, uint64(1), funcs["main"].Calls)
+			require.Equal(t, "(main)", funcs["main"].File)
+			fib := funcs["func@(main):3:2"]
+			require.Equal(t, uint64(15), fib.Calls)
+			require.Equal(t, 3, fib.Line)
+			require.Equal(t, uint64(1), funcs["func@(main):9:2"].Calls)
+			require.Greater(t, funcs["main"].Time, fib.Time)
+			require.Equal(t, prof.Funcs()[0].Name, "main")
+
+			lines := map[int]patcher.LineStat{}
+			var total time.Duration
+			for _, l := range prof.Lines() {
+				lines[l.Line] = l
+				total += l.Time
+			}
+			require.Equal(t, uint64(15), lines[3].Hits)
+			require.Equal(t, uint64(8), lines[4].Hits)
+			require.Equal(t, uint64(7), lines[6].Hits)
+			require.Equal(t, uint64(1), lines[12].Hits)
+			require.Equal(t, uint64(1), lines[15].Hits)
+			// time between main entry and first line is not attributed to a line
+			require.Equal(t, funcs["main"].Time-time.Millisecond, total)
+		}
+
+		var buf bytes.Buffer
+		require.NoError(t, prof.WriteProto(&buf))
+		zr, err := gzip.NewReader(&buf)
+		require.NoError(t, err)
+		data, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		require.Contains(t, string(data), "nanoseconds")
+		require.Contains(t, string(data), "func@(main):3:2")
+	})
+}
+
+func TestPatchForProfileRecursiveThrow(t *testing.T) {
+	script := `global depth
+var g
+g = func(n) {
+	if n == 1 {
+		throw "x"
+	}
+	if n > 0 {
+		return g(n-1)
+	}
+	try {
+		g(3)
+	} catch e {
+	}
+	return depth()
+}
+return g(0)`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		prof, err := patcher.PatchForProfile(bc)
+		require.NoError(t, err)
+
+		depth := &Function{
+			Value: func(args ...Object) (Object, error) {
+				return Int(patcher.ProfileDepth(prof)), nil
+			},
+		}
+		ret, err := NewVM(bc).Run(Map{"depth": depth})
+		require.NoError(t, err)
+		// frames left by the error are popped in the outer frame of g
+		require.Equal(t, Int(2), ret)
+		require.Equal(t, 0, patcher.ProfileDepth(prof))
+
+		for _, f := range prof.Funcs() {
+			if f.Name != "main" {
+				require.Equal(t, uint64(4), f.Calls)
+			}
+		}
+	})
+}
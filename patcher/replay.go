@@ -0,0 +1,380 @@
+package patcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/encoder"
+)
+
+// ErrReplayDiverged is the error matched by ReplayError with errors.Is.
+var ErrReplayDiverged = errors.New("replay diverged")
+
+// ReplayError is the error thrown by the callables added by PatchForReplay
+// when the calls of the script differ from the recorded ones. Once a replay
+// diverges, every call throws the same error, so that the error cannot be
+// swallowed by the script's error handlers. Errors returned from ugo.VM wrap
+// it, use errors.As to get it.
+type ReplayError struct {
+	// Call is the index of the call starting from 1.
+	Call int
+	// Name is the name of the called function.
+	Name string
+	// Recorded is the name of the recorded function, or an empty string if
+	// there is no recorded call left.
+	Recorded string
+}
+
+func (e *ReplayError) Error() string {
+	if e.Recorded == "" {
+		return fmt.Sprintf("%s at call %d: %s called, no recorded call left",
+			ErrReplayDiverged, e.Call, e.Name)
+	}
+	return fmt.Sprintf("%s at call %d: %s called, %s recorded",
+		ErrReplayDiverged, e.Call, e.Name, e.Recorded)
+}
+
+// Is reports whether target is ErrReplayDiverged.
+func (e *ReplayError) Is(target error) bool {
+	return target == ErrReplayDiverged
+}
+
+// ReplayEntry is a recorded call written in JSON Lines format by the recorder.
+type ReplayEntry struct {
+	// Name is the name of the called function.
+	Name string `json:"name"`
+	// Value is the returned object, or the returned error if it is an object
+	// like *ugo.Error, encoded with the object encoding of uGO.
+	Value []byte `json:"value,omitempty"`
+	// Error is the message of the returned error.
+	Error string `json:"error,omitempty"`
+	// Text is the string form of the returned object for humans, it is not
+	// used to replay the call.
+	Text string `json:"text,omitempty"`
+}
+
+// Replay records the results of the calls to nondeterministic functions or
+// replays them. It is created by NewRecorder or NewReplayer and used with
+// PatchForReplay and Wrap. Calls are recorded and replayed in the order they
+// are made, so a Replay should be used by a single VM run.
+type Replay struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	enc     *json.Encoder
+	entries []ReplayEntry
+	calls   int
+	err     error
+}
+
+// NewRecorder returns a Replay which calls the wrapped functions and writes
+// their results to w in JSON Lines format. Entries are buffered, Flush must
+// be called after running the script.
+func NewRecorder(w io.Writer) *Replay {
+	bw := bufio.NewWriter(w)
+	return &Replay{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// NewReplayer returns a Replay which reads the entries written by a recorder
+// from r, and returns the recorded results from the wrapped functions
+// without calling them.
+func NewReplayer(r io.Reader) (*Replay, error) {
+	rp := &Replay{}
+	dec := json.NewDecoder(r)
+	for {
+		var e ReplayEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("replay: entry %d: %w", len(rp.entries)+1, err)
+		}
+		rp.entries = append(rp.entries, e)
+	}
+	return rp, nil
+}
+
+// Calls returns the number of the calls recorded or replayed so far.
+func (rp *Replay) Calls() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	return rp.calls
+}
+
+// Remaining returns the number of the recorded calls which are not replayed
+// yet. It is always zero for recorders.
+func (rp *Replay) Remaining() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.enc != nil || rp.calls > len(rp.entries) {
+		return 0
+	}
+	return len(rp.entries) - rp.calls
+}
+
+// Flush writes the buffered entries of a recorder.
+func (rp *Replay) Flush() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.w == nil {
+		return nil
+	}
+	return rp.w.Flush()
+}
+
+// Wrap returns a callable recording or replaying the calls to given callable
+// with given name, which can be used to wrap the host callbacks passed to the
+// script as globals.
+func (rp *Replay) Wrap(name string, fn ugo.Object) ugo.Object {
+	return &replayFunc{replay: rp, name: name, fn: fn}
+}
+
+func (rp *Replay) call(name string, fn ugo.Object, c ugo.Call) (ugo.Object, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.err != nil {
+		return ugo.Undefined, rp.err
+	}
+	rp.calls++
+	if rp.enc != nil {
+		return rp.record(name, fn, c)
+	}
+	if rp.calls > len(rp.entries) {
+		rp.err = &ReplayError{Call: rp.calls, Name: name}
+		return ugo.Undefined, rp.err
+	}
+	e := rp.entries[rp.calls-1]
+	if e.Name != name {
+		rp.err = &ReplayError{Call: rp.calls, Name: name, Recorded: e.Name}
+		return ugo.Undefined, rp.err
+	}
+	return replayResult(e)
+}
+
+func (rp *Replay) record(name string, fn ugo.Object, c ugo.Call) (ugo.Object, error) {
+	var ret ugo.Object
+	var err error
+	if ex, ok := fn.(ugo.ExCallerObject); ok {
+		ret, err = ex.CallEx(c)
+	} else {
+		args := make([]ugo.Object, c.Len())
+		for i := range args {
+			args[i] = c.Get(i)
+		}
+		ret, err = fn.Call(args...)
+	}
+
+	e := ReplayEntry{Name: name}
+	value := ret
+	if err != nil {
+		e.Error = err.Error()
+		value, _ = err.(ugo.Object)
+	}
+	if value != nil {
+		data, encErr := encoder.Array(ugo.Array{value}).MarshalBinary()
+		if encErr != nil {
+			return ugo.Undefined, fmt.Errorf("replay: encode %s result: %w",
+				name, encErr)
+		}
+		e.Value = data
+		if err == nil {
+			e.Text = value.String()
+		}
+	}
+	if encErr := rp.enc.Encode(e); encErr != nil {
+		return ugo.Undefined, fmt.Errorf("replay: %w", encErr)
+	}
+	return ret, err
+}
+
+// replayResult returns the recorded result of given entry.
+func replayResult(e ReplayEntry) (ugo.Object, error) {
+	var value ugo.Object
+	if e.Value != nil {
+		obj, err := encoder.DecodeObject(bytes.NewReader(e.Value))
+		if err != nil {
+			return ugo.Undefined, fmt.Errorf("replay: decode %s result: %w",
+				e.Name, err)
+		}
+		arr, ok := obj.(ugo.Array)
+		if !ok || len(arr) != 1 {
+			return ugo.Undefined, fmt.Errorf("replay: invalid %s result", e.Name)
+		}
+		value = arr[0]
+	}
+	if e.Error != "" {
+		if err, ok := value.(error); ok {
+			return ugo.Undefined, err
+		}
+		return ugo.Undefined, errors.New(e.Error)
+	}
+	return value, nil
+}
+
+// PatchForReplay modifies given ugo.Bytecode to record or replay the calls to
+// the functions with given names with rp. Builtins are named as they are,
+// e.g. "printf", and the functions of builtin modules are named after the
+// module and the attribute, e.g. "time.Now". Loads of the builtins are
+// replaced with the wrappers, and the attributes of the imported builtin
+// modules are replaced with the wrappers in the copies of the modules, which
+// makes the wrappers used however the functions are referenced. Names of
+// unknown builtins, and the ones of the functions of the modules which are not
+// imported by the script or do not have the functions, result in an error. If
+// error is returned, given ugo.Bytecode must be discarded due to invalid
+// patching.
+func PatchForReplay(bc *ugo.Bytecode, rp *Replay, names []string) error {
+	_, err := NewPipeline(ReplayPass(rp, names)).Run(bc)
+	return err
+}
+
+// ReplayPass returns a Pass for Pipeline patching like PatchForReplay.
+func ReplayPass(rp *Replay, names []string) Pass {
+	// Replace loads of the builtins with the following instruction.
+	/*
+		0000 CONSTANT <wrapper index>
+	*/
+
+	if rp == nil {
+		panic("nil replay")
+	}
+
+	builtins := make(map[ugo.BuiltinType]string)
+	// builtin types in the order of names for the order of wrapper constants
+	var builtinTypes []ugo.BuiltinType
+	modules := make(map[string][]string)
+	var unknown string
+	for _, name := range names {
+		if i := strings.LastIndexByte(name, '.'); i > 0 {
+			modules[name[:i]] = append(modules[name[:i]], name[i+1:])
+		} else if typ, ok := ugo.BuiltinsMap[name]; ok {
+			if _, ok := builtins[typ]; !ok {
+				builtinTypes = append(builtinTypes, typ)
+			}
+			builtins[typ] = name
+		} else if unknown == "" {
+			unknown = name
+		}
+	}
+	wrapperIndexes := make(map[ugo.BuiltinType]int)
+
+	// wrapModule returns a copy of given module with the wrappers of its
+	// functions, ok is false if it is not a module to wrap.
+	wrapModule := func(obj ugo.Object) (_ ugo.Map, ok bool, _ error) {
+		m, ok := obj.(ugo.Map)
+		if !ok {
+			return nil, false, nil
+		}
+		modName, ok := m[ugo.AttrModuleName].(ugo.String)
+		if !ok || modules[string(modName)] == nil {
+			return nil, false, nil
+		}
+		cp := make(ugo.Map, len(m))
+		for k, v := range m {
+			cp[k] = v
+		}
+		for _, attr := range modules[string(modName)] {
+			fn, ok := cp[attr]
+			if !ok || !fn.CanCall() {
+				return nil, false, fmt.Errorf("module %s has no function %s",
+					modName, attr)
+			}
+			cp[attr] = rp.Wrap(string(modName)+"."+attr, fn)
+		}
+		return cp, true, nil
+	}
+
+	return Pass{
+		Name: "replay",
+		Key:  strings.Join(names, ","),
+		Start: func(pc *PassContext) error {
+			if unknown != "" {
+				return fmt.Errorf("unknown builtin: %s", unknown)
+			}
+			imported := make(map[string]bool)
+			for i, c := range pc.Bytecode().Constants {
+				cp, ok, err := wrapModule(c)
+				if err != nil {
+					return err
+				}
+				if ok {
+					// original module is stored by Cache
+					pc.replaceConstant(i, cp)
+					imported[string(cp[ugo.AttrModuleName].(ugo.String))] = true
+				}
+			}
+			for _, name := range names {
+				i := strings.LastIndexByte(name, '.')
+				if i > 0 && !imported[name[:i]] {
+					return fmt.Errorf("module %s of %s is not imported", name[:i], name)
+				}
+			}
+			for _, typ := range builtinTypes {
+				wrapperIndexes[typ] = pc.AddConstant(
+					rp.Wrap(builtins[typ], ugo.BuiltinObjects[typ]))
+			}
+			return nil
+		},
+		Visit: func(it *Iterator) (Op, []byte, error) {
+			if it.Opcode() != ugo.OpGetBuiltin {
+				return Next, nil, nil
+			}
+			index, ok := wrapperIndexes[ugo.BuiltinType(it.Operands()[0])]
+			if !ok {
+				return Next, nil, nil
+			}
+			insts, err := makeInsts([]int{int(ugo.OpConstant), index})
+			return Replace, insts, err
+		},
+		Attach: func(_ *ugo.Bytecode, consts []ugo.Object) error {
+			// copies of the modules precede the wrappers of the builtins
+			var i int
+			for ; i < len(consts); i++ {
+				cp, ok, err := wrapModule(consts[i])
+				if err != nil {
+					return err
+				}
+				if !ok {
+					break
+				}
+				consts[i] = cp
+			}
+			wrappers := make([]ugo.Object, len(builtinTypes))
+			for j, typ := range builtinTypes {
+				wrappers[j] = rp.Wrap(builtins[typ], ugo.BuiltinObjects[typ])
+			}
+			return attachConstants(consts[i:], wrappers...)
+		},
+	}
+}
+
+// replayFunc is the callable recording or replaying the calls to a function.
+type replayFunc struct {
+	ugo.ObjectImpl
+	replay *Replay
+	name   string
+	fn     ugo.Object
+}
+
+var _ ugo.ExCallerObject = (*replayFunc)(nil)
+
+func (f *replayFunc) String() string   { return "<replay:" + f.name + ">" }
+func (f *replayFunc) TypeName() string { return f.fn.TypeName() }
+func (f *replayFunc) CanCall() bool    { return true }
+
+func (f *replayFunc) Call(args ...ugo.Object) (ugo.Object, error) {
+	return f.CallEx(ugo.NewCall(nil, args))
+}
+
+func (f *replayFunc) CallEx(c ugo.Call) (ugo.Object, error) {
+	return f.replay.call(f.name, f.fn, c)
+}
@@ -0,0 +1,186 @@
+package patcher_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+	ugotime "github.com/ozanh/ugo/stdlib/time"
+)
+
+func TestPatchForReplay(t *testing.T) {
+	script := `
+	rnd := import("rnd")
+	next := rnd.Next
+	s := [rnd.Next(), next()]
+	s = append(s, len(s))
+	try {
+		rnd.Fail()
+	} catch err {
+		s = append(s, string(err))
+	}
+	return s`
+
+	modules := func(start int64) *ModuleMap {
+		n := start
+		mm := NewModuleMap()
+		mm.AddBuiltinModule("rnd", Map{
+			"Next": &Function{
+				Name: "Next",
+				Value: func(args ...Object) (Object, error) {
+					n++
+					return Int(n), nil
+				},
+			},
+			"Fail": &Function{
+				Name: "Fail",
+				Value: func(args ...Object) (Object, error) {
+					return nil, errors.New("failed")
+				},
+			},
+		})
+		return mm
+	}
+	names := []string{"rnd.Next", "rnd.Fail", "len"}
+
+	var log bytes.Buffer
+	var recorded Object
+	expectCompile(t, script, CompilerOptions{ModuleMap: modules(0)}, func(bc *Bytecode) {
+		rp := patcher.NewRecorder(&log)
+		require.NoError(t, patcher.PatchForReplay(bc, rp, names))
+		var err error
+		recorded, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.NoError(t, rp.Flush())
+		require.Equal(t, 4, rp.Calls())
+		require.Equal(t, 0, rp.Remaining())
+	})
+	require.Equal(t, Array{Int(1), Int(2), Int(2), String("error: failed")}, recorded)
+	require.Equal(t, 4, strings.Count(log.String(), "\n"))
+	require.Contains(t, log.String(), `"name":"rnd.Next"`)
+
+	// recorded values are returned without calling the functions
+	expectCompile(t, script, CompilerOptions{ModuleMap: modules(100)}, func(bc *Bytecode) {
+		rp, err := patcher.NewReplayer(bytes.NewReader(log.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, 4, rp.Remaining())
+		require.NoError(t, patcher.PatchForReplay(bc, rp, names))
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, recorded, ret)
+		require.Equal(t, 0, rp.Remaining())
+	})
+
+	// diverged replays throw an error which cannot be caught
+	diverged := `
+	rnd := import("rnd")
+	rnd.Next()
+	try {
+		rnd.Next()
+	} catch err {
+	}
+	return rnd.Next()`
+	expectCompile(t, diverged, CompilerOptions{ModuleMap: modules(0)}, func(bc *Bytecode) {
+		rp, err := patcher.NewReplayer(bytes.NewReader(log.Bytes()))
+		require.NoError(t, err)
+		require.NoError(t, patcher.PatchForReplay(bc, rp, names))
+		_, err = NewVM(bc).Run(nil)
+		require.ErrorIs(t, err, patcher.ErrReplayDiverged)
+		var re *patcher.ReplayError
+		require.True(t, errors.As(err, &re))
+		require.Equal(t, patcher.ReplayError{Call: 3, Name: "rnd.Next",
+			Recorded: "len"}, *re)
+	})
+
+	expectCompile(t, `return 1`, CompilerOptions{}, func(bc *Bytecode) {
+		rp, err := patcher.NewReplayer(strings.NewReader(""))
+		require.NoError(t, err)
+		err = patcher.PatchForReplay(bc, rp, []string{"nosuchbuiltin"})
+		require.EqualError(t, err, "replay pass: unknown builtin: nosuchbuiltin")
+	})
+
+	expectCompile(t, `return import("rnd")`, CompilerOptions{ModuleMap: modules(0)},
+		func(bc *Bytecode) {
+			err := patcher.PatchForReplay(bc, patcher.NewRecorder(&log),
+				[]string{"rnd.Missing"})
+			require.EqualError(t, err, "replay pass: module rnd has no function Missing")
+		})
+
+	// misspelled and not imported modules are not ignored
+	expectCompile(t, `return import("rnd")`, CompilerOptions{ModuleMap: modules(0)},
+		func(bc *Bytecode) {
+			err := patcher.PatchForReplay(bc, patcher.NewRecorder(&log),
+				[]string{"rnd.Next", "rdn.Next"})
+			require.EqualError(t, err, "replay pass: module rdn of rdn.Next is not imported")
+		})
+	expectCompile(t, `return 1`, CompilerOptions{ModuleMap: modules(0)},
+		func(bc *Bytecode) {
+			err := patcher.PatchForReplay(bc, patcher.NewRecorder(&log),
+				[]string{"rnd.Next"})
+			require.EqualError(t, err, "replay pass: module rnd of rnd.Next is not imported")
+		})
+
+	_, err := patcher.NewReplayer(strings.NewReader("{}\n{"))
+	require.EqualError(t, err, "replay: entry 2: unexpected EOF")
+}
+
+func TestReplayWrap(t *testing.T) {
+	script := `global now; return [now(), now()]`
+	n := 0
+	now := &Function{
+		Name: "now",
+		Value: func(args ...Object) (Object, error) {
+			n++
+			return Int(n), nil
+		},
+	}
+
+	var log bytes.Buffer
+	rec := patcher.NewRecorder(&log)
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		ret, err := NewVM(bc).Run(Map{"now": rec.Wrap("now", now)})
+		require.NoError(t, err)
+		require.Equal(t, Array{Int(1), Int(2)}, ret)
+		require.NoError(t, rec.Flush())
+
+		rp, err := patcher.NewReplayer(&log)
+		require.NoError(t, err)
+		ret, err = NewVM(bc).Run(Map{"now": rp.Wrap("now", now)})
+		require.NoError(t, err)
+		require.Equal(t, Array{Int(1), Int(2)}, ret)
+		require.Equal(t, 2, n)
+	})
+}
+
+func TestPatchForReplayTime(t *testing.T) {
+	script := `time := import("time"); return time.Now()`
+	opts := CompilerOptions{ModuleMap: NewModuleMap().
+		AddBuiltinModule("time", ugotime.Module)}
+	names := []string{"time.Now"}
+
+	var log bytes.Buffer
+	var recorded Object
+	expectCompile(t, script, opts, func(bc *Bytecode) {
+		rp := patcher.NewRecorder(&log)
+		require.NoError(t, patcher.PatchForReplay(bc, rp, names))
+		var err error
+		recorded, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.NoError(t, rp.Flush())
+	})
+
+	expectCompile(t, script, opts, func(bc *Bytecode) {
+		rp, err := patcher.NewReplayer(&log)
+		require.NoError(t, err)
+		require.NoError(t, patcher.PatchForReplay(bc, rp, names))
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.True(t, recorded.(*ugotime.Time).Value.Equal(ret.(*ugotime.Time).Value))
+	})
+}
@@ -0,0 +1,196 @@
+package patcher
+
+import (
+	"fmt"
+
+	"github.com/ozanh/ugo"
+)
+
+// PatchRecord records the functions, the constants and the number of modules
+// of a ugo.Bytecode changed by a patch to revert them with Revert. It is a
+// snapshot of the changed functions, see RecordPatch.
+type PatchRecord struct {
+	numConsts  int
+	endConsts  int
+	numModules int
+	funcs      []funcRecord
+}
+
+// funcRecord holds the original and the patched state of a function.
+type funcRecord struct {
+	fn        *ugo.CompiledFunction
+	index     int
+	insts     []byte
+	sourceMap map[int]int
+	numLocals int
+	patched   []byte
+}
+
+// RecordPatch calls patch with given ugo.Bytecode and returns a PatchRecord to
+// revert the changes made to the instructions, source maps and the number of
+// locals of the functions, the constants appended to the ugo.Bytecode and its
+// number of modules, which is increased by the patches keeping the states of
+// runs in the module cache of ugo.VM. If patch returns an error, changes are
+// reverted and the error is returned.
+//
+// The record does not list the inserted instructions, it is a snapshot
+// holding the original instructions and source maps and the patched
+// instructions of the changed functions, so it costs memory proportional to
+// the size of the changed functions while it is kept. The positions of the inserted
+// instructions are computed from the snapshot by Inserted. The original
+// instructions and source maps are kept without copying since Patcher does
+// not modify them in place, so patch must not modify them in place either.
+func RecordPatch(
+	bc *ugo.Bytecode,
+	patch func(bc *ugo.Bytecode) error,
+) (*PatchRecord, error) {
+	rec := &PatchRecord{numConsts: len(bc.Constants), numModules: bc.NumModules}
+	var funcs []funcRecord
+	if bc.Main != nil {
+		funcs = append(funcs, newFuncRecord(bc.Main, -1))
+	}
+	for i, c := range bc.Constants {
+		if fn, ok := c.(*ugo.CompiledFunction); ok {
+			funcs = append(funcs, newFuncRecord(fn, i))
+		}
+	}
+
+	err := patch(bc)
+	for _, f := range funcs {
+		if !sameBytes(f.insts, f.fn.Instructions) ||
+			f.numLocals != f.fn.NumLocals ||
+			!sameSourceMap(f.sourceMap, f.fn.SourceMap) {
+			f.patched = f.fn.Instructions
+			rec.funcs = append(rec.funcs, f)
+		}
+	}
+	rec.endConsts = len(bc.Constants)
+	if err != nil {
+		rec.restore(bc)
+		return nil, err
+	}
+	return rec, nil
+}
+
+func newFuncRecord(fn *ugo.CompiledFunction, index int) funcRecord {
+	return funcRecord{
+		fn:        fn,
+		index:     index,
+		insts:     fn.Instructions,
+		sourceMap: fn.SourceMap,
+		numLocals: fn.NumLocals,
+	}
+}
+
+// sameBytes reports whether a and b are the same slice.
+func sameBytes(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// sameSourceMap reports whether a and b have the same entries.
+func sameSourceMap(a, b map[int]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if v2, ok := b[k]; !ok || v2 != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Constants returns the index range [start, end) of the constants appended by
+// the patch.
+func (rec *PatchRecord) Constants() (start, end int) {
+	return rec.numConsts, rec.endConsts
+}
+
+// Funcs returns the constant indexes of the functions changed by the patch in
+// order, -1 is the main function.
+func (rec *PatchRecord) Funcs() []int {
+	out := make([]int, 0, len(rec.funcs))
+	for _, f := range rec.funcs {
+		out = append(out, f.index)
+	}
+	return out
+}
+
+// Inserted returns the positions of the instructions inserted by the patch in
+// the patched instructions of the function at given constant index, -1 is the
+// main function. Instructions are aligned like Diff does.
+func (rec *PatchRecord) Inserted(index int) ([]int, error) {
+	for _, f := range rec.funcs {
+		if f.index != index {
+			continue
+		}
+		fd, err := diffFunc(
+			&ugo.CompiledFunction{Instructions: f.insts},
+			&ugo.CompiledFunction{Instructions: f.patched},
+		)
+		if err != nil {
+			return nil, err
+		}
+		var out []int
+		for _, d := range fd.Insts {
+			if d.Kind == DiffInsert {
+				out = append(out, d.NewPos)
+			}
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+// Revert restores the instructions, source maps and the number of locals of
+// the functions changed by the patch recorded in rec, removes the constants
+// appended by the patch and restores the number of modules. The ugo.Bytecode
+// must not be changed after the record, so the records of stacked patches
+// must be reverted in reverse order. Revert returns an error without changing
+// the ugo.Bytecode if it is changed after the record.
+func Revert(bc *ugo.Bytecode, rec *PatchRecord) error {
+	if len(bc.Constants) != rec.endConsts {
+		return fmt.Errorf("revert: number of constants %d is not %d",
+			len(bc.Constants), rec.endConsts)
+	}
+	for _, f := range rec.funcs {
+		var fn *ugo.CompiledFunction
+		if f.index < 0 {
+			fn = bc.Main
+		} else {
+			fn, _ = bc.Constants[f.index].(*ugo.CompiledFunction)
+		}
+		if fn != f.fn {
+			return fmt.Errorf("revert: function at constant %d is replaced",
+				f.index)
+		}
+		if !sameBytes(fn.Instructions, f.patched) {
+			return fmt.Errorf("revert: instructions of %s are changed",
+				funcDesc(f.index))
+		}
+	}
+	rec.restore(bc)
+	return debugVerify(bc)
+}
+
+func (rec *PatchRecord) restore(bc *ugo.Bytecode) {
+	for _, f := range rec.funcs {
+		f.fn.Instructions = f.insts
+		f.fn.SourceMap = f.sourceMap
+		f.fn.NumLocals = f.numLocals
+	}
+	bc.NumModules = rec.numModules
+	if len(bc.Constants) > rec.numConsts {
+		for i := rec.numConsts; i < len(bc.Constants); i++ {
+			bc.Constants[i] = nil
+		}
+		bc.Constants = bc.Constants[:rec.numConsts]
+	}
+}
+
+func funcDesc(index int) string {
+	if index < 0 {
+		return "main function"
+	}
+	return fmt.Sprintf("function at constant %d", index)
+}
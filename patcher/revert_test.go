@@ -0,0 +1,117 @@
+package patcher_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestRevert(t *testing.T) {
+	script := `f := func(x) {
+	try {
+		return [x] + [x * 2]
+	} finally {
+		x = 0
+	}
+}
+s := 0
+for i := 0; i < 3; i++ {
+	s += len(f(i))
+}
+return s`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		original := copyBytecode(bc)
+
+		var cov *patcher.Coverage
+		covRec, err := patcher.RecordPatch(bc, func(bc *Bytecode) (err error) {
+			cov, err = patcher.PatchForCoverage(bc)
+			return
+		})
+		require.NoError(t, err)
+		start, end := covRec.Constants()
+		require.Equal(t, len(original.Constants), start)
+		require.Greater(t, end, start)
+		require.Equal(t, []int{-1, 2}, covRec.Funcs())
+		inserted, err := covRec.Inserted(-1)
+		require.NoError(t, err)
+		require.Equal(t, 0, inserted[0])
+		inserted, err = covRec.Inserted(100)
+		require.NoError(t, err)
+		require.Nil(t, inserted)
+
+		// stack another patch changing the number of locals
+		memRec, err := patcher.RecordPatch(bc, func(bc *Bytecode) error {
+			_, err := patcher.PatchForMemoryLimit(bc, 1000)
+			return err
+		})
+		require.NoError(t, err)
+
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(6), ret)
+		require.NotEmpty(t, cov.Lines())
+
+		// records must be reverted in reverse order
+		err = patcher.Revert(bc, covRec)
+		require.EqualError(t, err, "revert: number of constants "+
+			"20 is not 14")
+		require.NoError(t, patcher.Revert(bc, memRec))
+		require.NoError(t, patcher.Revert(bc, covRec))
+
+		require.Equal(t, original.Main.Instructions, bc.Main.Instructions)
+		require.Equal(t, original.Main.SourceMap, bc.Main.SourceMap)
+		require.Equal(t, original.Main.NumLocals, bc.Main.NumLocals)
+		require.Equal(t, len(original.Constants), len(bc.Constants))
+		expectCompiledFunctionsEqual(t, bc.Constants[2].(*CompiledFunction),
+			original.Constants[2].(*CompiledFunction))
+
+		ret, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(6), ret)
+
+		// patch again
+		_, err = patcher.PatchForCoverage(bc)
+		require.NoError(t, err)
+		err = patcher.Revert(bc, covRec)
+		require.Error(t, err)
+	})
+
+	// failed patches are reverted
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		original := copyBytecode(bc)
+		rec, err := patcher.RecordPatch(bc, func(bc *Bytecode) error {
+			if _, err := patcher.PatchForGosched(bc, 10); err != nil {
+				return err
+			}
+			return errors.New("failed")
+		})
+		require.EqualError(t, err, "failed")
+		require.Nil(t, rec)
+		require.Equal(t, original.Main.Instructions, bc.Main.Instructions)
+		require.Equal(t, len(original.Constants), len(bc.Constants))
+		require.Equal(t, original.NumModules, bc.NumModules)
+	})
+
+	// modules reserved for the states of runs are removed
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		original := copyBytecode(bc)
+		rec, err := patcher.RecordPatch(bc, func(bc *Bytecode) error {
+			_, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+				CallThreshold: 10,
+				PerRun:        true,
+			})
+			return err
+		})
+		require.NoError(t, err)
+		require.Equal(t, original.NumModules+1, bc.NumModules)
+		require.NoError(t, patcher.Revert(bc, rec))
+		require.Equal(t, original.NumModules, bc.NumModules)
+		require.Equal(t, original.Main.Instructions, bc.Main.Instructions)
+	})
+}
@@ -0,0 +1,103 @@
+package patcher
+
+import (
+	"fmt"
+
+	"github.com/ozanh/ugo"
+)
+
+// runState is a slot of the module cache of ugo.VM reserved by a patch to keep
+// the state of the current run in it. The module cache belongs to the VM and
+// it is shared with the VMs created by its invokers, so the state is found by
+// the callables without keeping the VMs, and it is dropped with the VM. The
+// state is created at the start of the main function by calling the starter
+// constant with the state of the previous run of the VM, or with the starter
+// itself if there is none, and it is stored in the slot. If there is an ender
+// constant, it is called with the state before the returns of the main
+// function, which are not reached if the run fails.
+type runState struct {
+	module  int
+	starter int
+	ender   int
+}
+
+// runStarter is implemented by the starter constants of run states, so that
+// the loads of run states are not taken for imports.
+type runStarter interface {
+	ugo.ExCallerObject
+	runStarter()
+}
+
+// newRunState reserves a module cache slot in given ugo.Bytecode for the state
+// created by the starter at given constant index. Ender is the constant index
+// of the ender, or -1 if there is none.
+func newRunState(bc *ugo.Bytecode, starter, ender int) (runState, error) {
+	if bc.NumModules >= 1<<16 {
+		return runState{}, fmt.Errorf("no module left for run state: %d",
+			bc.NumModules)
+	}
+	rs := runState{module: bc.NumModules, starter: starter, ender: ender}
+	bc.NumModules++
+	return rs, nil
+}
+
+// startInsts returns the instructions to create the state, which must be
+// inserted at the start of the main function before the other insertions and
+// must not be run by jumps.
+func (rs runState) startInsts() ([]byte, error) {
+	/*
+		0000 CONSTANT <starter>
+		0000 LOADMODULE <starter> <module>
+		0000 POP
+		0000 CALL 1 0
+		0000 STOREMODULE <module>
+		0000 POP
+	*/
+	return makeInsts(
+		[]int{int(ugo.OpConstant), rs.starter},
+		[]int{int(ugo.OpLoadModule), rs.starter, rs.module},
+		[]int{int(ugo.OpPop)},
+		[]int{int(ugo.OpCall), 1, 0},
+		[]int{int(ugo.OpStoreModule), rs.module},
+		[]int{int(ugo.OpPop)},
+	)
+}
+
+// callInsts returns the instructions to call the callable at given constant
+// index with the state, or with the starter if no state is created in the
+// VM, e.g. a function is called by a VM which has not run the main function.
+func (rs runState) callInsts(index int) ([]byte, error) {
+	/*
+		0000 CONSTANT <index>
+		0000 LOADMODULE <starter> <module>
+		0000 POP
+		0000 CALL 1 0
+		0000 POP
+	*/
+	return makeInsts(
+		[]int{int(ugo.OpConstant), index},
+		[]int{int(ugo.OpLoadModule), rs.starter, rs.module},
+		[]int{int(ugo.OpPop)},
+		[]int{int(ugo.OpCall), 1, 0},
+		[]int{int(ugo.OpPop)},
+	)
+}
+
+// endInsts returns the instructions to call the ender, which must be inserted
+// right before the returns of the main function, or nil if there is no ender.
+func (rs runState) endInsts() ([]byte, error) {
+	if rs.ender < 0 {
+		return nil, nil
+	}
+	return rs.callInsts(rs.ender)
+}
+
+// isRunStateLoad reports whether the constant loaded by LOADMODULE at given
+// index is a starter of a run state.
+func isRunStateLoad(bc *ugo.Bytecode, index int) bool {
+	if index >= len(bc.Constants) {
+		return false
+	}
+	_, ok := bc.Constants[index].(runStarter)
+	return ok
+}
@@ -0,0 +1,175 @@
+package patcher
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+)
+
+// List of trace event kinds.
+const (
+	TraceCall   = "call"
+	TraceLine   = "line"
+	TraceReturn = "return"
+)
+
+// TraceEvent is the event emitted by the callables added by PatchForTrace.
+type TraceEvent struct {
+	// Kind is one of TraceCall, TraceLine and TraceReturn.
+	Kind string `json:"kind"`
+	// Func is the name of the function, main function is named as "main".
+	Func   string `json:"func"`
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+	// Opcode is the name of the first instruction of the traced line, or the
+	// first instruction of the function for TraceCall events.
+	Opcode string `json:"opcode"`
+	// CallDepth is the number of the active calls including the call of the
+	// function, starting from 1 for main. It is not the depth of the operand
+	// stack of the VM.
+	CallDepth int `json:"callDepth"`
+}
+
+// TraceFunc is called for each trace event. Returned error is thrown in the
+// script.
+type TraceFunc func(ev TraceEvent) error
+
+// NewJSONTraceFunc returns a TraceFunc writing the events to w in JSON Lines
+// format.
+func NewJSONTraceFunc(w io.Writer) TraceFunc {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(ev TraceEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return enc.Encode(ev)
+	}
+}
+
+// PatchForTrace modifies given ugo.Bytecode to add callables emitting trace
+// events to fn at function entries, at the first instruction of each source
+// line and before returns. Call depth is tracked for a single VM at a time,
+// running the same patched ugo.Bytecode concurrently results in wrong depths.
+// Note that tail call optimization of the VM is disabled by this patch. If
+// error is returned, given ugo.Bytecode must be discarded due to invalid
+// patching.
+func PatchForTrace(bc *ugo.Bytecode, fn TraceFunc) error {
+	if fn == nil {
+		panic("fn must not be nil")
+	}
+
+	tr := &tracer{fn: fn}
+	var tf *traceFunc
+	newSite := func(kind string, pos parser.Pos, opcode ugo.Opcode) ugo.Object {
+		return &traceSite{
+			tracer: tr,
+			fn:     tf,
+			event:  tf.event(bc.FileSet, kind, pos, opcode),
+		}
+	}
+	hooks := Hooks{
+		Enter: func(cf *ugo.CompiledFunction, index int) ugo.Object {
+			tf = &traceFunc{main: index < 0}
+			tf.name, tf.pos = FuncName(bc.FileSet, cf, index)
+			var opcode ugo.Opcode
+			if len(cf.Instructions) > 0 {
+				opcode = cf.Instructions[0]
+			}
+			return newSite(TraceCall, tf.pos, opcode)
+		},
+		Line: func(pos parser.Pos, opcode ugo.Opcode) ugo.Object {
+			return newSite(TraceLine, pos, opcode)
+		},
+		Exit: func() ugo.Object {
+			return newSite(TraceReturn, parser.NoPos, ugo.OpReturn)
+		},
+	}
+	tr.stack.SetUnwindHooks(&hooks, &tr.mu, nil)
+	return PatchForHooks(bc, hooks)
+}
+
+type traceFunc struct {
+	name string
+	pos  parser.Pos
+	main bool
+}
+
+func (tf *traceFunc) event(
+	fileSet *parser.SourceFileSet,
+	kind string,
+	pos parser.Pos,
+	opcode ugo.Opcode,
+) TraceEvent {
+	ev := TraceEvent{
+		Kind:   kind,
+		Func:   tf.name,
+		Opcode: ugo.OpcodeNames[opcode],
+	}
+	if fileSet != nil && pos.IsValid() {
+		p := fileSet.Position(pos)
+		ev.File, ev.Line, ev.Column = p.Filename, p.Line, p.Column
+	}
+	return ev
+}
+
+// tracer tracks the call stack of the traced functions.
+type tracer struct {
+	mu    sync.Mutex
+	fn    TraceFunc
+	stack CallStack[*traceFunc]
+}
+
+// depth returns the call depth after handling the event of given site.
+func (tr *tracer) depth(s *traceSite) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	switch s.event.Kind {
+	case TraceCall:
+		if s.fn.main {
+			// new run, drop the frames left by the previous run if it failed
+			tr.stack.Cut(0, nil)
+		}
+		tr.stack.Push(s.fn)
+		return tr.stack.Len()
+	case TraceReturn:
+		depth := tr.stack.Len()
+		tr.stack.Pop()
+		return depth
+	default:
+		return tr.stack.Len()
+	}
+}
+
+// traceSite is the callable added to ugo.Bytecode by PatchForTrace to emit a
+// trace event.
+type traceSite struct {
+	ugo.ObjectImpl
+	tracer *tracer
+	fn     *traceFunc
+	event  TraceEvent
+}
+
+var _ ugo.ExCallerObject = (*traceSite)(nil)
+
+func (s *traceSite) String() string   { return "<traceSite>" }
+func (s *traceSite) TypeName() string { return s.String() }
+func (s *traceSite) CanCall() bool    { return true }
+
+func (s *traceSite) Call(args ...ugo.Object) (ugo.Object, error) {
+	return s.CallEx(ugo.Call{})
+}
+
+func (s *traceSite) CallEx(_ ugo.Call) (ugo.Object, error) {
+	ev := s.event
+	ev.CallDepth = s.tracer.depth(s)
+	if err := s.tracer.fn(ev); err != nil {
+		return ugo.Undefined, err
+	}
+	return ugo.Undefined, nil
+}
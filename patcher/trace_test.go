@@ -0,0 +1,144 @@
+package patcher_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPatchForTrace(t *testing.T) {
+	script := `f := func(x) {
+	if x > 0 {
+		throw "error"
+	}
+	return x
+}
+try {
+	f(1)
+} catch err {
+}
+return f(0)`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		var events []patcher.TraceEvent
+		err := patcher.PatchForTrace(bc, func(ev patcher.TraceEvent) error {
+			events = append(events, ev)
+			return nil
+		})
+		require.NoError(t, err)
+
+		ret, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		require.Equal(t, Int(0), ret)
+
+		type event struct {
+			kind  string
+			fn    string
+			line  int
+			depth int
+		}
+		var got []event
+		for _, ev := range events {
+			got = append(got, event{ev.Kind, ev.Func, ev.Line, ev.CallDepth})
+		}
+		f := "func@(main):2:2"
+		require.Equal(t, []event{
+			{patcher.TraceCall, "main", 1, 1},
+			{patcher.TraceLine, "main", 1, 1},
+			{patcher.TraceLine, "main", 7, 1},
+			{patcher.TraceLine, "main", 8, 1},
+			{patcher.TraceCall, f, 2, 2},
+			{patcher.TraceLine, f, 2, 2},
+			{patcher.TraceLine, f, 3, 2},
+			{patcher.TraceLine, "main", 9, 1},
+			{patcher.TraceLine, "main", 7, 1}, // end of try statement
+			{patcher.TraceLine, "main", 11, 1},
+			{patcher.TraceCall, f, 2, 2},
+			{patcher.TraceLine, f, 2, 2},
+			{patcher.TraceLine, f, 5, 2},
+			{patcher.TraceReturn, f, 0, 2},
+			{patcher.TraceReturn, "main", 0, 1},
+		}, got)
+		require.Equal(t, "(main)", events[0].File)
+		require.Equal(t, "GETLOCAL", events[5].Opcode)
+	})
+
+	expectCompile(t, `a := 1; return a`, CompilerOptions{}, func(bc *Bytecode) {
+		var buf bytes.Buffer
+		require.NoError(t, patcher.PatchForTrace(bc, patcher.NewJSONTraceFunc(&buf)))
+		_, err := NewVM(bc).Run(nil)
+		require.NoError(t, err)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, 3)
+		require.Contains(t, lines[1], `"callDepth":1`)
+		var ev patcher.TraceEvent
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &ev))
+		require.Equal(t, patcher.TraceEvent{
+			Kind:      patcher.TraceLine,
+			Func:      "main",
+			File:      "(main)",
+			Line:      1,
+			Column:    6,
+			Opcode:    "CONSTANT",
+			CallDepth: 1,
+		}, ev)
+	})
+
+	expectCompile(t, `for {}`, CompilerOptions{}, func(bc *Bytecode) {
+		errStop := errors.New("stop")
+		var n int
+		err := patcher.PatchForTrace(bc, func(ev patcher.TraceEvent) error {
+			if n++; n == 10 {
+				return errStop
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		_, err = NewVM(bc).Run(nil)
+		require.True(t, errors.Is(err, errStop))
+	})
+}
+
+func TestPatchForTraceRecursiveThrow(t *testing.T) {
+	script := `var g
+g = func(n) {
+	if n == 1 {
+		throw "x"
+	}
+	if n > 0 {
+		return g(n-1)
+	}
+	try {
+		g(3)
+	} catch e {
+	}
+	return 0
+}
+return g(0)`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		depths := map[int]int{}
+		err := patcher.PatchForTrace(bc, func(ev patcher.TraceEvent) error {
+			if ev.Kind == patcher.TraceLine {
+				depths[ev.Line] = ev.CallDepth
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		_, err = NewVM(bc).Run(nil)
+		require.NoError(t, err)
+		// frames left by the error are popped in the outer frame of g
+		require.Equal(t, 5, depths[4])
+		require.Equal(t, 2, depths[13])
+	})
+}
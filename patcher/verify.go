@@ -0,0 +1,167 @@
+package patcher
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ozanh/ugo"
+)
+
+// Debug enables verifying the bytecode with Verify after each patch. Patcher
+// skips the checks of the constant indexes since the callers may append the
+// constants after patching, the patch functions of this package verify the
+// bytecode again after adding their constants. It is intended to be used in
+// tests and while developing new patches.
+var Debug = false
+
+// VerifyError is the error returned by Verify.
+type VerifyError struct {
+	// FuncIndex is the constant index of the function, -1 for main function.
+	FuncIndex int
+	// Pos is the position of the instruction in the function, or -1 if the
+	// error is not related to an instruction.
+	Pos     int
+	Message string
+}
+
+func (e *VerifyError) Error() string {
+	fn := "main"
+	if e.FuncIndex >= 0 {
+		fn = fmt.Sprintf("function at constant %d", e.FuncIndex)
+	}
+	if e.Pos < 0 {
+		return fmt.Sprintf("verify %s: %s", fn, e.Message)
+	}
+	return fmt.Sprintf("verify %s at %d: %s", fn, e.Pos, e.Message)
+}
+
+// Verify checks the instructions of the main function and the compiled
+// functions in constants of given ugo.Bytecode. Opcodes must be known and
+// operands must fit into the instructions, jumps must target instructions of
+// the same function, catch and finally targets of try statements must be
+// OpSetupCatch and OpSetupFinally respectively, constant, module and local
+// variable indexes must be in range, and the source map keys must point at
+// instructions. It returns a *VerifyError for the first problem found.
+func Verify(bc *ugo.Bytecode) error {
+	return verify(bc, true)
+}
+
+func debugVerify(bc *ugo.Bytecode) error {
+	if !Debug {
+		return nil
+	}
+	return Verify(bc)
+}
+
+func verify(bc *ugo.Bytecode, checkConsts bool) error {
+	if bc.Main == nil {
+		return &VerifyError{FuncIndex: -1, Pos: -1, Message: "no main function"}
+	}
+	v := &verifier{bc: bc, checkConsts: checkConsts}
+	if err := v.verifyFunc(bc.Main, -1); err != nil {
+		return err
+	}
+	for i, c := range bc.Constants {
+		if fn, ok := c.(*ugo.CompiledFunction); ok {
+			if err := v.verifyFunc(fn, i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	bc          *ugo.Bytecode
+	checkConsts bool
+	starts      map[int]ugo.Opcode
+}
+
+func (v *verifier) verifyFunc(fn *ugo.CompiledFunction, index int) error {
+	fail := func(pos int, format string, args ...any) error {
+		return &VerifyError{
+			FuncIndex: index,
+			Pos:       pos,
+			Message:   fmt.Sprintf(format, args...),
+		}
+	}
+
+	insts := fn.Instructions
+	v.starts = make(map[int]ugo.Opcode)
+	it := NewIterator(insts)
+	for it.Next() {
+		v.starts[it.Pos()] = it.Opcode()
+	}
+	if err := it.Error(); err != nil {
+		if pos := it.Pos(); pos >= 0 && pos+1+it.Offset() > len(insts) {
+			return fail(pos, "%s operands exceed instructions",
+				ugo.OpcodeNames[it.Opcode()])
+		}
+		return fail(-1, "%s", err)
+	}
+
+	// check operands after collecting all instruction starts for jumps
+	it.Reset(insts)
+	for it.Next() {
+		pos := it.Pos()
+		opcode := it.Opcode()
+		operands := it.Operands()
+		switch opcode {
+		case ugo.OpJump, ugo.OpJumpFalsy, ugo.OpAndJump, ugo.OpOrJump:
+			if _, ok := v.starts[operands[0]]; !ok {
+				return fail(pos, "%s target %d is not an instruction",
+					ugo.OpcodeNames[opcode], operands[0])
+			}
+		case ugo.OpSetupTry:
+			if operands[0] != 0 && v.starts[operands[0]] != ugo.OpSetupCatch {
+				return fail(pos, "catch target %d is not %s",
+					operands[0], ugo.OpcodeNames[ugo.OpSetupCatch])
+			}
+			if operands[1] == 0 || v.starts[operands[1]] != ugo.OpSetupFinally {
+				return fail(pos, "finally target %d is not %s",
+					operands[1], ugo.OpcodeNames[ugo.OpSetupFinally])
+			}
+		case ugo.OpConstant, ugo.OpGetGlobal, ugo.OpSetGlobal,
+			ugo.OpLoadModule, ugo.OpClosure:
+			if opcode == ugo.OpLoadModule && operands[1] >= v.bc.NumModules {
+				return fail(pos, "%s module index %d out of range [0,%d)",
+					ugo.OpcodeNames[opcode], operands[1], v.bc.NumModules)
+			}
+			if !v.checkConsts {
+				break
+			}
+			if operands[0] >= len(v.bc.Constants) {
+				return fail(pos, "%s constant index %d out of range [0,%d)",
+					ugo.OpcodeNames[opcode], operands[0], len(v.bc.Constants))
+			}
+			if opcode == ugo.OpClosure {
+				if _, ok := v.bc.Constants[operands[0]].(*ugo.CompiledFunction); !ok {
+					return fail(pos, "%s constant %d is not a function",
+						ugo.OpcodeNames[opcode], operands[0])
+				}
+			}
+		case ugo.OpStoreModule:
+			if operands[0] >= v.bc.NumModules {
+				return fail(pos, "%s module index %d out of range [0,%d)",
+					ugo.OpcodeNames[opcode], operands[0], v.bc.NumModules)
+			}
+		case ugo.OpGetLocal, ugo.OpSetLocal, ugo.OpDefineLocal, ugo.OpGetLocalPtr:
+			if operands[0] >= fn.NumLocals {
+				return fail(pos, "%s local index %d out of range [0,%d)",
+					ugo.OpcodeNames[opcode], operands[0], fn.NumLocals)
+			}
+		}
+	}
+
+	ips := make([]int, 0, len(fn.SourceMap))
+	for ip := range fn.SourceMap {
+		ips = append(ips, ip)
+	}
+	sort.Ints(ips)
+	for _, ip := range ips {
+		if _, ok := v.starts[ip]; !ok {
+			return fail(-1, "source map key %d is not an instruction", ip)
+		}
+	}
+	return nil
+}
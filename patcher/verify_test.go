@@ -0,0 +1,135 @@
+package patcher_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestMain(m *testing.M) {
+	// verify all patches done in tests
+	patcher.Debug = true
+	os.Exit(m.Run())
+}
+
+func TestVerify(t *testing.T) {
+	script := `
+f := func(x) {
+	try {
+		if x {
+			throw "error"
+		}
+	} catch err {
+		return err
+	} finally {
+		x = 0
+	}
+	return x
+}
+for i := 0; i < 10; i++ {
+	f(i)
+}
+return f(0)`
+
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		require.NoError(t, patcher.Verify(bc))
+		_, err := patcher.PatchForGosched(bc, 10)
+		require.NoError(t, err)
+		require.NoError(t, patcher.Verify(bc))
+		_, err = patcher.PatchForCoverage(bc)
+		require.NoError(t, err)
+		require.NoError(t, patcher.Verify(bc))
+	})
+
+	expectVerifyError := func(t *testing.T, bc *Bytecode, fnIndex, pos int, msg string) {
+		t.Helper()
+		err := patcher.Verify(bc)
+		require.Error(t, err)
+		var verr *patcher.VerifyError
+		require.True(t, errors.As(err, &verr), "%v", err)
+		require.Equal(t, fnIndex, verr.FuncIndex)
+		require.Equal(t, pos, verr.Pos)
+		require.Equal(t, msg, verr.Message)
+	}
+
+	newBytecode := func(insts []byte, consts ...Object) *Bytecode {
+		return &Bytecode{
+			Main:      &CompiledFunction{Instructions: insts, NumLocals: 1},
+			Constants: consts,
+		}
+	}
+
+	expectVerifyError(t, newBytecode([]byte{255}), -1, -1,
+		"invalid opcode 255 at 0")
+	expectVerifyError(t, newBytecode([]byte{byte(OpConstant), 0}), -1, 0,
+		"CONSTANT operands exceed instructions")
+	expectVerifyError(t,
+		newBytecode(concatInsts(
+			makeInst(OpJump, 7),
+			makeInst(OpNull),
+			makeInst(OpReturn, 1),
+		)), -1, 0, "JUMP target 7 is not an instruction")
+	expectVerifyError(t,
+		newBytecode(concatInsts(
+			makeInst(OpSetupTry, 10, 10),
+			makeInst(OpSetupCatch),
+			makeInst(OpSetupFinally),
+			makeInst(OpReturn, 0),
+		)), -1, 0, "catch target 10 is not SETUPCATCH")
+	expectVerifyError(t,
+		newBytecode(concatInsts(
+			makeInst(OpSetupTry, 9, 9),
+			makeInst(OpSetupCatch),
+			makeInst(OpSetupFinally),
+			makeInst(OpReturn, 0),
+		)), -1, 0, "finally target 9 is not SETUPFINALLY")
+	expectVerifyError(t,
+		newBytecode(concatInsts(
+			makeInst(OpConstant, 1),
+			makeInst(OpReturn, 1),
+		), Int(1)), -1, 0, "CONSTANT constant index 1 out of range [0,1)")
+	expectVerifyError(t,
+		newBytecode(concatInsts(
+			makeInst(OpLoadModule, 0, 0),
+			makeInst(OpReturn, 1),
+		), Int(1)), -1, 0, "LOADMODULE module index 0 out of range [0,0)")
+	expectVerifyError(t,
+		newBytecode(concatInsts(
+			makeInst(OpNull),
+			makeInst(OpStoreModule, 1),
+			makeInst(OpReturn, 1),
+		)), -1, 1, "STOREMODULE module index 1 out of range [0,0)")
+	expectVerifyError(t,
+		newBytecode(concatInsts(
+			makeInst(OpClosure, 0, 0),
+			makeInst(OpReturn, 1),
+		), Int(1)), -1, 0, "CLOSURE constant 0 is not a function")
+	expectVerifyError(t,
+		newBytecode(concatInsts(
+			makeInst(OpNull),
+			makeInst(OpSetLocal, 1),
+			makeInst(OpReturn, 0),
+		)), -1, 1, "SETLOCAL local index 1 out of range [0,1)")
+
+	bc := newBytecode(concatInsts(
+		makeInst(OpNull),
+		makeInst(OpReturn, 1),
+	))
+	bc.Main.SourceMap = map[int]int{0: 1, 2: 2}
+	expectVerifyError(t, bc, -1, -1, "source map key 2 is not an instruction")
+
+	fn := &CompiledFunction{Instructions: makeInst(OpReturn, 2)}
+	bc = newBytecode(concatInsts(makeInst(OpReturn, 0)), Int(0), fn)
+	bc.Main.SourceMap = map[int]int{0: 1}
+	require.NoError(t, patcher.Verify(bc))
+	fn.SourceMap = map[int]int{1: 1}
+	err := patcher.Verify(bc)
+	require.EqualError(t, err,
+		"verify function at constant 1: source map key 1 is not an instruction")
+}
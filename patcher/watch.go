@@ -0,0 +1,460 @@
+package patcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugo/parser"
+)
+
+// List of watch event kinds.
+const (
+	WatchLocal  = "local"
+	WatchGlobal = "global"
+	WatchFree   = "free"
+	WatchIndex  = "index"
+)
+
+// WatchEvent is the event emitted by the callables added by PatchForWatch
+// after a variable or an index is written.
+type WatchEvent struct {
+	// Kind is one of WatchLocal, WatchGlobal, WatchFree and WatchIndex.
+	Kind string
+	// Name is the name of the variable, or the name of the variable holding
+	// the target of WatchIndex events if the target is a variable. Locals are
+	// named as "local#<index>" and free variables are named as
+	// "free#<index>" if their names cannot be resolved.
+	Name string
+	// Target and Index are the target and the index of WatchIndex events.
+	Target ugo.Object
+	Index  ugo.Object
+	// Old is the value before the write. Old values of WatchIndex events are
+	// read with IndexGet, which is ugo.Undefined if it fails.
+	Old ugo.Object
+	New ugo.Object
+	// Func is the name of the function, main function is named as "main".
+	Func   string
+	Pos    parser.Pos
+	File   string
+	Line   int
+	Column int
+}
+
+// WatchFunc is called for each watch event. Returned error is thrown in the
+// script.
+type WatchFunc func(ev WatchEvent) error
+
+// WatchOptions configures PatchForWatch.
+type WatchOptions struct {
+	// SymbolTable is the symbol table of the compiler options to resolve the
+	// names of the locals of the main function. Note that the compiler reuses
+	// the indexes of the locals of closed blocks, which are named after the
+	// last symbol of the index.
+	SymbolTable *ugo.SymbolTable
+	// Names is the names of the variables to watch, index writes are watched
+	// if their targets are in Names. All writes are watched if it is nil.
+	Names []string
+}
+
+// PatchForWatch modifies given ugo.Bytecode to call fn after writes to local,
+// global and free variables and index assignments. Names of globals are known,
+// names of the locals of the main function are resolved with the symbol table
+// and names of free variables are resolved through the closures capturing
+// them. If error is returned, given ugo.Bytecode must be discarded due to
+// invalid patching.
+func PatchForWatch(bc *ugo.Bytecode, fn WatchFunc, opts WatchOptions) error {
+	_, err := NewPipeline(WatchPass(fn, opts)).Run(bc)
+	return err
+}
+
+// WatchPass returns a Pass for Pipeline patching like PatchForWatch.
+func WatchPass(fn WatchFunc, opts WatchOptions) Pass {
+	// Replace variable writes with the following instructions, GET and SET
+	// are the instructions of the variable kind, <temp> is a local variable
+	// added to the function.
+	/*
+		0000 GET <var>
+		0000 DEFINELOCAL <temp>
+		0000 SET <var>
+		0000 CONSTANT <site index>
+		0000 GETLOCAL <temp>
+		0000 GET <var>
+		0000 CALL 2 0
+		0000 POP
+	*/
+	// Replace index writes with the following instructions, which call the
+	// site to set the index.
+	/*
+		0000 DEFINELOCAL <temp+2>
+		0000 DEFINELOCAL <temp+1>
+		0000 DEFINELOCAL <temp>
+		0000 CONSTANT <site index>
+		0000 GETLOCAL <temp+1>
+		0000 GETLOCAL <temp+2>
+		0000 GETLOCAL <temp>
+		0000 CALL 3 0
+		0000 POP
+	*/
+
+	if fn == nil {
+		panic("fn must not be nil")
+	}
+
+	names := makeStringSet(opts.Names)
+	var pc *PassContext
+	var w *watchNames
+
+	var curFn *ugo.CompiledFunction
+	var curName string
+	var leaders map[int]struct{}
+	var tempIndex int
+	// last two instructions of the current block to find the targets of index
+	// writes
+	var prev [2]watchInst
+
+	var key string
+	if opts.Names != nil {
+		key = "names=" + strings.Join(opts.Names, ",")
+	}
+	if opts.SymbolTable != nil {
+		key += ";symbols"
+	}
+
+	return Pass{
+		Name: "watch",
+		Key:  key,
+		Start: func(c *PassContext) error {
+			pc = c
+			var err error
+			w, err = newWatchNames(c.Bytecode(), opts.SymbolTable)
+			return err
+		},
+		Visit: func(it *Iterator) (Op, []byte, error) {
+			if curFn != it.Func() {
+				curFn = it.Func()
+				curName, _ = FuncName(pc.Bytecode().FileSet, curFn, it.FuncIndex())
+				blocks, err := basicBlocks(curFn.Instructions)
+				if err != nil {
+					return Next, nil, err
+				}
+				leaders = make(map[int]struct{}, len(blocks))
+				for _, b := range blocks {
+					leaders[b.start] = struct{}{}
+				}
+				tempIndex = -1
+				prev = [2]watchInst{}
+			}
+			if _, ok := leaders[it.Pos()]; ok {
+				prev = [2]watchInst{}
+			}
+			op := it.Opcode()
+			operands := it.Operands()
+			last := prev
+			prev = [2]watchInst{prev[1], {op: op, operand: -1}}
+			if len(operands) > 0 {
+				prev[1].operand = operands[0]
+			}
+
+			var kind, name string
+			var get ugo.Opcode
+			switch op {
+			case ugo.OpSetLocal:
+				kind, get = WatchLocal, ugo.OpGetLocal
+				name = w.local(curFn, operands[0])
+			case ugo.OpSetGlobal:
+				kind, get = WatchGlobal, ugo.OpGetGlobal
+				name = w.global(operands[0])
+			case ugo.OpSetFree:
+				kind, get = WatchFree, ugo.OpGetFree
+				name = w.free(curFn, operands[0])
+			case ugo.OpSetIndex:
+				kind = WatchIndex
+				// target is pushed before the index, which must be pushed by
+				// a single instruction
+				switch index := last[1].op; {
+				case pushOnly(index), index == ugo.OpGetGlobal, index == ugo.OpGetFree:
+					name = w.load(curFn, last[0])
+				}
+			default:
+				return Next, nil, nil
+			}
+			if names != nil {
+				if _, ok := names[name]; !ok {
+					return Next, nil, nil
+				}
+			}
+
+			if tempIndex < 0 {
+				if curFn.NumLocals > 256-3 {
+					return Next, nil, fmt.Errorf(
+						"no local variable left for watch: %d", curFn.NumLocals)
+				}
+				tempIndex = curFn.NumLocals
+				curFn.NumLocals += 3
+			}
+			site := &watchSite{fn: fn, event: WatchEvent{Kind: kind, Name: name,
+				Func: curName}}
+			site.event.Pos = parser.Pos(curFn.SourceMap[it.Pos()])
+			if fileSet := pc.Bytecode().FileSet; fileSet != nil && site.event.Pos.IsValid() {
+				p := fileSet.Position(site.event.Pos)
+				site.event.File, site.event.Line, site.event.Column =
+					p.Filename, p.Line, p.Column
+			}
+			siteIndex := pc.AddConstant(site)
+			pc.setCached(siteIndex, site.cached())
+
+			var insts []byte
+			var err error
+			if op == ugo.OpSetIndex {
+				insts, err = makeInsts(
+					[]int{int(ugo.OpDefineLocal), tempIndex + 2},
+					[]int{int(ugo.OpDefineLocal), tempIndex + 1},
+					[]int{int(ugo.OpDefineLocal), tempIndex},
+					[]int{int(ugo.OpConstant), siteIndex},
+					[]int{int(ugo.OpGetLocal), tempIndex + 1},
+					[]int{int(ugo.OpGetLocal), tempIndex + 2},
+					[]int{int(ugo.OpGetLocal), tempIndex},
+					[]int{int(ugo.OpCall), 3, 0},
+					[]int{int(ugo.OpPop)},
+				)
+			} else {
+				insts, err = makeInsts(
+					[]int{int(get), operands[0]},
+					[]int{int(ugo.OpDefineLocal), tempIndex},
+					[]int{int(op), operands[0]},
+					[]int{int(ugo.OpConstant), siteIndex},
+					[]int{int(ugo.OpGetLocal), tempIndex},
+					[]int{int(get), operands[0]},
+					[]int{int(ugo.OpCall), 2, 0},
+					[]int{int(ugo.OpPop)},
+				)
+			}
+			return Replace, insts, err
+		},
+		Attach: func(_ *ugo.Bytecode, consts []ugo.Object) error {
+			for i, c := range consts {
+				site, err := newCachedWatchSite(fn, c)
+				if err != nil {
+					return err
+				}
+				consts[i] = site
+			}
+			return nil
+		},
+	}
+}
+
+// watchInst is an instruction with its first operand, or -1 if it has none.
+type watchInst struct {
+	op      ugo.Opcode
+	operand int
+}
+
+// watchNames resolves the names of the variables of a bytecode.
+type watchNames struct {
+	bc *ugo.Bytecode
+	// mainLocals holds the names of the locals of the main function by index.
+	mainLocals map[int]string
+	// captures holds the instructions loading the free variables of the
+	// functions and the functions executing them.
+	captures map[*ugo.CompiledFunction]watchCapture
+}
+
+// watchCapture is the closure creation capturing the free variables of a
+// function, vars are GETLOCALPTR and GETFREEPTR instructions of parent in the
+// order of free variable indexes.
+type watchCapture struct {
+	parent *ugo.CompiledFunction
+	vars   []watchInst
+}
+
+func newWatchNames(bc *ugo.Bytecode, st *ugo.SymbolTable) (*watchNames, error) {
+	w := &watchNames{
+		bc:         bc,
+		mainLocals: make(map[int]string),
+		captures:   make(map[*ugo.CompiledFunction]watchCapture),
+	}
+	if st != nil {
+		st.Range(false, func(sym *ugo.Symbol) bool {
+			if sym.Scope == ugo.ScopeLocal {
+				w.mainLocals[sym.Index] = sym.Name
+			}
+			return true
+		})
+	}
+
+	fns := []*ugo.CompiledFunction{bc.Main}
+	for _, c := range bc.Constants {
+		if fn, ok := c.(*ugo.CompiledFunction); ok {
+			fns = append(fns, fn)
+		}
+	}
+	for _, fn := range fns {
+		var insts []watchInst
+		it := NewIterator(fn.Instructions)
+		for it.Next() {
+			operands := it.Operands()
+			switch op := it.Opcode(); op {
+			case ugo.OpGetLocalPtr, ugo.OpGetFreePtr:
+				insts = append(insts, watchInst{op: op, operand: operands[0]})
+				continue
+			case ugo.OpClosure:
+				n := operands[1]
+				cf, ok := bc.Constants[operands[0]].(*ugo.CompiledFunction)
+				if ok && n <= len(insts) {
+					w.captures[cf] = watchCapture{
+						parent: fn,
+						vars:   append([]watchInst(nil), insts[len(insts)-n:]...),
+					}
+				}
+			}
+			insts = insts[:0]
+		}
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *watchNames) local(fn *ugo.CompiledFunction, index int) string {
+	if fn == w.bc.Main {
+		if name, ok := w.mainLocals[index]; ok {
+			return name
+		}
+	}
+	return fmt.Sprintf("local#%d", index)
+}
+
+func (w *watchNames) global(index int) string {
+	if s, ok := w.bc.Constants[index].(ugo.String); ok {
+		return string(s)
+	}
+	return w.bc.Constants[index].String()
+}
+
+func (w *watchNames) free(fn *ugo.CompiledFunction, index int) string {
+	// closures capturing each other would recurse forever, limit the depth
+	for depth := 0; depth < 256; depth++ {
+		c, ok := w.captures[fn]
+		if !ok || index >= len(c.vars) {
+			break
+		}
+		v := c.vars[index]
+		if v.op == ugo.OpGetLocalPtr {
+			return w.local(c.parent, v.operand)
+		}
+		fn, index = c.parent, v.operand
+	}
+	return fmt.Sprintf("free#%d", index)
+}
+
+// load returns the name of the variable loaded by given instruction, or an
+// empty string if it is not a variable load.
+func (w *watchNames) load(fn *ugo.CompiledFunction, inst watchInst) string {
+	switch inst.op {
+	case ugo.OpGetLocal:
+		return w.local(fn, inst.operand)
+	case ugo.OpGetGlobal:
+		return w.global(inst.operand)
+	case ugo.OpGetFree:
+		return w.free(fn, inst.operand)
+	}
+	return ""
+}
+
+// watchSite is the callable added to ugo.Bytecode by PatchForWatch to emit the
+// events of a write.
+type watchSite struct {
+	ugo.ObjectImpl
+	fn    WatchFunc
+	event WatchEvent
+}
+
+var _ ugo.ExCallerObject = (*watchSite)(nil)
+
+// cached returns the event of the site stored by Cache.
+func (s *watchSite) cached() ugo.Object {
+	return ugo.Array{
+		ugo.String(s.event.Kind),
+		ugo.String(s.event.Name),
+		ugo.String(s.event.Func),
+		ugo.Int(s.event.Pos),
+		ugo.String(s.event.File),
+		ugo.Int(s.event.Line),
+		ugo.Int(s.event.Column),
+	}
+}
+
+// newCachedWatchSite returns the site of the event stored by Cache.
+func newCachedWatchSite(fn WatchFunc, obj ugo.Object) (*watchSite, error) {
+	arr, ok := obj.(ugo.Array)
+	if !ok || len(arr) != 7 {
+		return nil, fmt.Errorf("attach: invalid watch event: %s", obj)
+	}
+	kind, ok1 := arr[0].(ugo.String)
+	name, ok2 := arr[1].(ugo.String)
+	fnName, ok3 := arr[2].(ugo.String)
+	pos, ok4 := arr[3].(ugo.Int)
+	file, ok5 := arr[4].(ugo.String)
+	line, ok6 := arr[5].(ugo.Int)
+	column, ok7 := arr[6].(ugo.Int)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 || !ok7 {
+		return nil, fmt.Errorf("attach: invalid watch event: %s", obj)
+	}
+	return &watchSite{fn: fn, event: WatchEvent{
+		Kind:   string(kind),
+		Name:   string(name),
+		Func:   string(fnName),
+		Pos:    parser.Pos(pos),
+		File:   string(file),
+		Line:   int(line),
+		Column: int(column),
+	}}, nil
+}
+
+func (s *watchSite) String() string   { return "<watchSite>" }
+func (s *watchSite) TypeName() string { return s.String() }
+func (s *watchSite) CanCall() bool    { return true }
+
+func (s *watchSite) Call(args ...ugo.Object) (ugo.Object, error) {
+	return s.CallEx(ugo.NewCall(nil, args))
+}
+
+func (s *watchSite) CallEx(c ugo.Call) (ugo.Object, error) {
+	ev := s.event
+	if ev.Kind == WatchIndex {
+		if err := c.CheckLen(3); err != nil {
+			return ugo.Undefined, err
+		}
+		ev.Target, ev.Index, ev.New = c.Get(0), c.Get(1), c.Get(2)
+		if old, err := ev.Target.IndexGet(ev.Index); err == nil && old != nil {
+			ev.Old = old
+		} else {
+			ev.Old = ugo.Undefined
+		}
+		// errors are the same as the ones of SETINDEX
+		if err := ev.Target.IndexSet(ev.Index, ev.New); err != nil {
+			switch err {
+			case ugo.ErrNotIndexAssignable:
+				err = ugo.ErrNotIndexAssignable.NewError(ev.Target.TypeName())
+			case ugo.ErrIndexOutOfBounds:
+				err = ugo.ErrIndexOutOfBounds.NewError(ev.Index.String())
+			}
+			return ugo.Undefined, err
+		}
+	} else {
+		if err := c.CheckLen(2); err != nil {
+			return ugo.Undefined, err
+		}
+		ev.Old, ev.New = c.Get(0), c.Get(1)
+		if ev.Old == nil {
+			ev.Old = ugo.Undefined
+		}
+	}
+	if err := s.fn(ev); err != nil {
+		return ugo.Undefined, err
+	}
+	return ugo.Undefined, nil
+}
@@ -0,0 +1,116 @@
+package patcher_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ozanh/ugodev/patcher"
+
+	. "github.com/ozanh/ugo"
+)
+
+func TestPatchForWatch(t *testing.T) {
+	script := `global g
+a := {x: 1}
+b := 1
+b = 2
+a.x = b
+g = "v"
+f := func() {
+	b += 1
+	c := [0]
+	c[0] = 5
+	return c
+}
+f()
+a[b] = 4
+return [a, b, g]`
+
+	type event struct {
+		kind, name, fn string
+		old, new       Object
+		line           int
+	}
+	run := func(t *testing.T, symbols bool, names ...string) []event {
+		t.Helper()
+		var events []event
+		st := NewSymbolTable()
+		expectCompile(t, script, CompilerOptions{SymbolTable: st}, func(bc *Bytecode) {
+			opts := patcher.WatchOptions{Names: names}
+			if symbols {
+				opts.SymbolTable = st
+			}
+			err := patcher.PatchForWatch(bc, func(ev patcher.WatchEvent) error {
+				events = append(events, event{ev.Kind, ev.Name, ev.Func, ev.Old,
+					ev.New, ev.Line})
+				return nil
+			}, opts)
+			require.NoError(t, err)
+			ret, err := NewVM(bc).Run(Map{})
+			require.NoError(t, err)
+			require.Equal(t, Array{Map{"x": Int(2), "3": Int(4)}, Int(3), String("v")},
+				ret)
+		})
+		return events
+	}
+
+	f := "func@(main):8:2"
+	events := run(t, true)
+	require.Equal(t, []event{
+		{patcher.WatchLocal, "b", "main", Int(1), Int(2), 4},
+		{patcher.WatchIndex, "a", "main", Int(1), Int(2), 5},
+		{patcher.WatchGlobal, "g", "main", Undefined, String("v"), 6},
+		{patcher.WatchFree, "b", f, Int(2), Int(3), 8},
+		{patcher.WatchIndex, "local#0", f, Int(0), Int(5), 10},
+		{patcher.WatchIndex, "a", "main", Undefined, Int(4), 14},
+	}, events)
+
+	// names are not resolved without symbol table
+	events = run(t, false)
+	require.Equal(t, "local#1", events[0].name)
+	require.Equal(t, "local#0", events[1].name)
+	require.Equal(t, "local#1", events[3].name)
+
+	events = run(t, true, "b", "g")
+	require.Len(t, events, 3)
+	for _, ev := range events {
+		require.Contains(t, []string{"b", "g"}, ev.name)
+	}
+}
+
+func TestPatchForWatchErrors(t *testing.T) {
+	// errors of the callback are thrown
+	expectCompile(t, `a := 1; try { a = 2 } catch err { return string(err) }`,
+		CompilerOptions{}, func(bc *Bytecode) {
+			err := patcher.PatchForWatch(bc, func(ev patcher.WatchEvent) error {
+				return fmt.Errorf("readonly %s", ev.Name)
+			}, patcher.WatchOptions{Names: []string{"local#0"}})
+			require.NoError(t, err)
+			ret, err := NewVM(bc).Run(nil)
+			require.NoError(t, err)
+			require.Equal(t, String("error: readonly local#0"), ret)
+		})
+
+	// index errors are the same as the ones of SETINDEX
+	script := `a := [1]; a[2] = 1`
+	expectCompile(t, script, CompilerOptions{}, func(bc *Bytecode) {
+		_, expected := NewVM(bc).Run(nil)
+		require.Error(t, expected)
+
+		bc, err := Compile([]byte(script), CompilerOptions{})
+		require.NoError(t, err)
+		var called bool
+		err = patcher.PatchForWatch(bc, func(ev patcher.WatchEvent) error {
+			called = true
+			return nil
+		}, patcher.WatchOptions{})
+		require.NoError(t, err)
+		_, err = NewVM(bc).Run(nil)
+		require.True(t, errors.Is(err, ErrIndexOutOfBounds))
+		require.Equal(t, expected.Error(), err.Error())
+		require.False(t, called)
+	})
+}
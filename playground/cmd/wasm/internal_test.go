@@ -4,11 +4,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strings"
 	"syscall/js"
 	"testing"
 	"time"
+
+	"github.com/ozanh/ugo"
+	"github.com/ozanh/ugodev/patcher"
 )
 
 func Test_run(t *testing.T) {
@@ -265,6 +272,151 @@ func Test_sample(t *testing.T) {
 	}
 }
 
+func Test_sample_patched(t *testing.T) {
+	code, err := os.ReadFile("testdata/sample.ugo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts := []struct {
+		name   string
+		script string
+		err    string
+	}{
+		{"sample", string(code), ""},
+		{"error", `
+f := func(n) {
+  x := 0
+  for i := 0; i < n; i++ {
+    x += i
+  }
+  return x / (n - n)
+}
+println(f(10))`, "ZeroDivisionError: \n\tat (main):9:1\n\t   (main):7:10"},
+	}
+	for _, s := range scripts {
+		ret, stdout, err := runScript(t, s.script, false)
+		pret, pstdout, perr := runScript(t, s.script, true)
+		if pret != ret {
+			t.Fatalf("%s: expected value: %q, got: %q", s.name, ret, pret)
+		}
+		stdout, pstdout = sortMapOutput(stdout), sortMapOutput(pstdout)
+		if pstdout != stdout {
+			t.Fatalf("%s: expected stdout:\n%s\ngot:\n%s", s.name, stdout, pstdout)
+		}
+		if perr != err {
+			t.Fatalf("%s: expected error: %q, got: %q", s.name, err, perr)
+		}
+		if !strings.HasPrefix(err, s.err) {
+			t.Fatalf("%s: expected error prefix: %q, got: %q", s.name, s.err, err)
+		}
+	}
+}
+
+func Benchmark_sample(b *testing.B) {
+	code, err := os.ReadFile("testdata/sample.ugo")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// discard the output of println builtin and fmt module
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	printWriter, stdout := ugo.PrintWriter, os.Stdout
+	ugo.PrintWriter, os.Stdout = io.Discard, devNull
+	b.Cleanup(func() {
+		ugo.PrintWriter, os.Stdout = printWriter, stdout
+		_ = devNull.Close()
+	})
+
+	patches := []struct {
+		name  string
+		patch func(bc *ugo.Bytecode) error
+	}{
+		{"compiled", func(*ugo.Bytecode) error { return nil }},
+		{"optimized", func(bc *ugo.Bytecode) error {
+			_, err := patcher.Optimize(bc)
+			return err
+		}},
+		{"gosched", func(bc *ugo.Bytecode) error {
+			_, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+				CallThreshold: 100,
+				Quantum:       10 * time.Millisecond,
+				Placement:     patcher.GoschedLoops,
+			})
+			return err
+		}},
+		{"playground", func(bc *ugo.Bytecode) error {
+			return patchBytecode(context.Background(), bc)
+		}},
+	}
+	for _, p := range patches {
+		bc, err := ugo.Compile(code, newRunOptions())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := p.patch(bc); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(p.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ugo.NewVM(bc).Run(nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// runScript runs given script with the options of runUGO, and patches it like
+// runUGO if patch is true. It returns the value and the error formatted like
+// runUGO and the output of the script.
+func runScript(t *testing.T, script string, patch bool) (string, string, string) {
+	t.Helper()
+
+	bc, err := ugo.Compile([]byte(script), newRunOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patch {
+		if err := patchBytecode(context.Background(), bc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gStdout.Reset()
+	defer gStdout.Reset()
+	ret, err := ugo.NewVM(bc).Run(nil)
+	if err != nil {
+		return "", gStdout.String(), fmt.Sprintf("%+v", err)
+	}
+	return ret.String(), gStdout.String(), ""
+}
+
+// sortMapOutput sorts the parts of given output depending on the iteration
+// order of maps, which are the elements of printed maps and arrays, and the
+// lines printed while iterating a map in sample.ugo.
+func sortMapOutput(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if n := len(line); n > 1 && (line[0] == '{' || line[0] == '[') {
+			elems := strings.Split(line[1:n-1], ", ")
+			sort.Strings(elems)
+			lines[i] = line[:1] + strings.Join(elems, ", ") + line[n-1:]
+		}
+	}
+	for i := 0; i < len(lines); {
+		j := i
+		for j < len(lines) && strings.HasPrefix(lines[j], "key:") {
+			j++
+		}
+		sort.Strings(lines[i:j])
+		i = j + 1
+	}
+	return strings.Join(lines, "\n")
+}
+
 func setupRun(t *testing.T) <-chan []js.Value {
 	t.Helper()
 
@@ -83,14 +83,38 @@ func newErrorResult(err string) map[string]any {
 	}
 }
 
-func makeRunFunc() js.Func {
-	opts := ugo.CompilerOptions{
+func newRunOptions() ugo.CompilerOptions {
+	return ugo.CompilerOptions{
 		ModuleMap: ugo.NewModuleMap().
 			AddBuiltinModule("time", ugotime.Module).
 			AddBuiltinModule("strings", ugostrings.Module).
 			AddBuiltinModule("fmt", ugofmt.Module).
 			AddBuiltinModule("json", ugojson.Module),
 	}
+}
+
+// patchBytecode optimizes given bytecode and patches it to yield to the
+// browser event loop, running it is canceled once given context is done.
+func patchBytecode(ctx context.Context, bc *ugo.Bytecode) error {
+	if _, err := patcher.Optimize(bc); err != nil {
+		return err
+	}
+
+	// Yield to the browser event loop on every time slice, the clock
+	// is read on every schedThreshold calls.
+	const schedThreshold = 100
+	const schedQuantum = 10 * time.Millisecond
+	_, err := patcher.PatchForGoschedOptions(bc, patcher.GoschedOptions{
+		Context:       ctx,
+		CallThreshold: schedThreshold,
+		Quantum:       schedQuantum,
+		Placement:     patcher.GoschedLoops,
+	})
+	return err
+}
+
+func makeRunFunc() js.Func {
+	opts := newRunOptions()
 
 	return js.FuncOf(func(this js.Value, args []js.Value) any {
 		if len(args) != 2 {
@@ -151,48 +175,22 @@ func makeRunFunc() js.Func {
 				return
 			}
 
-			const schedThreshold = 1000
-			if _, err = patcher.PatchForGosched(bc, schedThreshold); err != nil {
+			runCtx, runCancel := context.WithTimeout(ctx, maxExecDuration)
+			defer runCancel()
+
+			if err = patchBytecode(runCtx, bc); err != nil {
 				callback(newResult(err.Error(), "", metrics.output()))
 				return
 			}
 
-			var ret ugo.Object
-			var waitCh = make(chan struct{})
-
-			vm := ugo.NewVM(bc)
-			defer vm.Abort()
-
-			go func() {
-				defer close(waitCh)
-				defer metrics.initExec()()
-
-				ret, err = vm.Run(nil)
-			}()
-
-			tm := time.NewTimer(maxExecDuration)
-			defer tm.Stop()
-
-			var isCtxDone bool
-			select {
-			case <-ctx.Done():
-				isCtxDone = true
-				vm.Abort()
-			case <-tm.C:
-				vm.Abort()
-			case <-waitCh:
-			}
-
-			<-waitCh
+			calcExecTime := metrics.initExec()
+			ret, err := ugo.NewVM(bc).Run(nil)
+			calcExecTime()
 
 			if err != nil {
-				if errors.Is(err, ugo.ErrVMAborted) {
-					if isCtxDone {
-						err = fmt.Errorf("%w %w", err, ctx.Err())
-					} else {
-						err = fmt.Errorf("%w %s playground max execution time",
-							err, maxExecDuration.String())
-					}
+				if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+					err = fmt.Errorf("%w: %s playground max execution time",
+						err, maxExecDuration.String())
 				}
 				e := fmt.Sprintf("%+v", err)
 				callback(newResult(e, "", metrics.output()))